@@ -6,6 +6,8 @@ import (
 	"io"
 	"math"
 	"reflect"
+	"sort"
+	"unicode/utf8"
 )
 
 // An Encoder encodes Go data structures into pickle byte stream
@@ -18,9 +20,11 @@ func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{w: w}
 }
 
-// Encode writes the pickle encoding of v to w, the encoder's writer
+// Encode writes the pickle encoding of v to w, the encoder's writer.
+// The pickle uses protocol 2, and is loadable by Python 2 and 3.
 func (e *Encoder) Encode(v interface{}) error {
 	rv := reflectValueOf(v)
+	e.w.Write([]byte{opProto, 2})
 	e.encode(rv)
 	e.w.Write([]byte{opStop})
 	return nil
@@ -35,7 +39,11 @@ func (e *Encoder) encode(rv reflect.Value) error {
 	case reflect.Int, reflect.Int8, reflect.Int64, reflect.Int32, reflect.Int16:
 		e.encodeInt(reflect.Int, rv.Int())
 	case reflect.Uint8, reflect.Uint64, reflect.Uint, reflect.Uint32, reflect.Uint16:
-		e.encodeInt(reflect.Uint, int64(rv.Uint()))
+		if u := rv.Uint(); u > math.MaxInt64 {
+			fmt.Fprintf(e.w, "%c%d\n", opInt, u)
+		} else {
+			e.encodeInt(reflect.Uint, int64(u))
+		}
 	case reflect.String:
 		e.encodeString(rv.String())
 	case reflect.Array, reflect.Slice:
@@ -100,26 +108,33 @@ func (e *Encoder) encodeArray(arr reflect.Value) {
 
 func (e *Encoder) encodeBool(b bool) {
 	if b {
-		e.w.Write([]byte(opTrue))
+		e.w.Write([]byte{opNewtrue})
 	} else {
-		e.w.Write([]byte(opFalse))
+		e.w.Write([]byte{opNewfalse})
 	}
 }
 
+// encodeBytes writes byt the way Python 3 pickles bytes under protocol
+// 2, which has no opcode for them: as _codecs.encode(s, 'latin1'),
+// where s has one rune per byte.
 func (e *Encoder) encodeBytes(byt []byte) {
-
-	l := len(byt)
-
-	if l < 256 {
-		e.w.Write([]byte{opShortBinstring, byte(l)})
-	} else {
-		e.w.Write([]byte{opBinstring})
-		var b [4]byte
-		binary.LittleEndian.PutUint32(b[:], uint32(l))
-		e.w.Write(b[:])
+	e.w.Write([]byte("c_codecs\nencode\n"))
+	latin1 := make([]byte, 0, len(byt))
+	for _, c := range byt {
+		latin1 = utf8.AppendRune(latin1, rune(c))
 	}
+	e.encodeUnicode(latin1)
+	e.encodeUnicode([]byte("latin1"))
+	e.w.Write([]byte{opTuple2, opReduce})
+}
 
-	e.w.Write(byt)
+// encodeUnicode writes the UTF-8 string s as a Python unicode string.
+func (e *Encoder) encodeUnicode(s []byte) {
+	e.w.Write([]byte{opBinunicode})
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(s)))
+	e.w.Write(b[:])
+	e.w.Write(s)
 }
 
 func (e *Encoder) encodeFloat(f float64) {
@@ -154,6 +169,10 @@ func (e *Encoder) encodeInt(k reflect.Kind, i int64) {
 func (e *Encoder) encodeMap(m reflect.Value) {
 
 	keys := m.MapKeys()
+	// sort string keys, so that the encoding is deterministic.
+	if m.Type().Key().Kind() == reflect.String {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	}
 
 	l := len(keys)
 
@@ -172,7 +191,10 @@ func (e *Encoder) encodeMap(m reflect.Value) {
 }
 
 func (e *Encoder) encodeString(s string) {
-	e.encodeBytes([]byte(s))
+	if !utf8.ValidString(s) {
+		panic(fmt.Sprintf("string is not valid UTF-8: %q", s))
+	}
+	e.encodeUnicode([]byte(s))
 }
 
 func (e *Encoder) encodeStruct(st reflect.Value) {
@@ -28,6 +28,11 @@ func TestEncode(t *testing.T) {
 			[]interface{}{int64(0), int64(1), int64(258), int64(65537), false, true},
 			nil,
 		},
+		{
+			"unicode",
+			map[interface{}]interface{}{"name": "Zoë 日本", "big": int64(1) << 40},
+			nil,
+		},
 		{
 			"array of struct types",
 			[]foo{{"Qux", 4}},
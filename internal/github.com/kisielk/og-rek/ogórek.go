@@ -10,9 +10,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/big"
+	"reflect"
 	"strconv"
+	"unicode/utf8"
 )
 
 // Opcodes
@@ -76,17 +79,87 @@ const (
 	opNewfalse = '\x89' // push False
 	opLong1    = '\x8a' // push long from < 256 bytes
 	opLong4    = '\x8b' // push really big long
+
+	// Protocol 3
+
+	opBinbytes      = 'B' // push bytes; counted binary string argument
+	opShortBinbytes = 'C' //  "     "   ;    "      "       "      " < 256 bytes
+
+	// Protocol 4
+
+	opShortBinunicode = '\x8c' // push short string; UTF-8 length < 256 bytes
+	opBinunicode8     = '\x8d' // push very long string
+	opBinbytes8       = '\x8e' // push very long bytes string
+	opEmptySet        = '\x8f' // push empty set on the stack
+	opAdditems        = '\x90' // modify set by adding topmost stack items
+	opFrozenset       = '\x91' // build frozenset from topmost stack items
+	opNewobjEx        = '\x92' // like NEWOBJ but work with keyword only arguments
+	opStackGlobal     = '\x93' // same as GLOBAL but using names on the stacks
+	opMemoize         = '\x94' // store top of the stack in memo
+	opFrame           = '\x95' // indicate the beginning of a new frame
+
+	// Protocol 5
+
+	opBytearray8     = '\x96' // push bytearray
+	opNextBuffer     = '\x97' // push next out-of-band buffer
+	opReadonlyBuffer = '\x98' // make top of stack readonly
 )
 
+// highestProtocol is the newest pickle protocol the Decoder
+// understands, matching pickle.HIGHEST_PROTOCOL as of Python 3.8.
+const highestProtocol = 5
+
+// opcodeNames maps opcodes to the names pickletools uses for them, so
+// that errors can say which opcode is unsupported.
+var opcodeNames = map[byte]string{
+	opMark: "MARK", opStop: "STOP", opPop: "POP", opPopMark: "POP_MARK",
+	opDup: "DUP", opFloat: "FLOAT", opInt: "INT", opBinint: "BININT",
+	opBinint1: "BININT1", opLong: "LONG", opBinint2: "BININT2",
+	opNone: "NONE", opPersid: "PERSID", opBinpersid: "BINPERSID",
+	opReduce: "REDUCE", opString: "STRING", opBinstring: "BINSTRING",
+	opShortBinstring: "SHORT_BINSTRING", opUnicode: "UNICODE",
+	opBinunicode: "BINUNICODE", opAppend: "APPEND", opBuild: "BUILD",
+	opGlobal: "GLOBAL", opDict: "DICT", opEmptyDict: "EMPTY_DICT",
+	opAppends: "APPENDS", opGet: "GET", opBinget: "BINGET",
+	opInst: "INST", opLongBinget: "LONG_BINGET", opList: "LIST",
+	opEmptyList: "EMPTY_LIST", opObj: "OBJ", opPut: "PUT",
+	opBinput: "BINPUT", opLongBinput: "LONG_BINPUT",
+	opSetitem: "SETITEM", opTuple: "TUPLE", opEmptyTuple: "EMPTY_TUPLE",
+	opSetitems: "SETITEMS", opBinfloat: "BINFLOAT",
+	opProto: "PROTO", opNewobj: "NEWOBJ", opExt1: "EXT1", opExt2: "EXT2",
+	opExt4: "EXT4", opTuple1: "TUPLE1", opTuple2: "TUPLE2",
+	opTuple3: "TUPLE3", opNewtrue: "NEWTRUE", opNewfalse: "NEWFALSE",
+	opLong1: "LONG1", opLong4: "LONG4",
+	opBinbytes: "BINBYTES", opShortBinbytes: "SHORT_BINBYTES",
+	opShortBinunicode: "SHORT_BINUNICODE", opBinunicode8: "BINUNICODE8",
+	opBinbytes8: "BINBYTES8", opEmptySet: "EMPTY_SET",
+	opAdditems: "ADDITEMS", opFrozenset: "FROZENSET",
+	opNewobjEx: "NEWOBJ_EX", opStackGlobal: "STACK_GLOBAL",
+	opMemoize: "MEMOIZE", opFrame: "FRAME",
+	opBytearray8: "BYTEARRAY8", opNextBuffer: "NEXT_BUFFER",
+	opReadonlyBuffer: "READONLY_BUFFER",
+}
+
 var errNotImplemented = errors.New("unimplemented opcode")
 var ErrInvalidPickleVersion = errors.New("invalid pickle version")
 
+// ErrStackUnderflow is returned for malformed pickles whose opcodes
+// consume more values than are on the stack.
+var ErrStackUnderflow = errors.New("pickle stack underflow")
+
+// ErrNoMarker is returned for malformed pickles whose opcodes expect
+// a marker that isn't on the stack.
+var ErrNoMarker = errors.New("no marker in stack")
+
 type OpcodeError struct {
 	Key byte
 	Pos int
 }
 
 func (e OpcodeError) Error() string {
+	if name, ok := opcodeNames[e.Key]; ok {
+		return fmt.Sprintf("Unsupported opcode %s (%q) at position %d", name, e.Key, e.Pos)
+	}
 	return fmt.Sprintf("Unknown opcode %d (%c) at position %d: %q", e.Key, e.Key, e.Pos, e.Key)
 }
 
@@ -128,11 +201,11 @@ func (d Decoder) Decode() (interface{}, error) {
 		case opStop:
 			break
 		case opPop:
-			d.pop()
+			_, err = d.pop()
 		case opPopMark:
-			d.popMark()
+			err = d.popMark()
 		case opDup:
-			d.dup()
+			err = d.dup()
 		case opFloat:
 			err = d.loadFloat()
 		case opInt:
@@ -219,9 +292,32 @@ func (d Decoder) Decode() (interface{}, error) {
 			err = d.binFloat()
 		case opProto:
 			v, _ := d.r.ReadByte()
-			if v != 2 {
-				err = ErrInvalidPickleVersion
+			if v < 2 || v > highestProtocol {
+				err = fmt.Errorf("%w: %d", ErrInvalidPickleVersion, v)
 			}
+		case opNewobj:
+			err = d.reduce()
+		case opLong4:
+			err = d.loadLong4()
+		case opBinbytes:
+			err = d.loadBinBytes()
+		case opShortBinbytes:
+			err = d.loadShortBinBytes()
+		case opShortBinunicode:
+			err = d.loadShortBinUnicode()
+		case opBinunicode8:
+			err = d.loadBinUnicode8()
+		case opBinbytes8, opBytearray8:
+			err = d.loadBinBytes8()
+		case opStackGlobal:
+			err = d.stackGlobal()
+		case opMemoize:
+			err = d.memoize(strconv.Itoa(len(d.memo)))
+		case opFrame:
+			// frames only help buffering; the opcodes they
+			// contain are read as usual.
+			var b [8]byte
+			_, err = io.ReadFull(d.r, b[:])
 
 		default:
 			return nil, OpcodeError{key, insn}
@@ -234,7 +330,7 @@ func (d Decoder) Decode() (interface{}, error) {
 			return nil, err
 		}
 	}
-	return d.pop(), nil
+	return d.pop()
 }
 
 // Push a marker
@@ -243,15 +339,14 @@ func (d *Decoder) mark() {
 }
 
 // Return the position of the topmost marker
-func (d *Decoder) marker() int {
+func (d *Decoder) marker() (int, error) {
 	m := mark{}
-	var k int
-	for k = len(d.stack) - 1; d.stack[k] != m && k > 0; k-- {
-	}
-	if k >= 0 {
-		return k
+	for k := len(d.stack) - 1; k >= 0; k-- {
+		if d.stack[k] == m {
+			return k, nil
+		}
 	}
-	panic("no marker in stack")
+	return -1, ErrNoMarker
 }
 
 // Append a new value
@@ -260,21 +355,52 @@ func (d *Decoder) push(v interface{}) {
 }
 
 // Pop a value
-func (d *Decoder) pop() interface{} {
+func (d *Decoder) pop() (interface{}, error) {
 	ln := len(d.stack) - 1
+	if ln < 0 {
+		return nil, ErrStackUnderflow
+	}
 	v := d.stack[ln]
 	d.stack = d.stack[:ln]
-	return v
+	return v, nil
+}
+
+// Return the top stack item
+func (d *Decoder) top() (interface{}, error) {
+	if len(d.stack) == 0 {
+		return nil, ErrStackUnderflow
+	}
+	return d.stack[len(d.stack)-1], nil
+}
+
+// Store the top stack item in the memo under key
+func (d *Decoder) memoize(key string) error {
+	v, err := d.top()
+	if err != nil {
+		return err
+	}
+	d.memo[key] = v
+	return nil
 }
 
 // Discard the stack through to the topmost marker
 func (d *Decoder) popMark() error {
-	return errNotImplemented
+	k, err := d.marker()
+	if err != nil {
+		return err
+	}
+	d.stack = d.stack[:k]
+	return nil
 }
 
 // Duplicate the top stack item
-func (d *Decoder) dup() {
-	d.stack = append(d.stack, d.stack[len(d.stack)-1])
+func (d *Decoder) dup() error {
+	v, err := d.top()
+	if err != nil {
+		return err
+	}
+	d.push(v)
+	return nil
 }
 
 // Push a float
@@ -324,7 +450,8 @@ func (d *Decoder) loadBinInt() error {
 	if err != nil {
 		return err
 	}
-	v := binary.LittleEndian.Uint32(b[:])
+	// BININT is a signed 32-bit integer
+	v := int32(binary.LittleEndian.Uint32(b[:]))
 	d.push(int64(v))
 	return nil
 }
@@ -342,8 +469,13 @@ func (d *Decoder) loadLong() error {
 	if err != nil {
 		return err
 	}
-	v := new(big.Int)
-	v.SetString(string(line[:len(line)-1]), 10)
+	if len(line) == 0 {
+		return fmt.Errorf("invalid long: %q", line)
+	}
+	v, ok := new(big.Int).SetString(string(line[:len(line)-1]), 10)
+	if !ok {
+		return fmt.Errorf("invalid long: %q", line)
+	}
 	if v.BitLen() < 63 {
 		d.push(v.Int64())
 	} else {
@@ -359,18 +491,42 @@ func (d *Decoder) loadLong1() error {
 	if err != nil {
 		return err
 	}
-	length, err := decodeLong(string(b))
-	if err != nil {
-		return err
-	}
-	for i := 0; int64(i) < length.Int64(); i++ {
+	// the length is unsigned, unlike the number itself.
+	for i := 0; i < int(b); i++ {
 		b2, err := d.r.ReadByte()
 		if err != nil {
 			return err
 		}
 		rawNum = append(rawNum, b2)
 	}
+	return d.pushLong(rawNum)
+}
+
+// Push a long4
+func (d *Decoder) loadLong4() error {
+	var b [4]byte
+	_, err := io.ReadFull(d.r, b[:])
+	if err != nil {
+		return err
+	}
+	n := int32(binary.LittleEndian.Uint32(b[:]))
+	if n < 0 {
+		return fmt.Errorf("invalid long4 length: %d", n)
+	}
+	rawNum, err := d.readN(uint64(n))
+	if err != nil {
+		return err
+	}
+	return d.pushLong(rawNum)
+}
+
+// pushLong pushes the little-endian two's complement number in
+// rawNum, as an int64 if it fits.
+func (d *Decoder) pushLong(rawNum []byte) error {
 	decodedNum, err := decodeLong(string(rawNum))
+	if err != nil {
+		return err
+	}
 	if decodedNum.BitLen() < 63 {
 		d.push(decodedNum.Int64())
 	} else {
@@ -413,8 +569,21 @@ type Call struct {
 }
 
 func (d *Decoder) reduce() error {
-	args := d.pop().([]interface{})
-	class := d.pop().(Class)
+	v, err := d.pop()
+	if err != nil {
+		return err
+	}
+	args, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("REDUCE expected a tuple of args, got %T", v)
+	}
+	if v, err = d.pop(); err != nil {
+		return err
+	}
+	class, ok := v.(Class)
+	if !ok {
+		return fmt.Errorf("REDUCE expected a class, got %T", v)
+	}
 	d.stack = append(d.stack, Call{Callable: class, Args: args})
 	return nil
 }
@@ -431,6 +600,10 @@ func (d *Decoder) loadString() error {
 		return err
 	}
 
+	if len(line) < 2 {
+		return fmt.Errorf("insecure string")
+	}
+
 	var delim byte
 	switch line[0] {
 	case '\'':
@@ -455,9 +628,7 @@ func (d *Decoder) loadBinString() error {
 	if err != nil {
 		return err
 	}
-	v := binary.LittleEndian.Uint32(b[:])
-	s := make([]byte, v)
-	_, err = io.ReadFull(d.r, s)
+	s, err := d.readN(uint64(binary.LittleEndian.Uint32(b[:])))
 	if err != nil {
 		return err
 	}
@@ -485,20 +656,27 @@ func (d *Decoder) loadUnicode() error {
 
 	buf := bytes.Buffer{}
 
-	for len(sline) >= 6 {
-		var r rune
-		var err error
-		r, _, sline, err = strconv.UnquoteChar(sline, '\'')
-		if err != nil {
-			return err
+	// the line is in Python's raw-unicode-escape encoding: bytes
+	// are latin-1 characters, except for \uXXXX and \UXXXXXXXX
+	// escapes.
+	for len(sline) > 0 {
+		n := 0
+		if len(sline) >= 6 && sline[:2] == "\\u" {
+			n = 6
+		} else if len(sline) >= 10 && sline[:2] == "\\U" {
+			n = 10
 		}
-		_, err = buf.WriteRune(r)
-		if err != nil {
-			return err
+		if n == 0 {
+			buf.WriteRune(rune(sline[0]))
+			sline = sline[1:]
+			continue
 		}
-	}
-	if len(sline) > 0 {
-		return fmt.Errorf("characters remaining after loadUnicode operation: %s", sline)
+		r, err := strconv.ParseUint(sline[2:n], 16, 32)
+		if err != nil || r > utf8.MaxRune {
+			return fmt.Errorf("invalid escape in loadUnicode operation: %s", sline[:n])
+		}
+		buf.WriteRune(rune(r))
+		sline = sline[n:]
 	}
 
 	d.push(buf.String())
@@ -526,9 +704,104 @@ func (d *Decoder) loadBinUnicode() error {
 	return nil
 }
 
+func (d *Decoder) loadShortBinUnicode() error {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	s := make([]byte, b)
+	_, err = io.ReadFull(d.r, s)
+	if err != nil {
+		return err
+	}
+	d.push(string(s))
+	return nil
+}
+
+func (d *Decoder) loadBinUnicode8() error {
+	s, err := d.readBytes8()
+	if err != nil {
+		return err
+	}
+	d.push(string(s))
+	return nil
+}
+
+// Push bytes, which are decoded as a []byte
+func (d *Decoder) loadBinBytes() error {
+	var b [4]byte
+	_, err := io.ReadFull(d.r, b[:])
+	if err != nil {
+		return err
+	}
+	s, err := d.readN(uint64(binary.LittleEndian.Uint32(b[:])))
+	if err != nil {
+		return err
+	}
+	d.push(s)
+	return nil
+}
+
+func (d *Decoder) loadShortBinBytes() error {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	s := make([]byte, b)
+	_, err = io.ReadFull(d.r, s)
+	if err != nil {
+		return err
+	}
+	d.push(s)
+	return nil
+}
+
+func (d *Decoder) loadBinBytes8() error {
+	s, err := d.readBytes8()
+	if err != nil {
+		return err
+	}
+	d.push(s)
+	return nil
+}
+
+// readBytes8 reads a string of bytes preceded by its 8-byte length.
+func (d *Decoder) readBytes8() ([]byte, error) {
+	var b [8]byte
+	_, err := io.ReadFull(d.r, b[:])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint64(b[:])
+	if length > math.MaxInt32 {
+		return nil, fmt.Errorf("string too long: %d", length)
+	}
+	return d.readN(length)
+}
+
+// readN reads a string of n bytes.  The lengths of strings are read
+// from the pickle, so rather than trusting them to allocate the whole
+// string up front, it is only allocated as it is read.
+func (d *Decoder) readN(n uint64) ([]byte, error) {
+	s, err := ioutil.ReadAll(io.LimitReader(d.r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(s)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return s, nil
+}
+
 func (d *Decoder) loadAppend() error {
-	v := d.pop()
-	l := d.stack[len(d.stack)-1]
+	v, err := d.pop()
+	if err != nil {
+		return err
+	}
+	l, err := d.top()
+	if err != nil {
+		return err
+	}
 	switch l.(type) {
 	case []interface{}:
 		l := l.([]interface{})
@@ -560,11 +833,40 @@ func (d *Decoder) global() error {
 	return nil
 }
 
+func (d *Decoder) stackGlobal() error {
+	v, err := d.pop()
+	if err != nil {
+		return err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("STACK_GLOBAL expected a string name")
+	}
+	if v, err = d.pop(); err != nil {
+		return err
+	}
+	module, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("STACK_GLOBAL expected a string module")
+	}
+	d.stack = append(d.stack, Class{Module: module, Name: name})
+	return nil
+}
+
 func (d *Decoder) loadDict() error {
-	k := d.marker()
+	k, err := d.marker()
+	if err != nil {
+		return err
+	}
 	m := make(map[interface{}]interface{}, 0)
 	items := d.stack[k+1:]
+	if len(items)%2 != 0 {
+		return fmt.Errorf("DICT expected key-value pairs, got %d items", len(items))
+	}
 	for i := 0; i < len(items); i += 2 {
+		if !hashable(items[i]) {
+			return fmt.Errorf("DICT got an unhashable key: %T", items[i])
+		}
 		m[items[i]] = items[i+1]
 	}
 	d.stack = append(d.stack[:k], m)
@@ -578,7 +880,13 @@ func (d *Decoder) loadEmptyDict() error {
 }
 
 func (d *Decoder) loadAppends() error {
-	k := d.marker()
+	k, err := d.marker()
+	if err != nil {
+		return err
+	}
+	if k == 0 {
+		return ErrStackUnderflow
+	}
 	l := d.stack[k-1]
 	switch l.(type) {
 	case []interface{}:
@@ -629,14 +937,20 @@ func (d *Decoder) loadBool(b bool) error {
 }
 
 func (d *Decoder) loadList() error {
-	k := d.marker()
+	k, err := d.marker()
+	if err != nil {
+		return err
+	}
 	v := append([]interface{}{}, d.stack[k+1:]...)
 	d.stack = append(d.stack[:k], v)
 	return nil
 }
 
 func (d *Decoder) loadTuple() error {
-	k := d.marker()
+	k, err := d.marker()
+	if err != nil {
+		return err
+	}
 	v := append([]interface{}{}, d.stack[k+1:]...)
 	d.stack = append(d.stack[:k], v)
 	return nil
@@ -644,6 +958,9 @@ func (d *Decoder) loadTuple() error {
 
 func (d *Decoder) loadTuple1() error {
 	k := len(d.stack) - 1
+	if k < 0 {
+		return ErrStackUnderflow
+	}
 	v := append([]interface{}{}, d.stack[k:]...)
 	d.stack = append(d.stack[:k], v)
 	return nil
@@ -651,6 +968,9 @@ func (d *Decoder) loadTuple1() error {
 
 func (d *Decoder) loadTuple2() error {
 	k := len(d.stack) - 2
+	if k < 0 {
+		return ErrStackUnderflow
+	}
 	v := append([]interface{}{}, d.stack[k:]...)
 	d.stack = append(d.stack[:k], v)
 	return nil
@@ -658,6 +978,9 @@ func (d *Decoder) loadTuple2() error {
 
 func (d *Decoder) loadTuple3() error {
 	k := len(d.stack) - 3
+	if k < 0 {
+		return ErrStackUnderflow
+	}
 	v := append([]interface{}{}, d.stack[k:]...)
 	d.stack = append(d.stack[:k], v)
 	return nil
@@ -672,27 +995,43 @@ func (d *Decoder) loadPut() error {
 	if err != nil {
 		return err
 	}
-	d.memo[string(line)] = d.stack[len(d.stack)-1]
-	return nil
+	return d.memoize(string(line))
 }
 
 func (d *Decoder) binPut() error {
 	b, _ := d.r.ReadByte()
-	d.memo[strconv.Itoa(int(b))] = d.stack[len(d.stack)-1]
-	return nil
+	return d.memoize(strconv.Itoa(int(b)))
 }
 
 func (d *Decoder) longBinPut() error {
-	return errNotImplemented
+	var b [4]byte
+	_, err := io.ReadFull(d.r, b[:])
+	if err != nil {
+		return err
+	}
+	v := binary.LittleEndian.Uint32(b[:])
+	return d.memoize(strconv.Itoa(int(v)))
 }
 
 func (d *Decoder) loadSetItem() error {
-	v := d.pop()
-	k := d.pop()
-	m := d.stack[len(d.stack)-1]
+	v, err := d.pop()
+	if err != nil {
+		return err
+	}
+	k, err := d.pop()
+	if err != nil {
+		return err
+	}
+	m, err := d.top()
+	if err != nil {
+		return err
+	}
 	switch m.(type) {
 	case map[interface{}]interface{}:
 		m := m.(map[interface{}]interface{})
+		if !hashable(k) {
+			return fmt.Errorf("SETITEM got an unhashable key: %T", k)
+		}
 		m[k] = v
 	default:
 		return fmt.Errorf("loadSetItem expected a map, got %t", m)
@@ -701,11 +1040,23 @@ func (d *Decoder) loadSetItem() error {
 }
 
 func (d *Decoder) loadSetItems() error {
-	k := d.marker()
+	k, err := d.marker()
+	if err != nil {
+		return err
+	}
+	if k == 0 {
+		return ErrStackUnderflow
+	}
 	l := d.stack[k-1]
 	switch m := l.(type) {
 	case map[interface{}]interface{}:
+		if (len(d.stack)-k-1)%2 != 0 {
+			return fmt.Errorf("SETITEMS expected key-value pairs, got %d items", len(d.stack)-k-1)
+		}
 		for i := k + 1; i < len(d.stack); i += 2 {
+			if !hashable(d.stack[i]) {
+				return fmt.Errorf("SETITEMS got an unhashable key: %T", d.stack[i])
+			}
 			m[d.stack[i]] = d.stack[i+1]
 		}
 		d.stack = append(d.stack[:k-1], m)
@@ -726,6 +1077,13 @@ func (d *Decoder) binFloat() error {
 	return nil
 }
 
+// hashable reports whether v can be used as a map key without
+// panicking; Python's lists and dicts, and the Calls reconstructing
+// objects, can't be.
+func hashable(v interface{}) bool {
+	return v == nil || reflect.TypeOf(v).Comparable()
+}
+
 // decodeLong takes a byte array of 2's compliment little-endian binary words and converts them
 // to a big integer
 func decodeLong(data string) (*big.Int, error) {
@@ -18,7 +18,7 @@ func TestMarker(t *testing.T) {
 	buf := bytes.Buffer{}
 	dec := NewDecoder(&buf)
 	dec.mark()
-	if dec.marker() != 0 {
+	if k, err := dec.marker(); err != nil || k != 0 {
 		t.Error("no marker found")
 	}
 }
@@ -35,6 +35,13 @@ func TestDecode(t *testing.T) {
 	}{
 		{"int", "I5\n.", int64(5)},
 		{"float", "F1.23\n.", float64(1.23)},
+		{"negative binint", "J\xff\xff\xff\xff.", int64(-1)},
+		{"protocol 4 frame", "\x80\x04\x95\x02\x00\x00\x00\x00\x00\x00\x00K\x05.", int64(5)},
+		{"short binbytes", "C\x02ab.", []byte("ab")},
+		{"binbytes", "B\x02\x00\x00\x00ab.", []byte("ab")},
+		{"short binunicode", "\x8c\x03abc.", "abc"},
+		{"long4", "\x8b\x02\x00\x00\x00\xff\x00.", int64(255)},
+		{"STACK_GLOBAL and MEMOIZE", "\x8c\x03foo\x94\x8c\x03bar\x94\x93\x94)R.", Call{Callable: Class{Module: "foo", Name: "bar"}, Args: []interface{}{}}},
 		{"long", "L12321231232131231231L\n.", bigInt("12321231232131231231")},
 		{"None", "N.", None{}},
 		{"empty tuple", "(t.", []interface{}{}},
@@ -48,6 +55,7 @@ func TestDecode(t *testing.T) {
 		{"list of numbers", "(lp0\nI1\naI2\naI3\naI4\na.", []interface{}{int64(1), int64(2), int64(3), int64(4)}},
 		{"string", "S'abc'\np0\n.", string("abc")},
 		{"unicode", "V\\u65e5\\u672c\\u8a9e\np0\n.", string("日本語")},
+		{"raw unicode", "Vcaf\xe9 \\u65e5\\U0001f600\\u005cx\np0\n.", string("café 日\U0001f600\\x")},
 		{"empty dict", "(dp0\n.", make(map[interface{}]interface{})},
 		{"dict with strings", "(dp0\nS'a'\np1\nS'1'\np2\nsS'b'\np3\nS'2'\np4\ns.", map[interface{}]interface{}{"a": "1", "b": "2"}},
 		{"GLOBAL and REDUCE opcodes", "cfoo\nbar\nS'bing'\n\x85R.", Call{Callable: Class{Module: "foo", Name: "bar"}, Args: []interface{} {"bing"}}},
@@ -69,6 +77,58 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   error
+	}{
+		{"empty", "", ErrStackUnderflow},
+		{"pop", "0.", ErrStackUnderflow},
+		{"dup", "2.", ErrStackUnderflow},
+		{"put", "p0\n.", ErrStackUnderflow},
+		{"memoize", "\x94.", ErrStackUnderflow},
+		{"append", "]a.", ErrStackUnderflow},
+		{"tuple2", "K\x01\x86.", ErrStackUnderflow},
+		{"appends without list", "(K\x01e.", ErrStackUnderflow},
+		{"list without marker", "K\x01l.", ErrNoMarker},
+		{"dict without marker", "d.", ErrNoMarker},
+		{"setitems without marker", "}u.", ErrNoMarker},
+	}
+	for _, test := range tests {
+		dec := NewDecoder(bytes.NewBufferString(test.input))
+		if _, err := dec.Decode(); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	for _, input := range []string{
+		"(K\x01d.",
+		"}(]K\x01u.",
+		"}]K\x01s.",
+		"K\x01K\x02R.",
+		"L\n.",
+		"S\n.",
+		"B\xff\xff\xff\xff.",
+		"\x8b\xff\xff\xff\xff.",
+		"V\\uzzzz\n.",
+		"V\\U00110000\n.",
+	} {
+		dec := NewDecoder(bytes.NewBufferString(input))
+		if _, err := dec.Decode(); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestPopMark(t *testing.T) {
+	dec := NewDecoder(bytes.NewBufferString("K\x01(K\x02K\x031."))
+	v, err := dec.Decode()
+	if err != nil || v != int64(1) {
+		t.Errorf("POP_MARK: got %#v, %v", v, err)
+	}
+}
+
 func TestZeroLengthData(t *testing.T) {
 	data := ""
 	output, err := decodeLong(data)
@@ -3,23 +3,31 @@
 // license that can be found in the LICENSE file.
 
 /*
-	The signedcookie package implements read-only access to
-	cookies generated by Django's signed_cookies session backend.
+The signedcookie package implements reading and writing of
+cookies compatible with Django's signed_cookies session backend.
 */
 package signedcookie
 
 import (
+	"bufio"
 	"bytes"
-	"compress/zlib"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
-	"crypto/subtle"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"math"
 	"strings"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/bpowers/go-django/internal/github.com/kisielk/og-rek"
 )
@@ -31,176 +39,1090 @@ type Serializer int
 const (
 	JSON Serializer = iota
 	Pickle
+	// AutoSerializer detects the serializer of each payload with
+	// DetectSerializer, for cookies from apps whose
+	// SESSION_SERIALIZER isn't known or is being changed.  If the
+	// detected serializer fails, the other is tried, except by
+	// DecodeReader and DecodeContext, which can't reread the
+	// payload.  It can't be used to encode.
+	AutoSerializer
 )
 
+// String returns the serializer's name, such as "JSON" or "Pickle".
+func (s Serializer) String() string {
+	switch s {
+	case JSON:
+		return "JSON"
+	case Pickle:
+		return "Pickle"
+	case AutoSerializer:
+		return "AutoSerializer"
+	}
+	return fmt.Sprintf("Serializer(%d)", int(s))
+}
+
+// Algorithm represents the digest used to compute HMAC signatures,
+// corresponding to the algorithm argument of
+// django.core.signing.Signer.  Django 3.1 changed the default from
+// SHA1 to SHA256.  Digests other than these can be used with
+// WithHashFunc.
+type Algorithm int
+
+// The digests Django's signing is commonly configured with, named as
+// in the algorithm argument: "sha1", "sha256", "sha384" and "sha512".
+const (
+	SHA1 Algorithm = iota
+	SHA256
+	SHA384
+	SHA512
+)
+
+// hash returns the constructor for the digest a represents, or nil
+// if a is not a known Algorithm.
+func (a Algorithm) hash() func() hash.Hash {
+	switch a {
+	case SHA1:
+		return sha1.New
+	case SHA256:
+		return sha256.New
+	case SHA384:
+		return sha512.New384
+	case SHA512:
+		return sha512.New
+	}
+	return nil
+}
+
 // Django's default max_age is defined as 2 weeks.
 const DefaultMaxAge = 14 * 24 * time.Hour
 
-// the salt value used by the signed_cookies SessionStore, it is not
-// configurable through normal means.
-const salt = "django.contrib.sessions.backends.signed_cookies"
+// SessionCookieAge is the max age of Decoders created without
+// WithMaxAge, playing the part of Django's SESSION_COOKIE_AGE setting
+// for apps that change it.  It is read by NewDecoder, so it should be
+// set once at startup, before any Decoders are created, rather than
+// modified concurrently with them.
+var SessionCookieAge = DefaultMaxAge
+
+// DefaultMaxDecompressedSize bounds the size a compressed payload may
+// expand to.  Browsers limit cookies to around 4 KB, so 1 MiB is
+// already far more than any legitimate session needs.
+const DefaultMaxDecompressedSize = 1 << 20
+
+// DefaultMaxCookieLength bounds the length of the cookies a Decoder
+// accepts.  Browsers limit cookies to around 4 KB, so longer cookies
+// can only have been crafted, and are rejected before any work is
+// done on them.
+const DefaultMaxCookieLength = 8 << 10
+
+// DefaultSalt is the salt django.core.signing.dumps and loads use when
+// the caller doesn't pass one.
+const DefaultSalt = "django.core.signing"
 
 var defaultSep = []byte{':'}
 
-// b64Encode encodes a slice of bytes in a Django-compatable way,
-// trimming trailing '=' padding specified by the standard.
+// b64Encode encodes a slice of bytes in a Django-compatable way:
+// URL-safe base64 without '=' padding.
 func b64Encode(b []byte) []byte {
-	var buf bytes.Buffer
-	encoder := base64.NewEncoder(base64.URLEncoding, &buf)
-	encoder.Write(b)
-	encoder.Close()
-	return bytes.TrimRight(buf.Bytes(), "=")
+	out := make([]byte, base64.RawURLEncoding.EncodedLen(len(b)))
+	base64.RawURLEncoding.Encode(out, b)
+	return out
 }
 
 // b64Decode decodes a base64-encoded string that was generated by
-// Django - specifically it adds any '=' padding that had previously
-// been stripped back to the end of the byte slice to ensure Go's
-// base64 decoder reads the entire payload.
+// Django, which strips all '=' padding from its encoded
+// representation.  b is not modified.
 func b64Decode(b []byte) ([]byte, error) {
-	// Django's signing module strips all '=' padding from its
-	// encoded representation of b.  Add them back here.
-	pad := 4 - (len(b) % 4)
-	for i := 0; i < pad; i++ {
-		// append is ideal here, because we can overwrite the
-		// timestamp that immediately follows the payload and
-		// avoid an allocation.
-		b = append(b, '=')
+	out := make([]byte, base64.RawURLEncoding.DecodedLen(len(b)))
+	n, err := base64.RawURLEncoding.Decode(out, b)
+	if err != nil {
+		return nil, err
 	}
-	return ioutil.ReadAll(base64.NewDecoder(base64.URLEncoding, bytes.NewReader(b)))
+	return out[:n], nil
 }
 
 var (
 	base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	base36Alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
 )
 
 // b62decode decodes a base62-encoded string into an int64, using the
-// same method as Django's django.utils.baseconv.BaseConverter.
+// same method as Django's django.utils.baseconv.BaseConverter.  A
+// leading '-' denotes a negative number.  Values that don't fit in an
+// int64 are an error, rather than silently wrapping around.
 func b62Decode(b []byte) (int64, error) {
-	var n int64
+	return baseDecode(base62Alphabet, b)
+}
+
+// b62Encode encodes an int64 as a base62 string, using the same
+// method as Django's django.utils.baseconv.BaseConverter: zero is
+// "0", and negative numbers are prefixed with '-'.
+func b62Encode(n int64) []byte {
+	return baseEncode(base62Alphabet, n)
+}
+
+// base36Decode is like b62Decode, but decodes the lowercase base36 of
+// django.utils.http.int_to_base36, used by password reset tokens.
+func base36Decode(b []byte) (int64, error) {
+	return baseDecode(base36Alphabet, b)
+}
+
+// base36Encode is like b62Encode, but encodes n in lowercase base36,
+// as django.utils.http.int_to_base36 does.  Negative numbers, which
+// int_to_base36 rejects, are prefixed with '-' as for base62.
+func base36Encode(n int64) []byte {
+	return baseEncode(base36Alphabet, n)
+}
+
+// baseDecode decodes b, a number written with the digits of alphabet
+// and optionally a leading '-', into an int64.
+func baseDecode(alphabet string, b []byte) (int64, error) {
+	neg := len(b) > 0 && b[0] == '-'
+	if neg {
+		b = b[1:]
+	}
+	// the magnitude is accumulated unsigned, as that of
+	// math.MinInt64 doesn't fit in an int64.
+	limit := uint64(math.MaxInt64)
+	if neg {
+		limit++
+	}
+	var n uint64
 	for _, d := range b {
-		i := strings.IndexByte(base62Alphabet, d)
+		i := strings.IndexByte(alphabet, d)
 		if i < 0 {
-			return -1, fmt.Errorf("not base62 encoded")
+			return -1, fmt.Errorf("not base%d encoded", len(alphabet))
 		}
-		n = n*int64(len(base62Alphabet)) + int64(i)
+		if n > (limit-uint64(i))/uint64(len(alphabet)) {
+			return -1, fmt.Errorf("base%d value overflows int64: %s", len(alphabet), b)
+		}
+		n = n*uint64(len(alphabet)) + uint64(i)
+	}
+	if neg {
+		return -int64(n), nil
 	}
-	return n, nil
+	return int64(n), nil
 }
 
-// djangoSignature calculates a HMAC signature in a way that matches
-// django.core.signing.Signer.signature().
-func djangoSignature(salt string, value []byte, secret string) []byte {
-	// explicit make + append instead of
-	// []byte(salt+"signer"+secret) avoids an allocation. copy
-	// instead of append doesn't change allocation count.
-	key := make([]byte, 0, len(salt)+len("signer")+len(secret))
-	key = append(key, salt...)
-	key = append(key, "signer"...)
-	key = append(key, secret...)
-	mac := hmac.New(sha1.New, key)
+// baseEncode is the inverse of baseDecode.
+func baseEncode(alphabet string, n int64) []byte {
+	if n == 0 {
+		return []byte{alphabet[0]}
+	}
+	// 64 binary digits plus a sign are enough to hold any int64 in
+	// any base.  Working with the magnitude as a uint64 avoids
+	// overflow when negating math.MinInt64.
+	var buf [65]byte
+	i := len(buf)
+	u := uint64(n)
+	if n < 0 {
+		u = -u
+	}
+	for u > 0 {
+		i--
+		buf[i] = alphabet[u%uint64(len(alphabet))]
+		u /= uint64(len(alphabet))
+	}
+	if n < 0 {
+		i--
+		buf[i] = '-'
+	}
+	return append([]byte(nil), buf[i:]...)
+}
+
+// saltedHMAC returns the HMAC of value, keyed the same way as
+// django.utils.crypto.salted_hmac.
+func saltedHMAC(a Algorithm, keySalt string, value []byte, secret string) []byte {
+	mac := hmac.New(a.hash(), saltedHMACKey(a.hash(), keySalt, secret))
 	mac.Write(value)
-	return b64Encode(mac.Sum(nil))
+	return mac.Sum(nil)
 }
 
-// unsign returns the cookie payload if the signature matches the
-// expected signature using the given secret, or an error otherwise.
-func unsign(secret string, cookie []byte) ([]byte, error) {
-	i := bytes.LastIndex(cookie, defaultSep)
-	if i == -1 {
-		return nil, fmt.Errorf("expected : in '%s'", string(cookie))
+// SaltedHMACKey returns the HMAC key django.utils.crypto.salted_hmac
+// derives from keySalt and secret: the digest of keySalt followed by
+// secret, rather than their concatenation itself.  Signer signs with
+// the key salt of its salt followed by "signer".  It returns nil if
+// a is not a known Algorithm.
+func SaltedHMACKey(keySalt, secret string, a Algorithm) []byte {
+	h := a.hash()
+	if h == nil {
+		return nil
 	}
-	val := cookie[:i]
-	sig := cookie[i+1:]
-	expectedSig := djangoSignature(salt, val, secret)
-	if subtle.ConstantTimeCompare([]byte(sig), expectedSig) != 1 {
-		return nil, fmt.Errorf("signature mismatch: '%s' != '%s'", sig, string(expectedSig))
+	return saltedHMACKey(h, keySalt, secret)
+}
+
+func saltedHMACKey(h func() hash.Hash, keySalt, secret string) []byte {
+	kh := h()
+	kh.Write([]byte(keySalt))
+	kh.Write([]byte(secret))
+	return kh.Sum(nil)
+}
+
+// signingLoads implements cookie object decoding in a way that is
+// compatable with django.core.signing.loads, using the Decoder's
+// configuration.  It returns a map representing the encoded object
+// and the time the cookie was signed at, or an error if one occured.
+func (d *Decoder) signingLoads(cookie string) (map[string]interface{}, time.Time, error) {
+	o, issued, _, err := d.signingLoadsStage([]byte(cookie))
+	return o, issued, err
+}
+
+// signingLoadsStage is like signingLoads, but additionally returns
+// the Stage that failed, or StageDeserialize if none did.
+func (d *Decoder) signingLoadsStage(cookie []byte) (map[string]interface{}, time.Time, Stage, error) {
+	payload, issued, _, stage, err := d.loadPayloadStage(cookie)
+	if err != nil {
+		if d.expiredError && errors.Is(err, ErrExpired) {
+			err = d.decodeExpired(cookie, err)
+		}
+		return nil, time.Time{}, stage, err
 	}
-	return val, nil
+	o, err := deserialize(d.serializer, payload)
+	if err != nil {
+		if looksCompressed(payload) {
+			return nil, time.Time{}, StageDeserialize, fmt.Errorf("deserialize: payload lacks the '.' compression prefix, but appears zlib compressed: %w", err)
+		}
+		return nil, time.Time{}, StageDeserialize, fmt.Errorf("deserialize: %w", err)
+	}
+	return o, issued, StageDeserialize, nil
+}
+
+// decodeExpired decodes cookie, which failed to decode with err as it
+// has expired, into an *ExpiredError.  If it can't be decoded even
+// so, err is returned as-is.
+func (d *Decoder) decodeExpired(cookie []byte, err error) error {
+	unchecked := *d
+	unchecked.noExpiry = true
+	o, issued, _, decodeErr := unchecked.signingLoadsStage(cookie)
+	if decodeErr != nil {
+		return err
+	}
+	return &ExpiredError{Session: o, Issued: issued, err: err}
 }
 
-var now = time.Now
+// streamingLoads is like signingLoads, but decompresses and
+// deserializes the payload as a stream, which stops once ctx is done.
+func (d *Decoder) streamingLoads(ctx context.Context, cookie []byte) (map[string]interface{}, error) {
+	if d.observer == nil {
+		o, _, err := d.streamingLoadsStage(ctx, cookie)
+		return o, err
+	}
+	start := time.Now()
+	o, stage, err := d.streamingLoadsStage(ctx, cookie)
+	d.observe(start, stage, err)
+	return o, err
+}
 
-// timestampUnsign returns the cookie payload if the signature matches
-// the expected signature using the given secret, and the timestamp of
-// the cookie is still valid.  It wraps the unsign method.
-func timestampUnsign(maxAge time.Duration, secret string, cookie []byte) ([]byte, error) {
-	val, err := unsign(secret, cookie)
+// streamingLoadsStage is like streamingLoads, but additionally
+// returns the Stage that failed, or StageDeserialize if none did.
+// As base64 decoding and decompression are streamed, their errors
+// are attributed to the first reader in the stream to fail.
+func (d *Decoder) streamingLoadsStage(ctx context.Context, cookie []byte) (map[string]interface{}, Stage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, StageSignature, err
+	}
+	payload, _, _, stage, err := d.unsignStage(cookie)
 	if err != nil {
-		return nil, fmt.Errorf("unsign('%s'): %s", string(cookie), err)
+		if d.expiredError && errors.Is(err, ErrExpired) {
+			err = d.decodeExpired(cookie, err)
+		}
+		return nil, stage, err
 	}
-	i := bytes.LastIndex(val, defaultSep)
-	if i == -1 {
-		return nil, fmt.Errorf("expected : in '%s'", string(cookie))
+	var failed streamStage
+	rc, stage, err := payloadReader(payload, d.compressor, d.maxDecompressedSize, &failed)
+	if err != nil {
+		return nil, stage, err
 	}
-	ts := val[i+1:]
-	val = val[:i]
-	stamp, err := b62Decode(ts)
+	// closing returns pooled decompressors, like zlib's, for reuse.
+	defer rc.Close()
+	var r io.Reader = rc
+	if ctx.Done() != nil {
+		r = &ctxReader{ctx: ctx, r: r}
+	}
+	o, err := deserializeReader(d.serializer, r)
 	if err != nil {
-		return nil, fmt.Errorf("b62Decode: %s", err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, StageDeserialize, ctxErr
+		}
+		if failed.failed {
+			return nil, failed.stage, err
+		}
+		return nil, StageDeserialize, err
 	}
-	if time.Unix(stamp, 0).Add(maxAge).Before(now()) {
-		return nil, fmt.Errorf("expired timestamp: %d", stamp)
+	return o, StageDeserialize, nil
+}
+
+// A streamStage records the Stage of the first reader in a payload
+// stream to fail.
+type streamStage struct {
+	stage  Stage
+	failed bool
+}
+
+// stageReader reads from r, recording stage in s if r is the first
+// reader to fail.
+type stageReader struct {
+	r     io.Reader
+	stage Stage
+	s     *streamStage
+}
+
+func (r *stageReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && !r.s.failed {
+		r.s.stage, r.s.failed = r.stage, true
 	}
-	return val, nil
+	return n, err
 }
 
-// signingLoads implements cookie object decoding in a way that is
-// compatable with django.core.signing.loads.  It returns a map
-// representing the encoded object, or an error if one occured.
-func signingLoads(s Serializer, maxAge time.Duration, secret, cookie string) (map[string]interface{}, error) {
-	c := []byte(cookie) // XXX: does this escape?
-	payload, err := timestampUnsign(maxAge, secret, c)
+// ctxReader reads from r until ctx is done, after which reads fail
+// with ctx.Err().
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// looksCompressed reports whether payload starts with a valid zlib
+// header (RFC 1950) using the deflate method, as zlib.compress output
+// does.
+func looksCompressed(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	cmf, flg := payload[0], payload[1]
+	return cmf&0x0f == 8 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
+
+// unsign verifies cookie's signature and age, returning the still
+// encoded payload, the time it was signed at and the index of the
+// secret it was signed with.  Cookies quoted the way Python's
+// http.cookies quotes values, as some clients and servers pass them
+// on, are unquoted first.
+func (d *Decoder) unsign(cookie []byte) ([]byte, time.Time, int, error) {
+	payload, issued, key, _, err := d.unsignStage(cookie)
+	return payload, issued, key, err
+}
+
+// unsignStage is like unsign, but additionally returns the Stage that
+// failed, if any.
+func (d *Decoder) unsignStage(cookie []byte) ([]byte, time.Time, int, Stage, error) {
+	if err := d.checkLength(cookie); err != nil {
+		return nil, time.Time{}, 0, StageSignature, err
+	}
+	cookie = unquoteCookie(cookie)
+	signer, err := d.timestampSigner(cookie)
+	if err != nil {
+		return nil, time.Time{}, 0, StageSignature, err
+	}
+	payload, issued, key, stage, err := signer.timestampUnsignStage(cookie, d.maxAge, !d.noExpiry)
 	if err != nil {
-		return nil, fmt.Errorf("timestampUnsign: %s", err)
+		return nil, time.Time{}, 0, stage, fmt.Errorf("timestampUnsign: %w", err)
 	}
-	decompress := false
-	if payload[0] == '.' {
-		decompress = true
-		payload = payload[1:]
+	return payload, issued, key, stage, nil
+}
+
+// checkLength returns ErrMalformed if cookie is longer than the
+// Decoder's maximum cookie length.
+func (d *Decoder) checkLength(cookie []byte) error {
+	if len(cookie) > d.maxCookieLength {
+		return fmt.Errorf("%w: cookie is %d bytes, more than the maximum of %d", ErrMalformed, len(cookie), d.maxCookieLength)
+	}
+	return nil
+}
+
+// timestampSigner returns the signer cookie is verified with: the
+// Decoder's own, or if it has a secret func, a copy of it with the
+// secrets the func looks up for cookie.
+func (d *Decoder) timestampSigner(cookie []byte) (*TimestampSigner, error) {
+	if d.secretFunc == nil {
+		return &d.signer, nil
 	}
-	payload, err = b64Decode(payload)
+	secrets, err := d.secretFunc(string(cookie))
 	if err != nil {
-		return nil, fmt.Errorf("base64Decode('%s'): %s", string(payload), err)
+		return nil, fmt.Errorf("secret func: %w", err)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("secret func: no secrets for cookie")
+	}
+	signer := d.signer
+	signer.Secret = secrets[0]
+	signer.FallbackSecrets = secrets[1:]
+	signer.macs = nil // keyed with the Decoder's secrets
+	return &signer, nil
+}
+
+// loadPayload verifies the cookie's signature and timestamp, and
+// returns its decoded and decompressed, but still serialized,
+// payload.
+func (d *Decoder) loadPayload(cookie string) ([]byte, time.Time, error) {
+	payload, issued, _, err := d.loadPayloadKey(cookie)
+	return payload, issued, err
+}
+
+// loadPayloadKey is like loadPayload, but additionally returns the
+// index of the secret the cookie was signed with.
+func (d *Decoder) loadPayloadKey(cookie string) ([]byte, time.Time, int, error) {
+	payload, issued, key, _, err := d.loadPayloadStage([]byte(cookie))
+	return payload, issued, key, err
+}
+
+// loadPayloadStage is like loadPayloadKey, but additionally returns
+// the Stage that failed, or the last one performed if none did.
+func (d *Decoder) loadPayloadStage(cookie []byte) ([]byte, time.Time, int, Stage, error) {
+	payload, issued, key, stage, err := d.unsignStage(cookie)
+	if err != nil {
+		return nil, time.Time{}, 0, stage, err
+	}
+	payload, stage, err = decodePayloadStage(payload, d.compressor, d.maxDecompressedSize)
+	if err != nil {
+		return nil, time.Time{}, 0, stage, err
+	}
+	return payload, issued, key, stage, nil
+}
+
+// decodePayload reverses the encoding django.core.signing.dumps
+// applies to a serialized object before signing it: base64, preceded
+// by compression with c if the payload starts with '.'.  Compressed
+// payloads that expand to more than maxSize bytes are rejected.
+func decodePayload(payload []byte, c Compressor, maxSize int64) ([]byte, error) {
+	payload, _, err := decodePayloadStage(payload, c, maxSize)
+	return payload, err
+}
+
+// decodePayloadStage is like decodePayload, but additionally returns
+// the Stage that failed, or the last one performed if none did.
+func decodePayloadStage(payload []byte, c Compressor, maxSize int64) ([]byte, Stage, error) {
+	payload, decompress, err := splitCompressed(payload)
+	if err != nil {
+		return nil, StageBase64, err
+	}
+	decoded, err := b64Decode(payload)
+	if err != nil {
+		return nil, StageBase64, fmt.Errorf("%w: base64Decode('%s'): %w", ErrMalformed, string(payload), err)
 	}
 	if decompress {
-		r, err := zlib.NewReader(bytes.NewReader(payload))
-		if err != nil {
-			return nil, fmt.Errorf("zlib.NewReader: %s", err)
-		}
-		payload, err = ioutil.ReadAll(r)
-		r.Close()
+		decoded, err = decompressPayload(decoded, c, maxSize)
+		return decoded, StageDecompress, err
+	}
+	return decoded, StageBase64, nil
+}
+
+// splitCompressed strips the '.' prefix marking a compressed payload,
+// and reports whether it was present.  Empty payloads, including
+// those that are only the prefix, are malformed.
+func splitCompressed(payload []byte) ([]byte, bool, error) {
+	if len(payload) == 0 {
+		return nil, false, fmt.Errorf("%w: empty payload", ErrMalformed)
+	}
+	if payload[0] != '.' {
+		return payload, false, nil
+	}
+	if len(payload) == 1 {
+		return nil, true, fmt.Errorf("%w: empty payload after the '.' compression prefix", ErrMalformed)
+	}
+	return payload[1:], true, nil
+}
+
+// decompressPayload returns payload decompressed with c, or an error
+// if it expands to more than maxSize bytes.
+func decompressPayload(payload []byte, c Compressor, maxSize int64) ([]byte, error) {
+	r, err := c.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload has the '.' compression prefix, but isn't %s compressed: %w", ErrMalformed, compressorName(c), err)
+	}
+	// read one byte past the limit to tell a payload of exactly
+	// maxSize from one that was truncated.
+	payload, err = ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: ReadAll(%s): %w", ErrMalformed, compressorName(c), err)
+	}
+	if int64(len(payload)) > maxSize {
+		return nil, fmt.Errorf("%w: decompressed payload exceeds %d bytes", ErrMalformed, maxSize)
+	}
+	return payload, nil
+}
+
+// payloadReader is the streaming counterpart of decodePayload: it
+// returns a reader that base64 decodes, and if needed decompresses,
+// payload as it is read, and must be closed once read.  If creating
+// the reader fails, the Stage that failed is returned; failures while
+// reading are recorded in failed.
+func payloadReader(payload []byte, c Compressor, maxSize int64, failed *streamStage) (io.ReadCloser, Stage, error) {
+	payload, decompress, err := splitCompressed(payload)
+	if err != nil {
+		return nil, StageBase64, err
+	}
+	var r io.Reader = &stageReader{
+		r:     base64.NewDecoder(base64.RawURLEncoding, bytes.NewReader(payload)),
+		stage: StageBase64,
+		s:     failed,
+	}
+	if decompress {
+		zr, err := c.NewReader(r)
 		if err != nil {
-			return nil, fmt.Errorf("ReadAll(zlib): %s", err)
+			return nil, StageDecompress, fmt.Errorf("%w: %s.NewReader: %w", ErrMalformed, compressorName(c), err)
 		}
+		r = &stageReader{r: &maxSizeReader{r: zr, max: maxSize, n: maxSize}, stage: StageDecompress, s: failed}
+		return readCloser{r, zr}, StageDeserialize, nil
+	}
+	return ioutil.NopCloser(r), StageDeserialize, nil
+}
+
+// readCloser reads from a Reader wrapping the decompressor it closes.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// maxSizeReader reads from r, failing with ErrMalformed once more
+// than max bytes have been read.
+type maxSizeReader struct {
+	r   io.Reader
+	max int64
+	n   int64 // bytes remaining before the limit is exceeded
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, fmt.Errorf("%w: decompressed payload exceeds %d bytes", ErrMalformed, m.max)
+	}
+	return n, err
+}
+
+// deserialize converts a serialized payload into a map, using the
+// same format as the Django serializer s.
+func deserialize(s Serializer, payload []byte) (map[string]interface{}, error) {
+	if s == AutoSerializer {
+		var o map[string]interface{}
+		err := autoDeserialize(payload, func(s Serializer) (err error) {
+			o, err = deserialize(s, payload)
+			return err
+		})
+		return o, err
+	}
+	switch s {
+	case JSON:
+	case Pickle:
+		return pickleLoads(bytes.NewReader(payload))
+	default:
+		return nil, unknownSerializer(s)
 	}
 	o := make(map[string]interface{})
-	if s == JSON {
-		json.Unmarshal(payload, &o)
-	} else {
-		d := ogórek.NewDecoder(bytes.NewReader(payload))
-		val, err := d.Decode()
-		if err != nil {
-			return nil, fmt.Errorf("Decode: %s", err)
+	if err := jsonUnmarshal(payload, &o); err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, errNullPayload
+	}
+	return o, nil
+}
+
+// errNullPayload is returned for JSON payloads of null, which
+// json.Unmarshal accepts in place of an object, leaving a nil map.
+var errNullPayload = fmt.Errorf("%w: payload is null, not an object", ErrMalformed)
+
+// jsonUnmarshal is json.Unmarshal, but rejects payloads that aren't
+// valid UTF-8, rather than replacing the invalid bytes in strings with
+// U+FFFD as json.Unmarshal does.  Django's JSONSerializer only writes
+// ASCII, so such payloads can only have been crafted.
+func jsonUnmarshal(payload []byte, v interface{}) error {
+	if !utf8.Valid(payload) {
+		return fmt.Errorf("%w: json.Unmarshal: %w", ErrMalformed, errInvalidUTF8)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("%w: json.Unmarshal: %w", ErrMalformed, err)
+	}
+	return nil
+}
+
+var errInvalidUTF8 = errors.New("invalid UTF-8")
+
+// A utf8Reader passes on reads from r, failing with errInvalidUTF8
+// once it has read bytes that aren't valid UTF-8.
+type utf8Reader struct {
+	r io.Reader
+	// tail holds the start of a rune split across reads.
+	tail [utf8.UTFMax]byte
+	n    int
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	b := p[:n]
+	if u.n > 0 {
+		for len(b) > 0 && !utf8.FullRune(u.tail[:u.n]) {
+			u.tail[u.n] = b[0]
+			u.n++
+			b = b[1:]
+		}
+		if !utf8.FullRune(u.tail[:u.n]) {
+			return u.eof(n, err)
 		}
-		mapI, ok := val.(map[interface{}]interface{})
-		if !ok {
-			return nil, fmt.Errorf("mapI not an object: %#v", mapI)
+		if r, size := utf8.DecodeRune(u.tail[:u.n]); r == utf8.RuneError && size == 1 {
+			return 0, errInvalidUTF8
 		}
-		for ki, v := range mapI {
-			k, ok := ki.(string)
-			if !ok {
-				return nil, fmt.Errorf("non-string key in map: %#v", ki)
+		u.n = 0
+	}
+	// hold back a rune the next read completes.
+	i := len(b)
+	for j := len(b) - 1; j >= 0 && j > len(b)-utf8.UTFMax; j-- {
+		if utf8.RuneStart(b[j]) {
+			if !utf8.FullRune(b[j:]) {
+				i = j
 			}
-			o[k] = v
+			break
 		}
 	}
+	if !utf8.Valid(b[:i]) {
+		return 0, errInvalidUTF8
+	}
+	u.n = copy(u.tail[:], b[i:])
+	return u.eof(n, err)
+}
+
+// eof returns n and err, unless r has ended partway through a rune.
+func (u *utf8Reader) eof(n int, err error) (int, error) {
+	if err == io.EOF && u.n > 0 {
+		return 0, errInvalidUTF8
+	}
+	return n, err
+}
+
+// autoDeserialize calls load with the serializer DetectSerializer
+// picks for payload, and if that fails, with the other one.  During a
+// migration between SESSION_SERIALIZERs, this still decodes cookies
+// DetectSerializer gets wrong, such as pickles of protocols 0 and 1,
+// which lack the PROTO opcode.  The fallback only parses the
+// already verified and decompressed payload again.  If both fail, the
+// detected serializer's error is returned.
+func autoDeserialize(payload []byte, load func(Serializer) error) error {
+	s := DetectSerializer(payload)
+	err := load(s)
+	if err == nil {
+		return nil
+	}
+	fallback := Pickle
+	if s == Pickle {
+		fallback = JSON
+	}
+	if load(fallback) == nil {
+		return nil
+	}
+	return err
+}
+
+// deserializeInto is like deserialize, but stores the dict in dst.
+// JSON is unmarshaled into dst directly; pickled dicts are built
+// first, and copied in.
+func deserializeInto(s Serializer, payload []byte, dst map[string]interface{}) error {
+	if s == AutoSerializer {
+		return autoDeserialize(payload, func(s Serializer) error {
+			for k := range dst {
+				delete(dst, k)
+			}
+			return deserializeInto(s, payload, dst)
+		})
+	}
+	switch s {
+	case JSON:
+	case Pickle:
+		o, err := pickleLoads(bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		for k, v := range o {
+			dst[k] = v
+		}
+		return nil
+	default:
+		return unknownSerializer(s)
+	}
+	// a null payload sets only the local dst to nil.
+	if err := jsonUnmarshal(payload, &dst); err != nil {
+		return err
+	}
+	if dst == nil {
+		return errNullPayload
+	}
+	return nil
+}
+
+// deserializeReader is like deserialize, but parses the serialized
+// payload as it is read from r.
+func deserializeReader(s Serializer, r io.Reader) (map[string]interface{}, error) {
+	if s == AutoSerializer {
+		br := bufio.NewReader(r)
+		// a failed Peek means an empty or unreadable payload,
+		// which either serializer will report.
+		b, _ := br.Peek(1)
+		s, r = DetectSerializer(b), br
+	}
+	switch s {
+	case JSON:
+	case Pickle:
+		return pickleLoads(r)
+	default:
+		return nil, unknownSerializer(s)
+	}
+	o := make(map[string]interface{})
+	dec := json.NewDecoder(&utf8Reader{r: r})
+	if err := dec.Decode(&o); err != nil {
+		return nil, fmt.Errorf("%w: json.Decode: %w", ErrMalformed, err)
+	}
+	// json.Unmarshal rejects trailing data, so do the same here.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: json.Decode: trailing data after object", ErrMalformed)
+	}
+	if o == nil {
+		return nil, errNullPayload
+	}
+	return o, nil
+}
+
+// deserializeValue is like deserialize, but returns whatever value
+// was serialized, rather than requiring it to be an object.  Objects
+// are returned as map[string]interface{}, lists as []interface{}.
+func deserializeValue(s Serializer, payload []byte) (interface{}, error) {
+	if s == AutoSerializer {
+		var v interface{}
+		err := autoDeserialize(payload, func(s Serializer) (err error) {
+			v, err = deserializeValue(s, payload)
+			return err
+		})
+		return v, err
+	}
+	switch s {
+	case JSON:
+	case Pickle:
+		return pickleValueLoads(bytes.NewReader(payload))
+	default:
+		return nil, unknownSerializer(s)
+	}
+	var v interface{}
+	if err := jsonUnmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// DetectSerializer returns the serializer payload, a decompressed
+// but still serialized session, was most likely serialized with.
+// Django's PickleSerializer pickles with protocol 2 or later, whose
+// pickles start with a PROTO opcode, 0x80, which can't start a JSON
+// document.  Anything else is taken to be JSON.
+func DetectSerializer(payload []byte) Serializer {
+	if len(payload) > 0 && payload[0] == 0x80 {
+		return Pickle
+	}
+	return JSON
+}
+
+// unknownSerializer returns the error for a payload serialized with
+// a Serializer other than JSON or Pickle, which can't be decoded.
+func unknownSerializer(s Serializer) error {
+	return fmt.Errorf("%w: unknown serializer: %s", ErrMalformed, s)
+}
+
+// pickleLoads decodes a pickled dict from r, normalized with
+// normalizePickle.
+func pickleLoads(r io.Reader) (map[string]interface{}, error) {
+	val, err := pickleValueLoads(r)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: not an object: %#v", ErrMalformed, val)
+	}
 	return o, nil
 }
 
+// pickleValueLoads decodes any pickled value from r, normalized with
+// normalizePickle.
+func pickleValueLoads(r io.Reader) (interface{}, error) {
+	val, err := ogórek.NewDecoder(r).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("%w: ogórek.Decode: %w", ErrMalformed, err)
+	}
+	return normalizePickle(val)
+}
+
+// jsonDumps serializes obj the same way Django's JSONSerializer
+// does: compact separators, no HTML escaping, and non-ASCII
+// characters escaped as \uXXXX sequences.
+func jsonDumps(obj interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(obj); err != nil {
+		return nil, err
+	}
+	b := bytes.TrimRight(buf.Bytes(), "\n")
+	if !hasNonASCII(b) {
+		return b, nil
+	}
+	out := make([]byte, 0, len(b))
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		b = b[size:]
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+			continue
+		}
+		if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+			out = append(out, fmt.Sprintf("\\u%04x\\u%04x", r1, r2)...)
+		} else {
+			out = append(out, fmt.Sprintf("\\u%04x", r)...)
+		}
+	}
+	return out, nil
+}
+
+func hasNonASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// pickleDumps serializes obj with ogórek's pickle encoder, as a
+// protocol 2 pickle that PickleSerializer loads under Python 2 and 3.
+// Strings are pickled as unicode, and []byte as bytes.
+func pickleDumps(obj interface{}) (b []byte, err error) {
+	// ogórek's encoder panics on types it can't represent.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	var buf bytes.Buffer
+	if err = ogórek.NewEncoder(&buf).Encode(obj); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// signingDumps implements cookie object encoding in a way that is
+// compatable with django.core.signing.dumps, using the Decoder's
+// configuration, as if the current time were signedAt.
+func (d *Decoder) signingDumps(obj interface{}, signedAt time.Time) (string, error) {
+	var payload []byte
+	var err error
+	switch d.serializer {
+	case JSON:
+		payload, err = jsonDumps(obj)
+	case Pickle:
+		payload, err = pickleDumps(obj)
+	case AutoSerializer:
+		err = fmt.Errorf("%s can't encode", d.serializer)
+	default:
+		err = fmt.Errorf("unknown serializer: %s", d.serializer)
+	}
+	if err != nil {
+		return "", fmt.Errorf("serialize: %s", err)
+	}
+	encoded, err := encodePayload(payload, d.compressor, d.compress)
+	if err != nil {
+		return "", err
+	}
+	return string(d.signer.SignAt(encoded, signedAt)), nil
+}
+
+// encodePayload is the inverse of decodePayload.  If compress is set
+// and c can compress, the payload is compressed with c, but as in
+// django.core.signing.dumps the compressed form is only kept if it is
+// actually smaller.
+func encodePayload(payload []byte, c Compressor, compress bool) ([]byte, error) {
+	cw, ok := c.(compressWriter)
+	if !compress || !ok {
+		return b64Encode(payload), nil
+	}
+	var buf bytes.Buffer
+	w := cw.NewWriter(&buf)
+	w.Write(payload)
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("%s.Close: %s", compressorName(c), err)
+	}
+	// the same threshold used by django.core.signing.dumps
+	if buf.Len() >= len(payload)-1 {
+		return b64Encode(payload), nil
+	}
+	return append([]byte{'.'}, b64Encode(buf.Bytes())...), nil
+}
+
 // Decode returns a map corresponding to the object encoded and signed
 // by the django.contrib.sessions.backends.signed_cookies
 // SessionStore, or an error if the cookie could not be decoded or if
 // signature validation failed.
+//
+// Callers decoding many cookies with the same configuration should
+// create a Decoder once instead, which takes its max age from
+// SessionCookieAge unless configured with WithMaxAge.
 func Decode(s Serializer, maxAge time.Duration, secret, cookie string) (map[string]interface{}, error) {
-	return signingLoads(s, maxAge, secret, cookie)
+	return DecodeWithAlgorithm(s, SHA1, maxAge, secret, cookie)
+}
+
+// DecodeWithAlgorithm is like Decode, but verifies the cookie's
+// signature with the digest a rather than SHA1.  Cookies issued by
+// Django 3.1 and later use SHA256.
+func DecodeWithAlgorithm(s Serializer, a Algorithm, maxAge time.Duration, secret, cookie string) (map[string]interface{}, error) {
+	d, err := NewDecoder(secret, WithSerializer(s), WithAlgorithm(a), WithMaxAge(maxAge))
+	if err != nil {
+		return nil, err
+	}
+	return d.Decode(cookie)
+}
+
+// DecodeWithSalt is like Decode, but verifies the cookie's signature
+// using salt rather than the signed_cookies SessionStore's salt.  This
+// allows decoding any map signed with
+// django.core.signing.dumps(obj, salt=salt).
+func DecodeWithSalt(s Serializer, salt string, maxAge time.Duration, secret, cookie string) (map[string]interface{}, error) {
+	d, err := NewDecoder(secret, WithSerializer(s), WithAlgorithm(SHA1), WithMaxAge(maxAge), WithSalt(salt))
+	if err != nil {
+		return nil, err
+	}
+	return d.Decode(cookie)
+}
+
+// DecodeInto is like Decode, but unmarshals a JSON-serialized cookie
+// directly into v, as json.Unmarshal does, rather than returning a
+// map.  Pickle-serialized cookies are not supported.
+func DecodeInto(s Serializer, maxAge time.Duration, secret, cookie string, v interface{}) error {
+	d, err := NewDecoder(secret, WithSerializer(s), WithAlgorithm(SHA1), WithMaxAge(maxAge))
+	if err != nil {
+		return err
+	}
+	return d.DecodeInto(cookie, v)
+}
+
+// DecodeJSONRaw is like Decode for JSON-serialized cookies, but keeps
+// each top-level value of the session as the JSON it was serialized
+// as, rather than converting it.  This preserves values like integers
+// too large for a float64, for callers forwarding them on, or
+// unmarshaling them into their own types.  The same is available from
+// a Decoder with DecodeInto.
+func DecodeJSONRaw(maxAge time.Duration, secret, cookie string) (map[string]json.RawMessage, error) {
+	var o map[string]json.RawMessage
+	if err := DecodeInto(JSON, maxAge, secret, cookie, &o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Encode returns a cookie value containing obj, serialized with s and
+// signed with secret, which the
+// django.contrib.sessions.backends.signed_cookies SessionStore will
+// accept.  It is the inverse of Decode.
+func Encode(s Serializer, secret string, obj map[string]interface{}) (string, error) {
+	d, err := NewDecoder(secret, WithSerializer(s), WithAlgorithm(SHA1))
+	if err != nil {
+		return "", err
+	}
+	return d.Encode(obj)
+}
+
+// Dumps returns obj serialized as JSON and signed with secret and
+// salt, matching django.core.signing.dumps(obj, key=secret,
+// salt=salt, compress=compress).  Pass DefaultSalt to use the salt
+// Django's dumps defaults to; as in Django, an empty salt is replaced
+// by TimestampSigner's.  Values are signed with SHA256, as by Django
+// 3.1 and later.
+func Dumps(obj interface{}, secret, salt string, compress bool) (string, error) {
+	d, err := NewDecoder(secret, WithSalt(salt), WithCompression(compress))
+	if err != nil {
+		return "", err
+	}
+	return d.signingDumps(obj, d.signer.now())
+}
+
+// Loads is the inverse of Dumps, matching
+// django.core.signing.loads(s, key=secret, salt=salt,
+// max_age=maxAge).  A maxAge of zero or less disables the age check,
+// like passing max_age=None.  Dicts are returned as
+// map[string]interface{}, and lists as []interface{}.
+func Loads(s, secret, salt string, maxAge time.Duration) (interface{}, error) {
+	opts := []Option{WithSalt(salt), WithMaxAge(maxAge)}
+	if maxAge <= 0 {
+		opts = append(opts, WithNoExpiry())
+	}
+	d, err := NewDecoder(secret, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return d.DecodeValue(s)
+}
+
+// LoadsNoTimestamp is like Loads, but for values signed without a
+// timestamp, matching django.core.signing.Signer(key=secret,
+// salt=salt).unsign_object(s).  As in Django, an empty salt is
+// replaced by Signer's.
+func LoadsNoTimestamp(s, secret, salt string) (interface{}, error) {
+	if salt == "" {
+		salt = SaltSigner
+	}
+	d, err := NewDecoder(secret, WithSalt(salt))
+	if err != nil {
+		return nil, err
+	}
+	return d.DecodeNoTimestamp(s)
+}
+
+// PeekTimestamp returns the time cookie claims to have been signed
+// at: the base62 timestamp between its last two colons.  It performs
+// NO authentication, as the signature isn't checked, so the result
+// may have been forged and must only be used where that doesn't
+// matter, such as correlating logs.  Use DecodeWithTimestamp for a
+// timestamp that can be trusted.
+func PeekTimestamp(cookie string) (time.Time, error) {
+	_, issued, err := splitUnverified(cookie)
+	return issued, err
+}
+
+// DecodeUnverified returns the session stored in cookie WITHOUT
+// VERIFYING ITS SIGNATURE OR AGE.  It performs NO authentication:
+// anyone can craft a cookie DecodeUnverified accepts, so its result
+// must never be trusted, and must never be used in place of Decode to
+// serve a request.  It exists for offline forensics, such as
+// inspecting a cookie from an incident whose secret is unknown or has
+// been rotated away.
+//
+// As the payload may be hostile, handlers registered with
+// RegisterGlobal are called with attacker-controlled arguments.
+func DecodeUnverified(s Serializer, cookie string) (map[string]interface{}, error) {
+	payload, _, err := splitUnverified(cookie)
+	if err != nil {
+		return nil, err
+	}
+	if payload, err = decodePayload(payload, Zlib, DefaultMaxDecompressedSize); err != nil {
+		return nil, err
+	}
+	o, err := deserialize(s, payload)
+	if err != nil {
+		return nil, fmt.Errorf("deserialize: %w", err)
+	}
+	return o, nil
+}
+
+// splitUnverified splits cookie into its payload and the time it
+// claims to have been signed at, ignoring its signature.
+func splitUnverified(cookie string) ([]byte, time.Time, error) {
+	var s TimestampSigner
+	c := unquoteCookie([]byte(cookie))
+	i := bytes.LastIndex(c, defaultSep)
+	if i == -1 {
+		return nil, time.Time{}, fmt.Errorf("%w: expected %s in '%s'", ErrMalformed, defaultSep, cookie)
+	}
+	return s.splitTimestamp(c[:i])
 }
@@ -3,10 +3,16 @@ package signedcookie
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -39,8 +45,18 @@ var decodeData = []struct {
 	},
 }
 
+// testDecoder returns a Decoder configured like the one Decode uses,
+// but whose clock is fixed at testNowOK, plus any extra opts.
+func testDecoder(s Serializer, secret string, opts ...Option) *Decoder {
+	opts = append([]Option{WithSerializer(s), WithAlgorithm(SHA1), WithClock(testNowOK)}, opts...)
+	d, err := NewDecoder(secret, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
 func TestOgrekAllocs(t *testing.T) {
-	now = testNowOK
 	d := &decodeData[0]
 	c := []byte(d.cookie)
 	payload := bytes.Split(c, []byte{':'})[0]
@@ -82,11 +98,54 @@ func TestOgrekAllocs(t *testing.T) {
 	}
 }
 
+// base64 values as produced by django.core.signing.b64_encode.
+var base64Data = []struct {
+	decoded, encoded string
+}{
+	{"", ""},
+	{"f", "Zg"},
+	{"fo", "Zm8"},
+	{"foo", "Zm9v"},
+	{"\xfb\xff\xfe", "-__-"},
+}
+
+func TestBase64(t *testing.T) {
+	for _, d := range base64Data {
+		if encoded := b64Encode([]byte(d.decoded)); string(encoded) != d.encoded {
+			t.Errorf("b64Encode(%q): %q != %q", d.decoded, encoded, d.encoded)
+		}
+		decoded, err := b64Decode([]byte(d.encoded))
+		if err != nil {
+			t.Errorf("b64Decode(%q): %s", d.encoded, err)
+		} else if string(decoded) != d.decoded {
+			t.Errorf("b64Decode(%q): %q != %q", d.encoded, decoded, d.decoded)
+		}
+	}
+}
+
+func TestB64DecodeAllocs(t *testing.T) {
+	// the payload is followed by the timestamp in the cookie;
+	// decoding must neither allocate for padding nor clobber it.
+	c := []byte(decodeData[1].cookie)
+	payload := bytes.Split(c, []byte{':'})[0][1:]
+	n := testing.AllocsPerRun(100, func() {
+		if _, err := b64Decode(payload); err != nil {
+			panic(err)
+		}
+	})
+	if n != 1 {
+		t.Errorf("b64Decode: expected 1 alloc, got %f", n)
+	}
+	if string(c) != decodeData[1].cookie {
+		t.Errorf("b64Decode modified its input: %s", c)
+	}
+}
+
 func TestLoadsPickleAllocs(t *testing.T) {
-	now = testNowOK
+	d := &decodeData[0]
+	decoder := testDecoder(d.kind, d.secret)
 	n := testing.AllocsPerRun(100, func() {
-		d := &decodeData[0]
-		decoded, err := Decode(d.kind, DefaultMaxAge, d.secret, d.cookie)
+		decoded, err := decoder.Decode(d.cookie)
 		if err != nil {
 			panic(err)
 		}
@@ -99,10 +158,10 @@ func TestLoadsPickleAllocs(t *testing.T) {
 }
 
 func TestLoadsJSONAllocs(t *testing.T) {
-	now = testNowOK
+	d := &decodeData[1]
+	decoder := testDecoder(d.kind, d.secret)
 	n := testing.AllocsPerRun(100, func() {
-		d := &decodeData[1]
-		decoded, err := Decode(d.kind, DefaultMaxAge, d.secret, d.cookie)
+		decoded, err := decoder.Decode(d.cookie)
 		if err != nil {
 			panic(err)
 		}
@@ -114,12 +173,31 @@ func TestLoadsJSONAllocs(t *testing.T) {
 	}
 }
 
+func TestDecodeBytesAllocs(t *testing.T) {
+	d := &decodeData[1]
+	decoder := testDecoder(d.kind, d.secret)
+	cookie := []byte(d.cookie)
+	bytesAllocs := testing.AllocsPerRun(100, func() {
+		if _, err := decoder.DecodeBytes(cookie); err != nil {
+			panic(err)
+		}
+	})
+	stringAllocs := testing.AllocsPerRun(100, func() {
+		if _, err := decoder.Decode(d.cookie); err != nil {
+			panic(err)
+		}
+	})
+	fmt.Printf("load allocs bytes: %f\n", bytesAllocs)
+	if bytesAllocs > stringAllocs {
+		t.Errorf("DecodeBytes allocs (%f) exceed Decode's (%f)", bytesAllocs, stringAllocs)
+	}
+}
+
 func TestDecode(t *testing.T) {
-	now = testNowOK
 	for _, d := range decodeData {
-		decoded, err := Decode(d.kind, DefaultMaxAge, d.secret, d.cookie)
+		decoded, err := testDecoder(d.kind, d.secret).Decode(d.cookie)
 		if err != nil {
-			t.Errorf("Decode(%s, '%s', '%s'): %s", d.kind, d.secret, d.cookie, err)
+			t.Errorf("Decode(%v, '%s', '%s'): %s", d.kind, d.secret, d.cookie, err)
 			continue
 		}
 		expected := d.decoded
@@ -130,6 +208,347 @@ func TestDecode(t *testing.T) {
 			t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
 			continue
 		}
+
+		quoted := []byte(`"` + d.cookie + `"`)
+		decoded, err = testDecoder(d.kind, d.secret).DecodeBytes(quoted)
+		if err != nil || !reflect.DeepEqual(expected, decoded) {
+			t.Errorf("DecodeBytes(%v): %#v, %v", d.kind, decoded, err)
+		}
+		if string(quoted) != `"`+d.cookie+`"` {
+			t.Errorf("DecodeBytes modified its argument: %s", quoted)
+		}
+	}
+}
+
+func TestSerializerString(t *testing.T) {
+	for s, name := range map[Serializer]string{JSON: "JSON", Pickle: "Pickle", Serializer(99): "Serializer(99)"} {
+		if s.String() != name {
+			t.Errorf("String: %s != %s", s, name)
+		}
+	}
+}
+
+func TestAutoSerializer(t *testing.T) {
+	for _, d := range decodeData {
+		dec := testDecoder(AutoSerializer, d.secret)
+		decoded, err := dec.Decode(d.cookie)
+		if err != nil {
+			t.Errorf("Decode(%v): %s", d.kind, err)
+		} else if !reflect.DeepEqual(d.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", d.decoded, decoded)
+		}
+		decoded, err = dec.DecodeReader(strings.NewReader(d.cookie))
+		if err != nil {
+			t.Errorf("DecodeReader(%v): %s", d.kind, err)
+		} else if !reflect.DeepEqual(d.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", d.decoded, decoded)
+		}
+		payload, err := dec.DecodeRaw(d.cookie)
+		if err != nil {
+			t.Errorf("DecodeRaw(%v): %s", d.kind, err)
+		} else if s := DetectSerializer(payload); s != d.kind {
+			t.Errorf("DetectSerializer: %v != %v", s, d.kind)
+		}
+	}
+
+	d := &decodeData[0]
+	if _, err := testDecoder(AutoSerializer, d.secret).Encode(d.decoded); err == nil {
+		t.Errorf("expected Encode to fail")
+	}
+	if s := DetectSerializer(nil); s != JSON {
+		t.Errorf("DetectSerializer(nil): %v", s)
+	}
+}
+
+func TestAutoSerializerFallback(t *testing.T) {
+	// pickle.dumps({'a': 'b', 'n': 1}, protocol) for protocols 0
+	// and 1, which DetectSerializer takes for JSON.
+	expected := map[string]interface{}{"a": "b", "n": int64(1)}
+	for _, payload := range []string{
+		"(dp0\nVa\np1\nVb\np2\nsVn\np3\nI1\ns.",
+		"}q\x00(X\x01\x00\x00\x00aq\x01X\x01\x00\x00\x00bq\x02X\x01\x00\x00\x00nq\x03K\x01u.",
+	} {
+		if s := DetectSerializer([]byte(payload)); s != JSON {
+			t.Fatalf("DetectSerializer: %v", s)
+		}
+		cookie := testSign(signerSecret, []byte(payload))
+		d := testDecoder(AutoSerializer, signerSecret)
+		decoded, err := d.Decode(cookie)
+		if err != nil {
+			t.Errorf("Decode(%q): %s", payload, err)
+		} else if !reflect.DeepEqual(expected, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+		}
+		v, err := d.DecodeValue(cookie)
+		if err != nil || !reflect.DeepEqual(expected, v) {
+			t.Errorf("DecodeValue(%q): %#v, %v", payload, v, err)
+		}
+		dst := make(map[string]interface{})
+		if err = d.DecodeReuse(cookie, dst); err != nil || !reflect.DeepEqual(expected, dst) {
+			t.Errorf("DecodeReuse(%q): %#v, %v", payload, dst, err)
+		}
+		_, tr, err := d.DecodeAndExplain(cookie)
+		if err != nil || tr.Serializer != Pickle {
+			t.Errorf("DecodeAndExplain(%q): serializer %v, %v", payload, tr.Serializer, err)
+		}
+	}
+
+	// if neither serializer works, the detected one's error is
+	// returned.
+	_, err := testDecoder(AutoSerializer, signerSecret).Decode(testSign(signerSecret, []byte("{nope")))
+	if !errors.Is(err, ErrMalformed) || !strings.Contains(err.Error(), "json") {
+		t.Errorf("expected a JSON error, got %v", err)
+	}
+}
+
+func TestUnknownSerializer(t *testing.T) {
+	d := &decodeData[0]
+	dec := testDecoder(d.kind, d.secret)
+	dec.serializer = Serializer(99)
+	if _, err := dec.Decode(d.cookie); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+	if _, err := dec.DecodeReader(strings.NewReader(d.cookie)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+	if _, err := dec.DecodeValue(d.cookie); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+	if _, err := dec.Encode(d.decoded); err == nil {
+		t.Errorf("expected Encode to fail")
+	}
+}
+
+// FuzzDecode checks that decoding arbitrary cookies, and cookies with
+// arbitrary but validly signed payloads, fails gracefully rather than
+// panicking.
+func FuzzDecode(f *testing.F) {
+	for _, d := range decodeData {
+		f.Add(d.cookie)
+	}
+	f.Add(sha256Data.cookie)
+	f.Add("")
+	f.Add(":")
+	f.Add("::")
+	f.Add(".")
+	// a bare compression prefix, both as the cookie's payload and
+	// signed by the fuzz function as a payload verbatim.
+	f.Add(".:1XeDSa:sig")
+	f.Add("..")
+
+	secret := decodeData[0].secret
+	decoders := []*Decoder{
+		testDecoder(JSON, secret),
+		testDecoder(Pickle, secret),
+	}
+	f.Fuzz(func(t *testing.T, cookie string) {
+		cookies := []string{
+			cookie,
+			testSign(secret, []byte(cookie)),
+			testSignCompressed(secret, []byte(cookie)),
+			// signed, but not base64 encoded.
+			string((&TimestampSigner{Signer: Signer{Secret: secret, Salt: SaltSession, Algorithm: SHA1}}).SignAt([]byte(cookie), testNowOK())),
+		}
+		for _, d := range decoders {
+			for _, c := range cookies {
+				d.Decode(c)
+				d.DecodeValue(c)
+				d.DecodeReader(strings.NewReader(c))
+			}
+		}
+	})
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, d := range decodeData {
+		cookie, err := Encode(d.kind, d.secret, d.decoded)
+		if err != nil {
+			t.Errorf("Encode(%v): %s", d.kind, err)
+			continue
+		}
+		decoded, err := Decode(d.kind, DefaultMaxAge, d.secret, cookie)
+		if err != nil {
+			t.Errorf("Decode(%v, '%s'): %s", d.kind, cookie, err)
+			continue
+		}
+		if !reflect.DeepEqual(d.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", d.decoded, decoded)
+		}
+	}
+}
+
+// generated by django.core.signing.dumps with compress=True, and
+// time.time() returning 1413244800.
+const djangoEncoded = "eyJfYXV0aF91c2VyX2lkIjoxMzM0fQ:1XdpWy:yofPzOnBvcYxg0_1CyAOF6zfP44"
+
+func TestEncodeDjango(t *testing.T) {
+	secret := "secretsecretsecretsecretsecretsecretsecretsecret"
+	obj := map[string]interface{}{"_auth_user_id": 1334}
+	signedAt := time.Unix(1413244800, 0)
+	d := testDecoder(JSON, secret)
+	cookie, err := d.EncodeAt(obj, signedAt)
+	if err != nil {
+		t.Fatalf("EncodeAt: %s", err)
+	}
+	if cookie != djangoEncoded {
+		t.Errorf("EncodeAt: '%s' != '%s'", cookie, djangoEncoded)
+	}
+	if _, issued, err := d.DecodeWithTimestamp(cookie); err != nil || !issued.Equal(signedAt) {
+		t.Errorf("DecodeWithTimestamp: %s, %v", issued, err)
+	}
+}
+
+// the payload framings django.core.signing has used since Django 1.4:
+// base64 of the serialized session, or with compress=True the '.'
+// prefixed base64 of its zlib compression, signed with SHA1 before
+// Django 3.1 and SHA256 since.  Signed with time.time() returning
+// 1413244800.
+var framingData = []struct {
+	algorithm Algorithm
+	cookie    string
+}{
+	{SHA1, "eyJfYXV0aF91c2VyX2lkIjoiMSIsInBhZGRpbmciOiJ4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4In0:1XdpWy:Yp2Lo2I59DzMjVUBhvxwjBR3Sd4"},
+	{SHA1, ".eJyrVopPLC3JiC8tTi2Kz0xRslIyVNJRKkhMScnMSwfyKogESrUAFZYdzA:1XdpWy:WkiGb_nIvzBihhKXTj_fi6yEnIo"},
+	{SHA256, "eyJfYXV0aF91c2VyX2lkIjoiMSIsInBhZGRpbmciOiJ4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4eHh4In0:1XdpWy:NGZpkVNmj5zOjpC9aFkboFtIe7txYXmMZGMJ07KIkvk"},
+	{SHA256, ".eJyrVopPLC3JiC8tTi2Kz0xRslIyVNJRKkhMScnMSwfyKogESrUAFZYdzA:1XdpWy:LQGm15JtQX4VqAQ14FeSyIOuGggVxi8dMnjoV7BH4Gs"},
+}
+
+func TestPayloadFramings(t *testing.T) {
+	want := map[string]interface{}{"_auth_user_id": "1", "padding": strings.Repeat("x", 40)}
+	for _, data := range framingData {
+		d := testDecoder(JSON, "framing-secret", WithAlgorithm(data.algorithm))
+		decoded, err := d.Decode(data.cookie)
+		if err != nil {
+			t.Errorf("Decode(%v, %s): %s", data.algorithm, data.cookie, err)
+			continue
+		}
+		if !reflect.DeepEqual(want, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", want, decoded)
+		}
+		// compress/zlib's output differs from Python's zlib, so
+		// only uncompressed cookies match byte for byte.
+		if data.cookie[0] == '.' {
+			continue
+		}
+		d = testDecoder(JSON, "framing-secret", WithAlgorithm(data.algorithm), WithCompression(false))
+		cookie, err := d.EncodeAt(want, time.Unix(1413244800, 0))
+		if err != nil || cookie != data.cookie {
+			t.Errorf("EncodeAt(%v): %s != %s (%v)", data.algorithm, cookie, data.cookie, err)
+		}
+	}
+}
+
+// generated by django.core.signing.dumps, with time.time() returning
+// 1413244800.
+var dumpsData = []struct {
+	obj      interface{}
+	salt     string
+	compress bool
+	signed   string
+}{
+	{
+		[]interface{}{float64(1), "two", map[string]interface{}{"three": 3.5}},
+		DefaultSalt,
+		false,
+		"WzEsInR3byIseyJ0aHJlZSI6My41fV0:1XdpWy:mGO_zgTHKM013nx4JoMO__ThDXEsktt6q23XIiNVawk",
+	},
+	{
+		map[string]interface{}{"user": strings.Repeat("a", 40)},
+		"myapp",
+		true,
+		".eJyrViotTi1SslJKJBIo1QIA3dASog:1XdpWy:DIPmPhfBJpCcCHFqCOnhoADHYblQingHMpF4pKrmJQI",
+	},
+}
+
+func TestDumpsLoads(t *testing.T) {
+	for _, d := range dumpsData {
+		obj, err := Loads(d.signed, signerSecret, d.salt, 0)
+		if err != nil {
+			t.Errorf("Loads(%s): %s", d.signed, err)
+			continue
+		}
+		if !reflect.DeepEqual(d.obj, obj) {
+			t.Errorf("DeepEqual(%#v != %#v)", d.obj, obj)
+		}
+		if _, err = Loads(d.signed, signerSecret, d.salt, time.Hour); !errors.Is(err, ErrExpired) {
+			t.Errorf("expected ErrExpired, got %v", err)
+		}
+		if _, err = Loads(d.signed, signerSecret, "wrong", 0); !errors.Is(err, ErrSignatureMismatch) {
+			t.Errorf("expected ErrSignatureMismatch, got %v", err)
+		}
+
+		signed, err := Dumps(d.obj, signerSecret, d.salt, d.compress)
+		if err != nil {
+			t.Errorf("Dumps(%#v): %s", d.obj, err)
+			continue
+		}
+		// compress/zlib's output differs from zlib's, but an
+		// uncompressed payload only depends on obj.
+		if d.compress {
+			if signed[0] != '.' {
+				t.Errorf("Dumps: '%s' isn't compressed", signed)
+			}
+		} else if payload := d.signed[:strings.IndexByte(d.signed, ':')]; !strings.HasPrefix(signed, payload+":") {
+			t.Errorf("Dumps: '%s' doesn't start with '%s:'", signed, payload)
+		}
+		if obj, err = Loads(signed, signerSecret, d.salt, time.Hour); err != nil {
+			t.Errorf("Loads(%s): %s", signed, err)
+		} else if !reflect.DeepEqual(d.obj, obj) {
+			t.Errorf("DeepEqual(%#v != %#v)", d.obj, obj)
+		}
+	}
+}
+
+// generated by Django's signed_cookies SessionStore with
+// DEFAULT_HASHING_ALGORITHM = 'sha256'.
+var sha256Data = struct {
+	secret  string
+	cookie  string
+	decoded map[string]interface{}
+}{
+	"70e97f01975bb59ae8804ca164081c46034042aa913a4dac055cad6a7e188bd1",
+	".eJxVjMsOgjAQRf-la9MUp8Dg0j3f0MwLQU1JKKyM_64kLHR7zzn35RJt65i2Ykua1F1cBRDd6Xdmkoflnemd8m32Mud1mdjvij9o8f2s9rwe7t_BSGX81rWgDtwy8iAsYNRZy6CRQ5QYG2vAArUSDFEJ0QQNAYcIVa0o3dm9P5V8OaM:1XdpWy:9fE-yeHIM84tMbqNSUfcDcPRqpBDYVNaxQq6P5P5h6w",
+	map[string]interface{}{
+		"_auth_user_id":      "1334",
+		"_auth_user_backend": "django.contrib.auth.backends.ModelBackend",
+		"_auth_user_hash":    "5c8dfb7b8bfcbc3ea9e7b3d4b04c446e63e0a7c0e88da88ec8e838f4315d8c92",
+	},
+}
+
+func TestDecodeSHA256(t *testing.T) {
+	d := &sha256Data
+	decoded, err := testDecoder(JSON, d.secret, WithAlgorithm(SHA256)).Decode(d.cookie)
+	if err != nil {
+		t.Fatalf("Decode(SHA256): %s", err)
+	}
+	if !reflect.DeepEqual(d.decoded, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", d.decoded, decoded)
+	}
+	if _, err = testDecoder(JSON, d.secret).Decode(d.cookie); err == nil {
+		t.Errorf("SHA256 cookie verified with SHA1")
+	}
+	if _, err = DecodeWithAlgorithm(JSON, Algorithm(42), DefaultMaxAge, d.secret, d.cookie); err == nil {
+		t.Errorf("unknown algorithm accepted")
+	}
+}
+
+func TestDecodeWithSalt(t *testing.T) {
+	secret := "secretsecretsecretsecretsecretsecretsecretsecret"
+	// signing.dumps({'email': 'user@example.com', 'user': 42}, salt='myapp.tokens')
+	cookie := "eyJlbWFpbCI6InVzZXJAZXhhbXBsZS5jb20iLCJ1c2VyIjo0Mn0:1XdpWy:CVZyyQYtYVwjRr8TajWZ8VwhALM"
+	expected := map[string]interface{}{
+		"email": "user@example.com",
+		"user":  float64(42),
+	}
+	decoded, err := testDecoder(JSON, secret, WithSalt("myapp.tokens")).Decode(cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+	if _, err = testDecoder(JSON, secret).Decode(cookie); err == nil {
+		t.Errorf("Decode with session salt should fail, but doesn't")
 	}
 }
 
@@ -144,9 +563,8 @@ func testNowTimedOut() time.Time {
 }
 
 func TestCookieTimeout(t *testing.T) {
-	now = testNowTimedOut
 	d := &decodeData[0]
-	_, err := Decode(d.kind, DefaultMaxAge, d.secret, d.cookie)
+	_, err := testDecoder(d.kind, d.secret, WithClock(testNowTimedOut)).Decode(d.cookie)
 	if err == nil {
 		t.Errorf("should fail to decode, but doesn't")
 	}
@@ -158,6 +576,13 @@ var base62Data = []struct {
 }{
 	{"d5778337", 137633489102557},
 	{"d5778349", 137633489102621},
+	{"0", 0},
+	{"z", 61},
+	{"10", 62},
+	{"1XeDSa", 1413336784},
+	{"-1XeDSa", -1413336784},
+	{"AzL8n0Y58m7", math.MaxInt64},
+	{"-AzL8n0Y58m8", math.MinInt64},
 }
 
 func TestBase62Decode(t *testing.T) {
@@ -171,4 +596,218 @@ func TestBase62Decode(t *testing.T) {
 			t.Errorf("incorrect decode: %d != %d", n, d.decoded)
 		}
 	}
+
+	for _, encoded := range []string{
+		"AzL8n0Y58m8",
+		"-AzL8n0Y58m9",
+		"zzzzzzzzzzzzzzzzzzzz",
+		"-zzzzzzzzzzzzzzzzzzzz",
+	} {
+		if n, err := b62Decode([]byte(encoded)); err == nil {
+			t.Errorf("b62Decode('%s'): expected overflow, got %d", encoded, n)
+		}
+	}
+}
+
+func TestBase62Encode(t *testing.T) {
+	for _, d := range base62Data {
+		if s := string(b62Encode(d.decoded)); s != d.encoded {
+			t.Errorf("b62Encode(%d): '%s' != '%s'", d.decoded, s, d.encoded)
+		}
+		n, err := b62Decode(b62Encode(d.decoded))
+		if err != nil || n != d.decoded {
+			t.Errorf("round trip of %d: %d (%v)", d.decoded, n, err)
+		}
+	}
+}
+
+func TestBaseDecodeErrors(t *testing.T) {
+	for _, c := range []struct {
+		alphabet string
+		encoded  string
+		err      string
+	}{
+		{base62Alphabet, "1Xe_Sa", "not base62 encoded"},
+		{base62Alphabet, "AzL8n0Y58m8", "base62 value overflows int64"},
+		{base36Alphabet, "1XeDSa", "not base36 encoded"},
+		{base36Alphabet, "1y2p0ij32e8e8", "base36 value overflows int64"},
+	} {
+		if n, err := baseDecode(c.alphabet, []byte(c.encoded)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("baseDecode(%d, '%s'): expected %q, got %d, %v", len(c.alphabet), c.encoded, c.err, n, err)
+		}
+	}
+	// the encoding of math.MinInt64 is the longest, in either base.
+	for _, alphabet := range []string{base62Alphabet, base36Alphabet} {
+		if n, err := baseDecode(alphabet, baseEncode(alphabet, math.MinInt64)); err != nil || n != math.MinInt64 {
+			t.Errorf("base%d round trip of math.MinInt64: %d (%v)", len(alphabet), n, err)
+		}
+	}
+}
+
+// generated with django.utils.http.int_to_base36
+var base36Data = []struct {
+	encoded string
+	decoded int64
+}{
+	{"0", 0},
+	{"z", 35},
+	{"10", 36},
+	{"ndgpn4", 1413336784},
+	{"c6ck00", 736257600},
+	{"1y2p0ij32e8e7", math.MaxInt64},
+	// int_to_base36 rejects negative numbers, but as for base62,
+	// they round trip with a leading '-'.
+	{"-ndgpn4", -1413336784},
+	{"-1y2p0ij32e8e8", math.MinInt64},
+}
+
+func TestBase36(t *testing.T) {
+	for _, d := range base36Data {
+		n, err := base36Decode([]byte(d.encoded))
+		if err != nil || n != d.decoded {
+			t.Errorf("base36Decode('%s'): %d != %d (%v)", d.encoded, n, d.decoded, err)
+		}
+		if s := string(base36Encode(d.decoded)); s != d.encoded {
+			t.Errorf("base36Encode(%d): '%s' != '%s'", d.decoded, s, d.encoded)
+		}
+	}
+	for _, n := range []int64{1, 61, 62, 1 << 40, math.MaxInt64 - 1, math.MinInt64 + 1} {
+		if m, err := base36Decode(base36Encode(n)); err != nil || m != n {
+			t.Errorf("round trip of %d: %d (%v)", n, m, err)
+		}
+	}
+
+	for _, encoded := range []string{
+		"1y2p0ij32e8e8",
+		"-1y2p0ij32e8e9",
+		"zzzzzzzzzzzzzz",
+		"-zzzzzzzzzzzzzz",
+	} {
+		if n, err := base36Decode([]byte(encoded)); err == nil {
+			t.Errorf("base36Decode('%s'): expected overflow, got %d", encoded, n)
+		}
+	}
+	// int_to_base36 only writes lowercase digits.
+	for _, encoded := range []string{"C6CK00", "c6_k00", "c6ck00 "} {
+		if n, err := base36Decode([]byte(encoded)); err == nil {
+			t.Errorf("base36Decode('%s'): expected an error, got %d", encoded, n)
+		}
+	}
+}
+
+func TestLoadsNoTimestamp(t *testing.T) {
+	// generated with Signer(key=secret, salt=salt).sign_object(obj)
+	for _, c := range []struct {
+		salt    string
+		signed  string
+		decoded interface{}
+	}{
+		{
+			"newsletter.unsubscribe",
+			"eyJlbWFpbCI6ImFAZXhhbXBsZS5jb20iLCJsaXN0IjozfQ:WXSQXUp4hQfFiKm5hJma0q_lsJf73phPFFtWXUA4u1c",
+			map[string]interface{}{"email": "a@example.com", "list": 3.0},
+		},
+		{"", "WzEsInR3byJd:q47amWBbrfPSGd0aacJL969GWUy2coU5IH22PAoe18s", []interface{}{1.0, "two"}},
+	} {
+		v, err := LoadsNoTimestamp(c.signed, "plain-secret", c.salt)
+		if err != nil {
+			t.Errorf("LoadsNoTimestamp(%q): %s", c.signed, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.decoded, v) {
+			t.Errorf("DeepEqual(%#v != %#v)", c.decoded, v)
+		}
+		if _, err = LoadsNoTimestamp(c.signed, "wrong-secret", c.salt); !errors.Is(err, ErrSignatureMismatch) {
+			t.Errorf("expected ErrSignatureMismatch, got %v", err)
+		}
+	}
+
+	// timestamped values aren't mistaken for plain ones, and vice versa.
+	const timestamped = "eyJlbWFpbCI6ImFAZXhhbXBsZS5jb20ifQ:1XdpWy:g0v5fjTgFo-RM-e_Nk-0uQ3oOMk9dYK8vLlIFSt0Phw"
+	if _, err := LoadsNoTimestamp(timestamped, "plain-secret", "newsletter.unsubscribe"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+	const plain = "eyJlbWFpbCI6ImFAZXhhbXBsZS5jb20iLCJsaXN0IjozfQ:WXSQXUp4hQfFiKm5hJma0q_lsJf73phPFFtWXUA4u1c"
+	if _, err := Loads(plain, "plain-secret", "newsletter.unsubscribe", 0); !errors.Is(err, ErrNoTimestamp) {
+		t.Errorf("expected ErrNoTimestamp, got %v", err)
+	}
+}
+
+func TestPeekTimestamp(t *testing.T) {
+	for _, data := range decodeData {
+		_, expected, err := testDecoder(data.kind, data.secret).DecodeWithTimestamp(data.cookie)
+		if err != nil {
+			t.Fatalf("DecodeWithTimestamp: %s", err)
+		}
+		// the signature isn't checked, so a tampered one is fine.
+		for _, cookie := range []string{data.cookie, data.cookie + "x", `"` + data.cookie + `"`} {
+			issued, err := PeekTimestamp(cookie)
+			if err != nil {
+				t.Errorf("PeekTimestamp(%q): %s", cookie, err)
+			} else if !issued.Equal(expected) {
+				t.Errorf("PeekTimestamp(%q): %s != %s", cookie, issued, expected)
+			}
+		}
+	}
+	for _, c := range []struct {
+		cookie string
+		err    error
+	}{
+		{"", ErrMalformed},
+		{"nocolons", ErrMalformed},
+		{"payload:sig", ErrNoTimestamp},
+		{"payload:!!!:sig", ErrMalformed},
+	} {
+		if _, err := PeekTimestamp(c.cookie); !errors.Is(err, c.err) {
+			t.Errorf("PeekTimestamp(%q): expected %v, got %v", c.cookie, c.err, err)
+		}
+	}
+}
+
+func TestDecodeUnverified(t *testing.T) {
+	for _, data := range decodeData {
+		// neither the signature nor the age is checked.
+		for _, cookie := range []string{data.cookie, data.cookie + "x", `"` + data.cookie + `"`} {
+			decoded, err := DecodeUnverified(data.kind, cookie)
+			if err != nil {
+				t.Errorf("DecodeUnverified(%q): %s", cookie, err)
+			} else if !reflect.DeepEqual(data.decoded, decoded) {
+				t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+			}
+		}
+	}
+	for _, cookie := range []string{"", "payload:sig", "!!!:1XeDNx:sig", ".eJyr:1XeDNx:sig"} {
+		if _, err := DecodeUnverified(JSON, cookie); err == nil {
+			t.Errorf("DecodeUnverified(%q): expected an error", cookie)
+		}
+	}
+}
+
+func TestSaltedHMACKey(t *testing.T) {
+	// hashlib.new(algorithm, (key_salt + secret).encode()).hexdigest()
+	cases := []struct {
+		keySalt string
+		a       Algorithm
+		key     string
+	}{
+		{SaltSession + "signer", SHA1, "e3b909f7e500220301912381eb158566fe3b6c3f"},
+		{SaltSession + "signer", SHA256, "89a1b2de763ede8702c61584e1499af11588cd93e4b1ba441b696eb9489730a7"},
+		{"django.contrib.messagesSessionStore", SHA256, "5f7ddd00bd66ac33080b3bd106cb43626f6e7f405d38ccabc5d2301bc61a9b81"},
+	}
+	for _, c := range cases {
+		if key := hex.EncodeToString(SaltedHMACKey(c.keySalt, "secret", c.a)); key != c.key {
+			t.Errorf("SaltedHMACKey(%q, %d): %s != %s", c.keySalt, c.a, key, c.key)
+		}
+	}
+	if key := SaltedHMACKey("salt", "secret", Algorithm(42)); key != nil {
+		t.Errorf("SaltedHMACKey: expected nil for an unknown algorithm, got %x", key)
+	}
+
+	// Signer's HMAC is keyed with it.
+	s := Signer{Secret: "secret", Salt: SaltSession, Algorithm: SHA256}
+	mac := hmac.New(sha256.New, SaltedHMACKey(SaltSession+"signer", "secret", SHA256))
+	mac.Write([]byte("hello"))
+	if signed := string(s.Sign([]byte("hello"))); signed != "hello:"+string(b64Encode(mac.Sum(nil))) {
+		t.Errorf("Sign: %s", signed)
+	}
 }
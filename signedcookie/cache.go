@@ -0,0 +1,193 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// the prefixes the cache and cached_db session backends prepend to
+// the session key to form the cache key (KEY_PREFIX in each module).
+const (
+	cacheKeyPrefix    = "django.contrib.sessions.cache"
+	cachedDBKeyPrefix = "django.contrib.sessions.cached_db"
+)
+
+// the characters SessionBase._get_new_session_key draws session keys
+// from (VALID_KEY_CHARS).
+const sessionKeyChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// A CacheBackend is one of Django's session backends that store
+// sessions in the cache.  For these backends the sessionid cookie
+// holds an opaque session key, rather than the signed session itself.
+type CacheBackend int
+
+const (
+	// Cache is django.contrib.sessions.backends.cache.
+	Cache CacheBackend = iota
+	// CachedDB is django.contrib.sessions.backends.cached_db, which
+	// writes sessions through to the django_session table as well.
+	// On a cache miss, the session_data column can be decoded with
+	// DecodeSessionData.
+	CachedDB
+)
+
+// CacheKey returns the key backend stores the session identified by
+// sessionKey under, as SessionStore.cache_key does, or ErrMalformed
+// if sessionKey isn't a session key Django could have issued.  The
+// cache itself transforms keys further before storing them; see
+// MakeCacheKey.
+func (b CacheBackend) CacheKey(sessionKey string) (string, error) {
+	if !validSessionKey(sessionKey) {
+		return "", fmt.Errorf("%w: invalid session key: %q", ErrMalformed, sessionKey)
+	}
+	switch b {
+	case Cache:
+		return cacheKeyPrefix + sessionKey, nil
+	case CachedDB:
+		return cachedDBKeyPrefix + sessionKey, nil
+	}
+	return "", fmt.Errorf("unknown cache backend: %d", b)
+}
+
+// validSessionKey mirrors SessionBase._validate_session_key, which
+// requires keys to be at least 8 characters long, and additionally
+// requires them to consist of the characters Django generates keys
+// from, so that a forged cookie can't address arbitrary cache keys.
+func validSessionKey(key string) bool {
+	if len(key) < 8 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if strings.IndexByte(sessionKeyChars, key[i]) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSignedCookie reports whether value is shaped like a cookie set by
+// the signed_cookies session backend: a base64 payload, optionally
+// with the '.' compression prefix, a base62 timestamp and a base64
+// signature, separated by colons.  The cache and db backends instead
+// set an opaque session key, which ParseSessionKey accepts.  It checks
+// only the shape of value, not its signature.
+func IsSignedCookie(value string) bool {
+	parts := bytes.Split(unquoteCookie([]byte(value)), defaultSep)
+	if len(parts) != 3 {
+		return false
+	}
+	payload := bytes.TrimPrefix(parts[0], []byte{'.'})
+	if !isBase64URL(payload) || !isBase64URL(parts[2]) || len(parts[1]) == 0 {
+		return false
+	}
+	_, err := b62Decode(parts[1])
+	return err == nil
+}
+
+// isBase64URL reports whether b is non-empty, and consists only of
+// the characters of unpadded URL-safe base64.
+func isBase64URL(b []byte) bool {
+	for _, c := range b {
+		if !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// ParseSessionKey returns the session key held by value, the
+// sessionid cookie set by a session backend that stores sessions
+// server side, such as the cache, cached_db or db backends.  It
+// returns ErrMalformed if value isn't a session key Django could have
+// issued, such as a cookie set by the signed_cookies backend, which
+// should be decoded with Decode instead.
+func ParseSessionKey(value string) (string, error) {
+	if IsSignedCookie(value) {
+		return "", fmt.Errorf("%w: signed cookie, not a session key", ErrMalformed)
+	}
+	if !validSessionKey(value) {
+		return "", fmt.Errorf("%w: invalid session key: %q", ErrMalformed, value)
+	}
+	return value, nil
+}
+
+// MakeCacheKey returns the key Django's cache framework stores key
+// under, given the cache's KEY_PREFIX and VERSION settings, as the
+// default KEY_FUNCTION does.  With the default settings, the session
+// with key "abc..." is stored under
+// ":1:django.contrib.sessions.cacheabc...".
+func MakeCacheKey(keyPrefix string, version int, key string) string {
+	return keyPrefix + ":" + strconv.Itoa(version) + ":" + key
+}
+
+// DecodeCacheData returns a map corresponding to a session fetched
+// from the cache by the cache or cached_db backends.  These backends
+// don't encode the session like the db backend does: the cache stores
+// the session dict itself, pickled by the cache backend (as all of
+// Django's cache backends do) regardless of SESSION_SERIALIZER, and
+// without a signature.
+func DecodeCacheData(data []byte) (map[string]interface{}, error) {
+	o, err := pickleLoads(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("deserialize: %w", err)
+	}
+	return o, nil
+}
+
+// DecodeCacheEntries decodes a dump of sessions read from r, for
+// offline analysis.  Each line of the dump holds one session as
+// key=value, where value is encoded as the session_data column is and
+// is decoded with DecodeSessionData.  Blank lines are ignored.
+//
+// The returned map is keyed by session key.  Keys in the dump may be
+// bare session keys, or cache keys like
+// ":1:django.contrib.sessions.cached_dbabc...", from which the session
+// key is extracted.  If a session key appears more than once, the
+// last entry wins.  Decoding stops at the first entry that can't be
+// decoded, and the error names its line.
+func DecodeCacheEntries(s Serializer, secret string, r io.Reader) (map[string]map[string]interface{}, error) {
+	sessions := make(map[string]map[string]interface{})
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if entry := strings.TrimRight(line, "\r\n"); strings.TrimSpace(entry) != "" {
+			i := strings.IndexByte(entry, '=')
+			if i == -1 {
+				return nil, fmt.Errorf("%w: line %d: expected key=value", ErrMalformed, n)
+			}
+			key := sessionKeyFromCacheKey(strings.TrimSpace(entry[:i]))
+			o, err := DecodeSessionData(s, secret, strings.TrimSpace(entry[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: session %q: %w", n, key, err)
+			}
+			sessions[key] = o
+		}
+		if err == io.EOF {
+			return sessions, nil
+		}
+	}
+}
+
+// sessionKeyFromCacheKey returns the session key a cache key was
+// built from, or key itself if it has neither backend's prefix.
+func sessionKeyFromCacheKey(key string) string {
+	// cachedDBKeyPrefix starts with cacheKeyPrefix, so must be
+	// checked first.
+	for _, prefix := range []string{cachedDBKeyPrefix, cacheKeyPrefix} {
+		if i := strings.LastIndex(key, prefix); i != -1 {
+			return key[i+len(prefix):]
+		}
+	}
+	return key
+}
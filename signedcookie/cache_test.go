@@ -0,0 +1,126 @@
+package signedcookie
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	const sessionKey = "q1mzb8ug4n2xwv7kcoibs7mfqz3a9t1e"
+	cases := []struct {
+		backend CacheBackend
+		key     string
+	}{
+		{Cache, "django.contrib.sessions.cacheq1mzb8ug4n2xwv7kcoibs7mfqz3a9t1e"},
+		{CachedDB, "django.contrib.sessions.cached_dbq1mzb8ug4n2xwv7kcoibs7mfqz3a9t1e"},
+	}
+	for _, c := range cases {
+		key, err := c.backend.CacheKey(sessionKey)
+		if err != nil || key != c.key {
+			t.Errorf("CacheKey(%d): %q, %v", c.backend, key, err)
+		}
+	}
+
+	for _, sessionKey := range []string{"", "short", "Q1MZB8UG4N2XWV7K", "abcdefgh:signature", "abcdefgh\r\nflush_all"} {
+		if _, err := Cache.CacheKey(sessionKey); !errors.Is(err, ErrMalformed) {
+			t.Errorf("CacheKey(%q): expected ErrMalformed, got %v", sessionKey, err)
+		}
+	}
+	if _, err := CacheBackend(99).CacheKey(sessionKey); err == nil {
+		t.Errorf("expected an error for an unknown backend")
+	}
+
+	if key := MakeCacheKey("", 1, cases[0].key); key != ":1:"+cases[0].key {
+		t.Errorf("MakeCacheKey: %s", key)
+	}
+}
+
+func TestParseSessionKey(t *testing.T) {
+	const sessionKey = "q1mzb8ug4n2xwv7kcoibs7mfqz3a9t1e"
+	if IsSignedCookie(sessionKey) {
+		t.Errorf("IsSignedCookie(%q)", sessionKey)
+	}
+	if key, err := ParseSessionKey(sessionKey); err != nil || key != sessionKey {
+		t.Errorf("ParseSessionKey: %q, %v", key, err)
+	}
+
+	for _, data := range decodeData {
+		if !IsSignedCookie(data.cookie) {
+			t.Errorf("IsSignedCookie(%q) is false", data.cookie)
+		}
+		if _, err := ParseSessionKey(data.cookie); !errors.Is(err, ErrMalformed) {
+			t.Errorf("ParseSessionKey(%q): expected ErrMalformed, got %v", data.cookie, err)
+		}
+	}
+	if !IsSignedCookie(`"eyJhIjoiYiJ9:1XeDHa:sig-_"`) || !IsSignedCookie(".eJyrVkpUslJKUqoFAA:1XeDHa:sig") {
+		t.Errorf("IsSignedCookie rejected a quoted or compressed cookie")
+	}
+	for _, value := range []string{"", "a:b", "e30::sig", "e30:1XeDHa:", "e30:1XeD!a:sig", "e3+0:1XeDHa:sig", "e30:1XeDHa:sig:extra", ".:1XeDHa:sig"} {
+		if IsSignedCookie(value) {
+			t.Errorf("IsSignedCookie(%q) is true", value)
+		}
+	}
+	if _, err := ParseSessionKey("short"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("ParseSessionKey(short): expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestDecodeCacheData(t *testing.T) {
+	// pickle.dumps(session, pickle.HIGHEST_PROTOCOL), as stored by
+	// the redis cache backend.
+	data := "\x80\x05\x95q\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x0d_auth_user_id\x94\x8c\x041334\x94\x8c\x12_auth_user_backend\x94\x8c)django.contrib.auth.backends.ModelBackend\x94\x8c\x0f_session_expiry\x94K\x00u."
+	decoded, err := DecodeCacheData([]byte(data))
+	if err != nil {
+		t.Fatalf("DecodeCacheData: %s", err)
+	}
+	expected := map[string]interface{}{
+		"_auth_user_id":      "1334",
+		"_auth_user_backend": "django.contrib.auth.backends.ModelBackend",
+		"_session_expiry":    int64(0),
+	}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+	if _, err = DecodeCacheData([]byte(sessionData[0].data)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestDecodeCacheEntries(t *testing.T) {
+	const sessionKey = "q1mzb8ug4n2xwv7kcoibs7mfqz3a9t1e"
+	dump := ":1:django.contrib.sessions.cached_db" + sessionKey + "=" + sessionData[2].data + "\r\n" +
+		"\n" +
+		"abcdefgh12345678 = " + sessionData[0].data + "\n" +
+		"django.contrib.sessions.cachezyxwvuts0=" + sessionData[0].data
+	decoded, err := DecodeCacheEntries(JSON, sessionDataSecret, strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("DecodeCacheEntries: %s", err)
+	}
+	session := map[string]interface{}{
+		"_auth_user_id":      "1334",
+		"_auth_user_backend": "django.contrib.auth.backends.ModelBackend",
+	}
+	expected := map[string]map[string]interface{}{
+		sessionKey:         session,
+		"abcdefgh12345678": session,
+		"zyxwvuts0":        session,
+	}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+
+	for _, c := range []struct {
+		dump string
+		err  error
+	}{
+		{"abcdefgh12345678\n", ErrMalformed},
+		{"\nabcdefgh12345678=" + sessionData[2].data + "x\n", ErrSignatureMismatch},
+	} {
+		_, err := DecodeCacheEntries(JSON, sessionDataSecret, strings.NewReader(c.dump))
+		if !errors.Is(err, c.err) || !strings.Contains(err.Error(), "line") {
+			t.Errorf("DecodeCacheEntries(%q): expected %v naming the line, got %v", c.dump, c.err, err)
+		}
+	}
+}
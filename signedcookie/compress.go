@@ -0,0 +1,119 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Compressor decompresses the payloads of cookies whose payload
+// starts with '.'.  Django compresses with zlib, but some custom
+// signers and middlewares compress with gzip instead.
+//
+// A Compressor that also has a method
+//
+//	NewWriter(w io.Writer) io.WriteCloser
+//
+// is used to compress payloads when encoding, as Zlib and Gzip are.
+// Otherwise, payloads are encoded uncompressed.
+type Compressor interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// compressWriter is implemented by Compressors that can compress.
+type compressWriter interface {
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+var (
+	// Zlib is the compression django.core.signing uses.  It is
+	// the default.
+	Zlib Compressor = zlibCompressor{}
+	// Gzip compresses payloads in the gzip format (RFC 1952).
+	Gzip Compressor = gzipCompressor{}
+)
+
+type zlibCompressor struct{}
+
+// zlibReaders holds readers returned to it by pooledZlibReader.Close.
+// Each zlib reader allocates tens of kilobytes of decompression state,
+// which Reset lets a new payload reuse.
+var zlibReaders sync.Pool
+
+// NewReader reuses a pooled reader if there is one.  The reader is
+// returned to the pool when closed.
+func (zlibCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if zr, ok := zlibReaders.Get().(io.ReadCloser); ok {
+		if err := zr.(zlib.Resetter).Reset(r, nil); err != nil {
+			zlibReaders.Put(zr)
+			return nil, err
+		}
+		return &pooledZlibReader{zr}, nil
+	}
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledZlibReader{zr}, nil
+}
+
+// pooledZlibReader returns its reader to zlibReaders on Close.  Once
+// closed it forgets the reader, so that closing twice can't hand the
+// same reader to two callers.
+type pooledZlibReader struct {
+	zr io.ReadCloser
+}
+
+func (r *pooledZlibReader) Read(p []byte) (int, error) {
+	if r.zr == nil {
+		return 0, errors.New("zlib: read after Close")
+	}
+	return r.zr.Read(p)
+}
+
+func (r *pooledZlibReader) Close() error {
+	if r.zr == nil {
+		return nil
+	}
+	err := r.zr.Close()
+	zlibReaders.Put(r.zr)
+	r.zr = nil
+	return err
+}
+
+// NewWriter uses the best compression: zlib.compress uses level 6,
+// but compress/flate's levels up to 6 miss matches in short inputs
+// like cookies that zlib finds, so that payloads Django would
+// compress wouldn't be.
+func (zlibCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	zw, _ := zlib.NewWriterLevel(w, zlib.BestCompression)
+	return zw
+}
+
+func (zlibCompressor) String() string { return "zlib" }
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+
+func (gzipCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+	return gw
+}
+
+func (gzipCompressor) String() string { return "gzip" }
+
+// compressorName returns c's name for error messages.
+func compressorName(c Compressor) string {
+	if s, ok := c.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", c)
+}
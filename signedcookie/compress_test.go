@@ -0,0 +1,157 @@
+package signedcookie
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readOnlyCompressor decompresses with gzip, but can't compress.
+type readOnlyCompressor struct{}
+
+func (readOnlyCompressor) NewReader(r io.Reader) (io.ReadCloser, error) { return Gzip.NewReader(r) }
+
+// closeCountingCompressor is Zlib, counting the readers closed.
+type closeCountingCompressor struct{ closed *int }
+
+func (c closeCountingCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := Zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return closeCounter{zr, c.closed}, nil
+}
+
+type closeCounter struct {
+	io.ReadCloser
+	closed *int
+}
+
+func (c closeCounter) Close() error {
+	*c.closed++
+	return c.ReadCloser.Close()
+}
+
+func TestDecodeReaderCloses(t *testing.T) {
+	secret := decodeData[1].secret
+	var closed int
+	d := testDecoder(JSON, secret, WithCompressor(closeCountingCompressor{&closed}))
+	for _, payload := range []string{`{"a":1}`, `{"a":`} {
+		closed = 0
+		cookie := testSignCompressed(secret, []byte(payload))
+		d.DecodeReader(strings.NewReader(cookie))
+		if closed != 1 {
+			t.Errorf("DecodeReader(%s): closed %d readers", payload, closed)
+		}
+	}
+}
+
+func TestCompressorGzip(t *testing.T) {
+	obj := map[string]interface{}{"padding": strings.Repeat("x", 100)}
+	d := testDecoder(JSON, "secret", WithCompressor(Gzip))
+	cookie, err := d.Encode(obj)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if cookie[0] != '.' {
+		t.Fatalf("expected a compressed payload: %s", cookie)
+	}
+	payload, err := b64Decode([]byte(cookie[1:strings.Index(cookie, ":")]))
+	if err != nil {
+		t.Fatalf("b64Decode: %s", err)
+	}
+	if !bytes.HasPrefix(payload, []byte{0x1f, 0x8b}) {
+		t.Errorf("expected the gzip magic number, got % x", payload[:2])
+	}
+
+	decoded, err := d.Decode(cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !reflect.DeepEqual(obj, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", obj, decoded)
+	}
+	decoded, err = d.DecodeReader(strings.NewReader(cookie))
+	if err != nil {
+		t.Fatalf("DecodeReader: %s", err)
+	}
+	if !reflect.DeepEqual(obj, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", obj, decoded)
+	}
+
+	_, err = testDecoder(JSON, "secret").Decode(cookie)
+	if !errors.Is(err, ErrMalformed) || !strings.Contains(err.Error(), "isn't zlib compressed") {
+		t.Errorf("zlib Decoder: expected ErrMalformed, got %v", err)
+	}
+
+	// a Compressor without NewWriter leaves payloads uncompressed.
+	d = testDecoder(JSON, "secret", WithCompressor(readOnlyCompressor{}))
+	if cookie, err = d.Encode(obj); err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if cookie[0] == '.' {
+		t.Errorf("expected an uncompressed payload: %s", cookie)
+	}
+	if _, err = d.Decode(cookie); err != nil {
+		t.Errorf("Decode: %s", err)
+	}
+
+	if _, err = NewDecoder("secret", WithCompressor(nil)); err == nil {
+		t.Errorf("NewDecoder: expected error for nil compressor")
+	}
+}
+
+func TestZlibReaderPool(t *testing.T) {
+	var buf bytes.Buffer
+	w := Zlib.(compressWriter).NewWriter(&buf)
+	w.Write([]byte("payload"))
+	w.Close()
+	for i := 0; i < 3; i++ {
+		r, err := Zlib.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("NewReader: %s", err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil || string(b) != "payload" {
+			t.Fatalf("ReadAll: %q, %v", b, err)
+		}
+		// closing twice must return the reader to the pool once.
+		if err = r.Close(); err != nil {
+			t.Errorf("Close: %s", err)
+		}
+		r.Close()
+		if _, err = r.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Read: expected an error after Close")
+		}
+	}
+	if _, err := Zlib.NewReader(strings.NewReader("not zlib")); err == nil {
+		t.Errorf("NewReader: expected an error for a bad header")
+	}
+}
+
+func BenchmarkDecodeCompression(b *testing.B) {
+	data := &decodeData[1]
+	d := testDecoder(data.kind, data.secret)
+	uncompressed, err := testDecoder(data.kind, data.secret, WithCompression(false)).Encode(data.decoded)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, c := range []struct {
+		name, cookie string
+	}{
+		{"compressed", data.cookie},
+		{"uncompressed", uncompressed},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := d.Decode(c.cookie); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
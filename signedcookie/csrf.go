@@ -0,0 +1,64 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// constants from django.middleware.csrf
+const (
+	csrfSecretLength = 32
+	csrfTokenLength  = 2 * csrfSecretLength
+	csrfAllowedChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// UnmaskCSRFToken returns the secret a CSRF token was derived from,
+// implementing django.middleware.csrf._unmask_cipher_token.  Django
+// masks the secret in tokens rendered into forms (and, before Django
+// 4.1, in the csrftoken cookie) by prefixing it with a random mask,
+// and adding the mask to the secret character by character.  Unmasked
+// 32 character secrets are returned as-is.
+func UnmaskCSRFToken(token string) (string, error) {
+	if len(token) != csrfSecretLength && len(token) != csrfTokenLength {
+		return "", fmt.Errorf("%w: CSRF token has incorrect length %d", ErrMalformed, len(token))
+	}
+	for i := 0; i < len(token); i++ {
+		if strings.IndexByte(csrfAllowedChars, token[i]) < 0 {
+			return "", fmt.Errorf("%w: CSRF token has invalid characters", ErrMalformed)
+		}
+	}
+	if len(token) == csrfSecretLength {
+		return token, nil
+	}
+	mask, cipher := token[:csrfSecretLength], token[csrfSecretLength:]
+	secret := make([]byte, csrfSecretLength)
+	n := len(csrfAllowedChars)
+	for i := range secret {
+		x := strings.IndexByte(csrfAllowedChars, cipher[i])
+		y := strings.IndexByte(csrfAllowedChars, mask[i])
+		secret[i] = csrfAllowedChars[(x-y+n)%n]
+	}
+	return string(secret), nil
+}
+
+// CSRFTokensMatch reports whether the token from a csrftoken cookie
+// and the one submitted with a form or X-CSRFToken header were derived
+// from the same secret, as Django's CsrfViewMiddleware requires.
+// Either token may be masked or not.  The secrets are compared in
+// constant time.
+func CSRFTokensMatch(cookieToken, formToken string) bool {
+	cookieSecret, err := UnmaskCSRFToken(cookieToken)
+	if err != nil {
+		return false
+	}
+	formSecret, err := UnmaskCSRFToken(formToken)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookieSecret), []byte(formSecret)) == 1
+}
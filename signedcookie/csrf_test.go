@@ -0,0 +1,48 @@
+package signedcookie
+
+import (
+	"errors"
+	"testing"
+)
+
+const csrfSecret = "Xq9sL2mVbN4cT7kWz1aR8pYe3uH6jD0f"
+
+// masked with django.middleware.csrf._mask_cipher_secret
+var csrfTokens = []string{
+	"kP3nZ8wQ1vB5xM7cR2tL9yG4hJ6sF0dA752FA0IB28v7gJhYgTts7Nu8a3DoOt3F",
+	"abcdefghijABCDEFGHIJ0123456789zzXrbvP7s2jWuDlAOr5yIqYgQ7XpD3hCpE",
+}
+
+func TestUnmaskCSRFToken(t *testing.T) {
+	for _, token := range append(csrfTokens, csrfSecret) {
+		secret, err := UnmaskCSRFToken(token)
+		if err != nil {
+			t.Errorf("UnmaskCSRFToken('%s'): %s", token, err)
+			continue
+		}
+		if secret != csrfSecret {
+			t.Errorf("UnmaskCSRFToken('%s'): %s != %s", token, secret, csrfSecret)
+		}
+	}
+	for _, token := range []string{"", csrfSecret[1:], csrfSecret[1:] + "!"} {
+		if _, err := UnmaskCSRFToken(token); !errors.Is(err, ErrMalformed) {
+			t.Errorf("UnmaskCSRFToken('%s'): expected ErrMalformed, got %v", token, err)
+		}
+	}
+}
+
+func TestCSRFTokensMatch(t *testing.T) {
+	if !CSRFTokensMatch(csrfSecret, csrfTokens[0]) {
+		t.Errorf("secret and masked token don't match")
+	}
+	if !CSRFTokensMatch(csrfTokens[0], csrfTokens[1]) {
+		t.Errorf("differently masked tokens don't match")
+	}
+	other := "Yq9sL2mVbN4cT7kWz1aR8pYe3uH6jD0f"
+	if CSRFTokensMatch(other, csrfTokens[0]) {
+		t.Errorf("tokens from different secrets match")
+	}
+	if CSRFTokensMatch("", "") {
+		t.Errorf("empty tokens match")
+	}
+}
@@ -0,0 +1,649 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// A Decoder decodes cookies signed with django.core.signing using a
+// fixed configuration, so that the serializer, salt and friends don't
+// need to be repeated at every call site.  Decoders are created with
+// NewDecoder.
+//
+// A Decoder is not modified after NewDecoder returns, and its methods
+// are safe for concurrent use by multiple goroutines.  The HMACs used
+// to verify signatures are pooled, so each call gets its own.
+type Decoder struct {
+	serializer Serializer
+	signer     TimestampSigner
+	maxAge     time.Duration
+	noExpiry   bool // if set, the cookie's timestamp isn't checked
+	compress   bool
+	compressor Compressor
+
+	maxDecompressedSize int64
+	maxCookieLength     int
+	expiredError        bool // if set, expired cookies are decoded into an *ExpiredError
+	cookieNames         []string
+
+	// if non-nil, secretFunc supplies the secrets cookies are
+	// verified with, in place of signer's.
+	secretFunc func(cookie string) ([]string, error)
+
+	observer func(DecodeResult) // if non-nil, called after each Decode
+}
+
+// An Option configures a Decoder.
+type Option func(*Decoder) error
+
+// WithSerializer sets the serializer used to decode the cookie
+// payload.  The default is JSON, matching Django's default
+// SESSION_SERIALIZER.
+func WithSerializer(s Serializer) Option {
+	return func(d *Decoder) error {
+		if s != JSON && s != Pickle && s != AutoSerializer {
+			return fmt.Errorf("unknown serializer: %s", s)
+		}
+		d.serializer = s
+		return nil
+	}
+}
+
+// WithMaxAge sets how long after being issued a cookie is considered
+// valid.  The default is SessionCookieAge, which is initially
+// DefaultMaxAge.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(d *Decoder) error {
+		d.maxAge = maxAge
+		return nil
+	}
+}
+
+// WithMaxAgeSeconds is like WithMaxAge, but takes a number of
+// seconds, as Django's SESSION_COOKIE_AGE setting does, so that the
+// setting's value can be used as-is.  Django's default of 1209600
+// seconds is DefaultMaxAge.
+func WithMaxAgeSeconds(seconds int) Option {
+	return WithMaxAge(time.Duration(seconds) * time.Second)
+}
+
+// WithSalt sets the salt the cookie was signed with.  The default is
+// SaltSession, the salt used by the signed_cookies SessionStore.
+func WithSalt(salt string) Option {
+	return func(d *Decoder) error {
+		d.signer.Salt = salt
+		return nil
+	}
+}
+
+// WithNoExpiry disables the maximum age check, so that cookies are
+// accepted regardless of when they were issued.  The signature is
+// still verified, and DecodeWithTimestamp still reports the time the
+// cookie was signed at.
+func WithNoExpiry() Option {
+	return func(d *Decoder) error {
+		d.noExpiry = true
+		return nil
+	}
+}
+
+// WithExpiredError makes Decode, DecodeWithTimestamp, DecodeReader
+// and DecodeContext report cookies that have expired, but whose
+// signature is valid, with an *ExpiredError carrying the decoded
+// session, rather than discarding it.  Such errors still match
+// ErrExpired with errors.Is.
+func WithExpiredError() Option {
+	return func(d *Decoder) error {
+		d.expiredError = true
+		return nil
+	}
+}
+
+// WithFallbackSecrets adds secrets that are accepted in addition to
+// the one passed to NewDecoder, mirroring Django's
+// SECRET_KEY_FALLBACKS setting.  This allows SECRET_KEY to be rotated
+// without invalidating existing cookies.  The primary secret is
+// always tried first.
+func WithFallbackSecrets(secrets ...string) Option {
+	return func(d *Decoder) error {
+		d.signer.FallbackSecrets = append(d.signer.FallbackSecrets, secrets...)
+		return nil
+	}
+}
+
+// WithConstantTimeKeyTrial sets whether a cookie's signature is
+// checked against every secret, rather than stopping at the first
+// that matches.  Normally, a cookie signed with a fallback secret takes
+// longer to verify than one signed with the primary secret, which
+// reveals which secret signed it.  With constant time key trial, the
+// time taken is the same whichever secret matched, at the cost of
+// computing an HMAC per secret for every cookie, including those
+// signed with the primary secret.  It has no effect without fallback
+// secrets.  The default is false.
+func WithConstantTimeKeyTrial(enabled bool) Option {
+	return func(d *Decoder) error {
+		d.signer.allSecrets = enabled
+		return nil
+	}
+}
+
+// WithSecretFunc sets a function that looks up the secrets each
+// cookie may be signed with at decode time, for example by tenant in
+// multi-tenant deployments.  The first secret returned is tried
+// first, and any others are treated as fallbacks; the secret passed
+// to NewDecoder and any WithFallbackSecrets are ignored when
+// decoding.  An error returned by fn is returned by Decode, wrapped.
+// As the secrets aren't known in advance, their HMAC keys are derived
+// for every cookie.  Encode still signs with NewDecoder's secret.
+func WithSecretFunc(fn func(cookie string) ([]string, error)) Option {
+	return func(d *Decoder) error {
+		d.secretFunc = fn
+		return nil
+	}
+}
+
+// WithAlgorithm sets the digest used to verify signatures.  The
+// default is SHA256, matching Django 3.1 and later.
+func WithAlgorithm(a Algorithm) Option {
+	return func(d *Decoder) error {
+		if a.hash() == nil {
+			return fmt.Errorf("unknown algorithm: %d", a)
+		}
+		d.signer.Algorithm = a
+		d.signer.hashFunc = nil
+		return nil
+	}
+}
+
+// WithHashFunc sets the digest used to verify signatures to the one
+// h constructs, such as sha256.New224, for signers configured with an
+// algorithm that isn't an Algorithm.  It overrides WithAlgorithm, or
+// is overridden by it, whichever comes last.
+func WithHashFunc(h func() hash.Hash) Option {
+	return func(d *Decoder) error {
+		if h == nil {
+			return fmt.Errorf("nil hash func")
+		}
+		d.signer.hashFunc = h
+		return nil
+	}
+}
+
+// WithSeparator sets the separator between the payload, timestamp
+// and signature, corresponding to the sep argument of
+// django.core.signing.Signer.  The default is ":".  As in Django, a
+// separator that is empty or consists only of characters that can
+// appear in the base64 payload or base62 timestamp is rejected, as it
+// would make the cookie ambiguous.
+func WithSeparator(sep string) Option {
+	return func(d *Decoder) error {
+		if unsafeSeparator(sep) {
+			return fmt.Errorf("unsafe separator: %q (cannot be empty or consist of only A-z0-9-_=)", sep)
+		}
+		d.signer.sep = []byte(sep)
+		return nil
+	}
+}
+
+// unsafeSeparator mirrors django.core.signing._SEP_UNSAFE, which
+// matches the regular expression ^[A-z0-9-_=]*$.  Note that the range
+// A-z includes the punctuation between 'Z' and 'a'.
+func unsafeSeparator(sep string) bool {
+	for i := 0; i < len(sep); i++ {
+		c := sep[i]
+		if !(c >= 'A' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// WithDebugErrors sets whether signature errors include the cookie
+// itself, and mismatch errors the signature expected.  As the
+// expected signature is valid for the cookie's payload, and the
+// cookie is a credential, this leaks forgeable values into logs, and
+// should only be enabled during development.  The default is false,
+// reporting a bare ErrSignatureMismatch without the cookie.
+func WithDebugErrors(debug bool) Option {
+	return func(d *Decoder) error {
+		d.signer.debug = debug
+		return nil
+	}
+}
+
+// WithCookieName sets the name of the cookie DecodeRequest reads the
+// session from, corresponding to Django's SESSION_COOKIE_NAME
+// setting.  The default is DefaultCookieName.  While renaming the
+// cookie, more names can be given: DecodeRequest then decodes the
+// first cookie with one of the names, in order, that decodes.
+func WithCookieName(name string, more ...string) Option {
+	return func(d *Decoder) error {
+		d.cookieNames = append([]string{name}, more...)
+		return nil
+	}
+}
+
+// WithClock sets the function used to get the current time when
+// checking a cookie's age.  The default is time.Now; tests can supply
+// a fixed time to exercise expiry deterministically.  As the clock
+// belongs to the Decoder, Decoders with different clocks can safely
+// be used concurrently.
+func WithClock(clock func() time.Time) Option {
+	return func(d *Decoder) error {
+		d.signer.clock = clock
+		return nil
+	}
+}
+
+// WithMaxClockSkew rejects cookies signed more than skew in the
+// future with ErrExpired.  Django accepts cookies with any timestamp
+// in the future, so a cookie forged with a leaked secret can be dated
+// to stay valid for years; for compatibility, no limit is enforced
+// by default for the Django scheme.  The ItsDangerous and Flask
+// schemes reject any timestamp in the future by default, as
+// itsdangerous does.  A skew of a few seconds to minutes tolerates
+// clocks that disagree across servers.
+func WithMaxClockSkew(skew time.Duration) Option {
+	return func(d *Decoder) error {
+		if skew < 0 {
+			return fmt.Errorf("negative clock skew: %s", skew)
+		}
+		d.signer.checkSkew = true
+		d.signer.maxSkew = skew
+		return nil
+	}
+}
+
+// WithObserver sets a func called after each call to Decode,
+// DecodeReader or DecodeContext with its outcome, the stage that
+// failed and how long it took, for uses such as exporting metrics.
+// It is called synchronously, so should be quick.  A nil func, the
+// default, observes nothing, and costs nothing.
+func WithObserver(observer func(DecodeResult)) Option {
+	return func(d *Decoder) error {
+		d.observer = observer
+		return nil
+	}
+}
+
+// WithLeeway extends the max age by leeway when checking whether a
+// cookie has expired, so sessions aren't rejected on the boundary
+// because of small differences between clocks, as JWT libraries'
+// leeway does.  The default is no leeway.
+func WithLeeway(leeway time.Duration) Option {
+	return func(d *Decoder) error {
+		if leeway < 0 {
+			return fmt.Errorf("negative leeway: %s", leeway)
+		}
+		d.signer.leeway = leeway
+		return nil
+	}
+}
+
+// WithMaxCookieLength sets the maximum length of the cookies the
+// Decoder accepts, in bytes; longer cookies are rejected with
+// ErrMalformed before their signature is checked.  The default is
+// DefaultMaxCookieLength.
+func WithMaxCookieLength(n int) Option {
+	return func(d *Decoder) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max cookie length: %d", n)
+		}
+		d.maxCookieLength = n
+		return nil
+	}
+}
+
+// WithMaxDecompressedSize sets the maximum number of bytes a
+// compressed payload may expand to; larger payloads are rejected with
+// ErrMalformed, protecting against decompression bombs.  The default
+// is DefaultMaxDecompressedSize.
+func WithMaxDecompressedSize(n int64) Option {
+	return func(d *Decoder) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max decompressed size: %d", n)
+		}
+		d.maxDecompressedSize = n
+		return nil
+	}
+}
+
+// WithCompression sets whether Encode tries to compress the
+// payload, corresponding to the compress argument of
+// django.core.signing.dumps.  Even when enabled, the payload is only
+// stored compressed if that makes it smaller.  The default is true,
+// as used by the signed_cookies session backend.
+func WithCompression(compress bool) Option {
+	return func(d *Decoder) error {
+		d.compress = compress
+		return nil
+	}
+}
+
+// WithCompressor sets the Compressor used to decompress payloads
+// starting with '.', and if it can, to compress them for Encode.  The
+// default is Zlib, matching django.core.signing.
+func WithCompressor(c Compressor) Option {
+	return func(d *Decoder) error {
+		if c == nil {
+			return fmt.Errorf("nil compressor")
+		}
+		d.compressor = c
+		return nil
+	}
+}
+
+// NewDecoder returns a Decoder for cookies signed with secret,
+// configured by opts.  Without options, the Decoder matches the
+// defaults of a current Django install's signed_cookies session
+// backend.
+func NewDecoder(secret string, opts ...Option) (*Decoder, error) {
+	d := &Decoder{
+		serializer: JSON,
+		signer: TimestampSigner{
+			Signer: Signer{Secret: secret, Salt: SaltSession, Algorithm: SHA256},
+			clock:  time.Now,
+		},
+		maxAge:      SessionCookieAge,
+		compress:    true,
+		compressor:  Zlib,
+		cookieNames: []string{DefaultCookieName},
+
+		maxDecompressedSize: DefaultMaxDecompressedSize,
+		maxCookieLength:     DefaultMaxCookieLength,
+	}
+	for _, opt := range opts {
+		if err := opt(d); err != nil {
+			return nil, err
+		}
+	}
+	if d.signer.Salt == "" {
+		d.signer.Salt = SaltTimestampSigner
+	}
+	d.signer.prepare()
+	return d, nil
+}
+
+// Decode returns a map corresponding to the object encoded and signed
+// in cookie, or an error if the cookie could not be decoded or if
+// signature validation failed.
+func (d *Decoder) Decode(cookie string) (map[string]interface{}, error) {
+	return d.DecodeBytes([]byte(cookie))
+}
+
+// DecodeBytes is like Decode, but takes the cookie as a byte slice,
+// such as one sliced from a request buffer, avoiding a copy of it.
+// cookie is only read, and isn't retained.
+func (d *Decoder) DecodeBytes(cookie []byte) (map[string]interface{}, error) {
+	if d.observer != nil {
+		return d.observedDecode(cookie)
+	}
+	o, _, _, err := d.signingLoadsStage(cookie)
+	return o, err
+}
+
+// DecodeReuse is like Decode, but decodes into dst, which is cleared
+// first, rather than a newly made map.  On hot paths, reusing one map
+// across requests avoids allocating a map header and buckets for
+// every cookie; the keys and values stored in it, such as strings and
+// nested maps, are still allocated.  dst must not be nil, and its
+// contents are unspecified if an error is returned.
+func (d *Decoder) DecodeReuse(cookie string, dst map[string]interface{}) error {
+	if dst == nil {
+		return fmt.Errorf("DecodeReuse: nil map")
+	}
+	payload, _, err := d.loadPayload(cookie)
+	if err != nil {
+		return err
+	}
+	for k := range dst {
+		delete(dst, k)
+	}
+	if err = deserializeInto(d.serializer, payload, dst); err != nil {
+		return fmt.Errorf("deserialize: %w", err)
+	}
+	return nil
+}
+
+// DecodeWithSalt is like Decode, but verifies cookie's signature
+// with salt in place of the Decoder's, such as one of the well-known
+// salts like SaltMessages.  As the HMAC keys for salt are derived for
+// each call, this is slower than using a Decoder created WithSalt.
+func (d *Decoder) DecodeWithSalt(salt, cookie string) (map[string]interface{}, error) {
+	if salt == "" {
+		salt = SaltTimestampSigner
+	}
+	salted := *d
+	salted.signer.Salt = salt
+	salted.signer.macs = nil // keyed with the Decoder's salt
+	return salted.Decode(cookie)
+}
+
+// DecodeWithKeyIndex is like Decode, but additionally returns the
+// index of the secret cookie was signed with: 0 for the secret passed
+// to NewDecoder, and i+1 for the i'th secret passed to
+// WithFallbackSecrets (or returned by a WithSecretFunc).  While
+// rotating SECRET_KEY, this tells how much traffic is still signed
+// with an old secret before it is retired.
+func (d *Decoder) DecodeWithKeyIndex(cookie string) (map[string]interface{}, int, error) {
+	payload, _, key, err := d.loadPayloadKey(cookie)
+	if err != nil {
+		return nil, 0, err
+	}
+	o, err := deserialize(d.serializer, payload)
+	if err != nil {
+		return nil, 0, fmt.Errorf("deserialize: %w", err)
+	}
+	return o, key, nil
+}
+
+// DecodeWithTimestamp is like Decode, but additionally returns the
+// time the cookie was signed at.  This is useful for audit logging,
+// or for enforcing an idle timeout stricter than the Decoder's
+// maximum age.
+func (d *Decoder) DecodeWithTimestamp(cookie string) (map[string]interface{}, time.Time, error) {
+	return d.signingLoads(cookie)
+}
+
+// DecodeWithSignature is like Decode, but additionally returns the
+// cookie's signature, as the base64 text that ends the cookie, for
+// uses such as logging a hash of it to correlate requests made with
+// the same session.  The signature is only returned once it has been
+// verified.
+func (d *Decoder) DecodeWithSignature(cookie string) (map[string]interface{}, []byte, error) {
+	c := []byte(cookie)
+	o, err := d.DecodeBytes(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	c = unquoteCookie(c)
+	sep := d.signer.separator()
+	return o, c[bytes.LastIndex(c, sep)+len(sep):], nil
+}
+
+// Encode returns a cookie value containing obj, serialized and signed
+// with the Decoder's configuration and the current time, which
+// Decode will accept.  Only the primary secret is used to sign.  An
+// error is returned if the cookie would contain characters browsers
+// reject in cookie values, as a separator set with WithSeparator
+// might.
+func (d *Decoder) Encode(obj map[string]interface{}) (string, error) {
+	return d.EncodeAt(obj, d.signer.now())
+}
+
+// EncodeAt is like Encode, but signs obj as if the current time were
+// signedAt.
+func (d *Decoder) EncodeAt(obj map[string]interface{}, signedAt time.Time) (string, error) {
+	cookie, err := d.signingDumps(obj, signedAt)
+	if err != nil {
+		return "", err
+	}
+	if err = checkCookieValue(cookie); err != nil {
+		return "", err
+	}
+	return cookie, nil
+}
+
+// Rotate verifies cookie, and returns it re-signed with the current
+// time, for sliding expiration like Django's SESSION_SAVE_EVERY_REQUEST.
+// The payload is kept as-is, so its serializer and compression are
+// preserved; only the timestamp and signature change.  The new cookie
+// is signed with the primary secret, so rotating also moves cookies
+// signed with a fallback secret onto the current one.
+func (d *Decoder) Rotate(cookie string) (string, error) {
+	if err := d.checkLength([]byte(cookie)); err != nil {
+		return "", err
+	}
+	c := unquoteCookie([]byte(cookie))
+	signer, err := d.timestampSigner(c)
+	if err != nil {
+		return "", err
+	}
+	payload, _, _, err := signer.timestampUnsign(c, d.maxAge, !d.noExpiry)
+	if err != nil {
+		return "", fmt.Errorf("timestampUnsign: %w", err)
+	}
+	rotated := string(signer.SignAt(payload, signer.now()))
+	if err = checkCookieValue(rotated); err != nil {
+		return "", err
+	}
+	return rotated, nil
+}
+
+// DecodeReader is like Decode, but reads the cookie from r.  The whole
+// cookie must still be buffered to verify its signature, which comes
+// last, but the decompression and deserialization of its payload are
+// streamed rather than materialized in memory.
+func (d *Decoder) DecodeReader(r io.Reader) (map[string]interface{}, error) {
+	// read one byte past the limit, for checkLength to reject.
+	cookie, err := ioutil.ReadAll(io.LimitReader(r, int64(d.maxCookieLength)+1))
+	if err != nil {
+		return nil, fmt.Errorf("ReadAll: %w", err)
+	}
+	return d.streamingLoads(context.Background(), cookie)
+}
+
+// DecodeContext is like Decode, but stops decompressing and
+// deserializing the payload once ctx is done, returning ctx.Err().
+// This bounds the time spent on large compressed payloads by a
+// request's deadline.
+func (d *Decoder) DecodeContext(ctx context.Context, cookie string) (map[string]interface{}, error) {
+	return d.streamingLoads(ctx, []byte(cookie))
+}
+
+// DecodeValue is like Decode, but returns whatever value was signed,
+// rather than requiring it to be a dict as sessions are.  Values
+// signed with django.core.signing.dumps are often lists, strings or
+// numbers.  Dicts are returned as map[string]interface{}, and lists
+// and tuples as []interface{}.
+func (d *Decoder) DecodeValue(cookie string) (interface{}, error) {
+	payload, _, err := d.loadPayload(cookie)
+	if err != nil {
+		return nil, err
+	}
+	v, err := deserializeValue(d.serializer, payload)
+	if err != nil {
+		return nil, fmt.Errorf("deserialize: %w", err)
+	}
+	return v, nil
+}
+
+// DecodeNoTimestamp is like DecodeValue, but for values signed
+// without a timestamp, with django.core.signing.Signer.sign_object
+// rather than dumps, as tokens such as unsubscribe links often are.
+// As there is no timestamp, the Decoder's maximum age isn't checked.
+func (d *Decoder) DecodeNoTimestamp(cookie string) (interface{}, error) {
+	if err := d.checkLength([]byte(cookie)); err != nil {
+		return nil, err
+	}
+	c := unquoteCookie([]byte(cookie))
+	signer, err := d.timestampSigner(c)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := signer.Signer.Unsign(c)
+	if err != nil {
+		return nil, fmt.Errorf("unsign: %w", err)
+	}
+	if payload, err = decodePayload(payload, d.compressor, d.maxDecompressedSize); err != nil {
+		return nil, err
+	}
+	v, err := deserializeValue(d.serializer, payload)
+	if err != nil {
+		return nil, fmt.Errorf("deserialize: %w", err)
+	}
+	return v, nil
+}
+
+// DecodeRaw verifies cookie's signature and age, and returns its
+// payload decompressed but still serialized, for callers that want to
+// deserialize it themselves, or whose cookies don't hold a dict.
+func (d *Decoder) DecodeRaw(cookie string) ([]byte, error) {
+	payload, _, err := d.loadPayload(cookie)
+	return payload, err
+}
+
+// Verify checks that cookie's signature is valid and that it hasn't
+// expired, without decompressing or deserializing its payload.  This
+// is cheaper than Decode when only the cookie's authenticity matters,
+// for example to gate access to an upstream service.  It returns nil
+// if the cookie is valid, and otherwise the error Decode would for an
+// invalid signature or an expired cookie.
+func (d *Decoder) Verify(cookie string) error {
+	_, _, _, err := d.unsign([]byte(cookie))
+	return err
+}
+
+// IsCompressed verifies cookie, as Verify does, and reports whether
+// its payload has the '.' prefix marking it as compressed, without
+// decompressing or deserializing it.  Across many cookies, this shows
+// how often Django finds compression pays off.
+func (d *Decoder) IsCompressed(cookie string) (bool, error) {
+	payload, _, _, err := d.unsign([]byte(cookie))
+	if err != nil {
+		return false, err
+	}
+	_, compressed, err := splitCompressed(payload)
+	return compressed, err
+}
+
+// DecodeInto verifies cookie, and unmarshals its JSON-serialized
+// payload into v, as json.Unmarshal does.  This avoids the
+// intermediate map returned by Decode, and allows a session to be
+// decoded into a struct with json field tags.  Pickle-serialized
+// cookies are not supported.
+func (d *Decoder) DecodeInto(cookie string, v interface{}) error {
+	if d.serializer != JSON && d.serializer != AutoSerializer {
+		return fmt.Errorf("DecodeInto: only JSON-serialized cookies are supported")
+	}
+	payload, _, err := d.loadPayload(cookie)
+	if err != nil {
+		return err
+	}
+	if d.serializer == AutoSerializer && DetectSerializer(payload) != JSON {
+		return fmt.Errorf("DecodeInto: only JSON-serialized cookies are supported")
+	}
+	return jsonUnmarshal(payload, v)
+}
+
+// DecodeTyped is like Decoder.DecodeInto, but returns the session as
+// a value of type T, typically a struct with json field tags
+// describing the session's shape.  As for DecodeInto, Pickle-serialized
+// cookies are not supported.
+func DecodeTyped[T any](d *Decoder, cookie string) (T, error) {
+	var v T
+	if err := d.DecodeInto(cookie, &v); err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
@@ -0,0 +1,996 @@
+package signedcookie
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecoderDefaults(t *testing.T) {
+	d, err := NewDecoder(sha256Data.secret, WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	decoded, err := d.Decode(sha256Data.cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !reflect.DeepEqual(sha256Data.decoded, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", sha256Data.decoded, decoded)
+	}
+}
+
+func TestDecoderOptions(t *testing.T) {
+	for _, data := range decodeData {
+		d, err := NewDecoder(data.secret, WithSerializer(data.kind), WithAlgorithm(SHA1), WithMaxAge(DefaultMaxAge), WithClock(testNowOK))
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		decoded, err := d.Decode(data.cookie)
+		if err != nil {
+			t.Errorf("Decode(%v): %s", data.kind, err)
+			continue
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+	}
+}
+
+func TestSessionCookieAge(t *testing.T) {
+	defer func(age time.Duration) { SessionCookieAge = age }(SessionCookieAge)
+	SessionCookieAge = time.Hour
+
+	d, err := NewDecoder("secret")
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if d.maxAge != time.Hour {
+		t.Errorf("maxAge: %s != %s", d.maxAge, time.Hour)
+	}
+	if d, err = NewDecoder("secret", WithMaxAge(DefaultMaxAge)); err != nil || d.maxAge != DefaultMaxAge {
+		t.Errorf("WithMaxAge: expected it to override SessionCookieAge (%v)", err)
+	}
+
+	data := &decodeData[1]
+	later := func() time.Time { return time.Unix(1413336784, 0).Add(2 * time.Hour) }
+	if _, err = testDecoder(data.kind, data.secret, WithClock(later)).Decode(data.cookie); !errors.Is(err, ErrExpired) {
+		t.Errorf("Decode: expected ErrExpired, got %v", err)
+	}
+}
+
+func TestDecoderMaxClockSkew(t *testing.T) {
+	// testNowOK is an hour and a half before the cookie was signed.
+	data := &decodeData[1]
+	if _, err := testDecoder(data.kind, data.secret).Decode(data.cookie); err != nil {
+		t.Errorf("Decode without a max skew: %s", err)
+	}
+	if _, err := testDecoder(data.kind, data.secret, WithMaxClockSkew(2*time.Hour)).Decode(data.cookie); err != nil {
+		t.Errorf("Decode within the max skew: %s", err)
+	}
+	_, err := testDecoder(data.kind, data.secret, WithMaxClockSkew(time.Hour)).Decode(data.cookie)
+	if !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired for a cookie from the future, got %v", err)
+	}
+
+	// a skew loosens itsdangerous's default of none.
+	its := itsDangerousData[0]
+	past := func() time.Time { return time.Unix(1413244800-60, 0) }
+	d, err := NewDecoder(its.secret, WithScheme(its.scheme), WithClock(past), WithMaxClockSkew(time.Minute))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err = d.Decode(its.cookie); err != nil {
+		t.Errorf("Decode(%s) within the max skew: %s", its.scheme, err)
+	}
+
+	if _, err = NewDecoder("secret", WithMaxClockSkew(-time.Second)); err == nil {
+		t.Errorf("NewDecoder accepted a negative skew")
+	}
+}
+
+func TestDecoderLeeway(t *testing.T) {
+	data := &decodeData[1]
+	issued, err := PeekTimestamp(data.cookie)
+	if err != nil {
+		t.Fatalf("PeekTimestamp: %s", err)
+	}
+	// half a second past the max age
+	late := func() time.Time { return issued.Add(time.Hour + 500*time.Millisecond) }
+
+	_, err = testDecoder(data.kind, data.secret, WithMaxAge(time.Hour), WithClock(late)).Decode(data.cookie)
+	if !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired without a leeway, got %v", err)
+	}
+	d := testDecoder(data.kind, data.secret, WithMaxAge(time.Hour), WithClock(late), WithLeeway(time.Second))
+	if _, err = d.Decode(data.cookie); err != nil {
+		t.Errorf("Decode within the leeway: %s", err)
+	}
+	d = testDecoder(data.kind, data.secret, WithMaxAge(time.Hour), WithClock(late), WithLeeway(100*time.Millisecond))
+	if _, err = d.Decode(data.cookie); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired past the leeway, got %v", err)
+	}
+
+	if _, err = NewDecoder("secret", WithLeeway(-time.Second)); err == nil {
+		t.Errorf("NewDecoder accepted a negative leeway")
+	}
+}
+
+func TestDecoderMaxAgeSeconds(t *testing.T) {
+	// Django's default SESSION_COOKIE_AGE
+	d, err := NewDecoder("secret", WithMaxAgeSeconds(1209600))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if d.maxAge != DefaultMaxAge {
+		t.Errorf("maxAge: %s != %s", d.maxAge, DefaultMaxAge)
+	}
+
+	data := &decodeData[1]
+	// an hour after the cookie was signed
+	later := func() time.Time { return time.Unix(1413336784, 0).Add(time.Hour) }
+	if _, err = testDecoder(data.kind, data.secret, WithClock(later), WithMaxAgeSeconds(86400)).Decode(data.cookie); err != nil {
+		t.Errorf("Decode: %s", err)
+	}
+	_, err = testDecoder(data.kind, data.secret, WithClock(later), WithMaxAgeSeconds(60)).Decode(data.cookie)
+	if !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestDecoderInvalidAlgorithm(t *testing.T) {
+	if _, err := NewDecoder("secret", WithAlgorithm(Algorithm(42))); err == nil {
+		t.Errorf("NewDecoder accepted an unknown algorithm")
+	}
+}
+
+func TestDecoderHashFunc(t *testing.T) {
+	// signing.dumps({'a': 'b'}, key='secret', algorithm='sha224',
+	//     salt='django.contrib.sessions.backends.signed_cookies')
+	const cookie = "eyJhIjoiYiJ9:1XdpWy:RJymxuM0OIy66uZydXW-pQFGhPAJJU6lqdPVgw"
+	d := testDecoder(JSON, "secret", WithHashFunc(sha256.New224))
+	decoded, err := d.Decode(cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !reflect.DeepEqual(map[string]interface{}{"a": "b"}, decoded) {
+		t.Errorf("Decode: %#v", decoded)
+	}
+	// the last of WithHashFunc and WithAlgorithm wins.
+	d = testDecoder(JSON, "secret", WithHashFunc(sha256.New224), WithAlgorithm(SHA256))
+	if _, err = d.Decode(cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+	if _, err = NewDecoder("secret", WithHashFunc(nil)); err == nil {
+		t.Errorf("NewDecoder accepted a nil hash func")
+	}
+}
+
+func TestDecoderInvalidSerializer(t *testing.T) {
+	if _, err := NewDecoder("secret", WithSerializer(Serializer(99))); err == nil {
+		t.Errorf("NewDecoder accepted an unknown serializer")
+	}
+	d := &decodeData[1]
+	if _, err := Decode(Serializer(99), DefaultMaxAge, d.secret, d.cookie); err == nil {
+		t.Errorf("Decode accepted an unknown serializer")
+	}
+	if _, err := DecodeSessionData(Serializer(99), sessionDataSecret, sessionData[0].data); err == nil {
+		t.Errorf("DecodeSessionData accepted an unknown serializer")
+	}
+}
+
+func TestDecoderFallbackSecrets(t *testing.T) {
+	data := &decodeData[1]
+	d, err := NewDecoder("new-secret", WithSerializer(data.kind), WithAlgorithm(SHA1),
+		WithFallbackSecrets("older-secret", data.secret), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	decoded, err := d.Decode(data.cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !reflect.DeepEqual(data.decoded, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+	}
+
+	d, err = NewDecoder("new-secret", WithSerializer(data.kind), WithAlgorithm(SHA1),
+		WithFallbackSecrets("older-secret"))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err = d.Decode(data.cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestDecodeWithKeyIndex(t *testing.T) {
+	data := &decodeData[1]
+	for _, c := range []struct {
+		secret    string
+		fallbacks []string
+		index     int
+	}{
+		{data.secret, nil, 0},
+		{"new-secret", []string{data.secret}, 1},
+		{"new-secret", []string{"older-secret", data.secret}, 2},
+	} {
+		d := testDecoder(data.kind, c.secret, WithFallbackSecrets(c.fallbacks...))
+		decoded, index, err := d.DecodeWithKeyIndex(data.cookie)
+		if err != nil {
+			t.Errorf("DecodeWithKeyIndex: %s", err)
+			continue
+		}
+		if index != c.index {
+			t.Errorf("DecodeWithKeyIndex: index %d, expected %d", index, c.index)
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+	}
+	d := testDecoder(data.kind, "new-secret", WithFallbackSecrets("older-secret"))
+	if _, _, err := d.DecodeWithKeyIndex(data.cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestDecoderConstantTimeKeyTrial(t *testing.T) {
+	data := &decodeData[1]
+	for _, c := range []struct {
+		secret    string
+		fallbacks []string
+		index     int
+	}{
+		{data.secret, nil, 0},
+		{data.secret, []string{"older-secret", data.secret}, 0},
+		{"new-secret", []string{data.secret, "older-secret"}, 1},
+		{"new-secret", []string{"older-secret", data.secret}, 2},
+		// the first matching secret wins, as without the option
+		{"new-secret", []string{data.secret, data.secret}, 1},
+	} {
+		d := testDecoder(data.kind, c.secret, WithFallbackSecrets(c.fallbacks...), WithConstantTimeKeyTrial(true))
+		decoded, index, err := d.DecodeWithKeyIndex(data.cookie)
+		if err != nil {
+			t.Errorf("DecodeWithKeyIndex(%s, %v): %s", c.secret, c.fallbacks, err)
+			continue
+		}
+		if index != c.index {
+			t.Errorf("DecodeWithKeyIndex(%s, %v): index %d, expected %d", c.secret, c.fallbacks, index, c.index)
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+	}
+	d := testDecoder(data.kind, "new-secret", WithFallbackSecrets("older-secret"), WithConstantTimeKeyTrial(true))
+	if _, _, err := d.DecodeWithKeyIndex(data.cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestDecoderSecretFunc(t *testing.T) {
+	data := &decodeData[1]
+	errNoTenant := errors.New("no tenant")
+	var got string
+	secrets := func(cookie string) ([]string, error) {
+		got = cookie
+		if strings.HasPrefix(cookie, "x") {
+			return nil, errNoTenant
+		}
+		return []string{"tenant-secret", data.secret}, nil
+	}
+	d, err := NewDecoder("unused-secret", WithSerializer(data.kind), WithAlgorithm(SHA1),
+		WithSecretFunc(secrets), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	decoded, err := d.Decode(data.cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !reflect.DeepEqual(data.decoded, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+	}
+	if got != data.cookie {
+		t.Errorf("secret func called with %q, expected %q", got, data.cookie)
+	}
+	if _, err = d.Decode("x" + data.cookie); !errors.Is(err, errNoTenant) {
+		t.Errorf("expected secret func error, got %v", err)
+	}
+	if _, tr, err := d.DecodeAndExplain("x" + data.cookie); !errors.Is(err, errNoTenant) || tr.Err() == nil {
+		t.Errorf("DecodeAndExplain: expected secret func error, got %v", err)
+	}
+
+	none := func(string) ([]string, error) { return nil, nil }
+	d, err = NewDecoder(data.secret, WithSerializer(data.kind), WithAlgorithm(SHA1),
+		WithSecretFunc(none), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err = d.Decode(data.cookie); err == nil {
+		t.Errorf("Decode: expected error when secret func returns no secrets")
+	}
+}
+
+func TestDecodeReuse(t *testing.T) {
+	dst := map[string]interface{}{"stale": true}
+	for _, data := range decodeData {
+		d, err := NewDecoder(data.secret, WithSerializer(data.kind), WithAlgorithm(SHA1), WithClock(testNowOK))
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		if err = d.DecodeReuse(data.cookie, dst); err != nil {
+			t.Errorf("DecodeReuse(%v): %s", data.kind, err)
+			continue
+		}
+		if !reflect.DeepEqual(data.decoded, dst) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, dst)
+		}
+	}
+	d := testDecoder(JSON, decodeData[1].secret)
+	if err := d.DecodeReuse(decodeData[1].cookie, nil); err == nil {
+		t.Errorf("DecodeReuse: expected error for nil map")
+	}
+}
+
+func BenchmarkDecodeReuse(b *testing.B) {
+	data := &decodeData[1]
+	d := testDecoder(data.kind, data.secret)
+	b.Run("Decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := d.Decode(data.cookie); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("DecodeReuse", func(b *testing.B) {
+		dst := make(map[string]interface{})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := d.DecodeReuse(data.cookie, dst); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDecoderDebugErrors(t *testing.T) {
+	data := &decodeData[1]
+	tampered := data.cookie[:len(data.cookie)-1] + "x"
+	// the expected signature is the cookie's real one.
+	sig := data.cookie[strings.LastIndex(data.cookie, ":")+1:]
+	for _, debug := range []bool{false, true} {
+		d := testDecoder(data.kind, data.secret, WithDebugErrors(debug))
+		_, err := d.Decode(tampered)
+		if !errors.Is(err, ErrSignatureMismatch) {
+			t.Fatalf("expected ErrSignatureMismatch, got %v", err)
+		}
+		if leaked := strings.Contains(err.Error(), sig); leaked != debug {
+			t.Errorf("debug %v: error %q includes expected signature: %v", debug, err, leaked)
+		}
+		if leaked := strings.Contains(err.Error(), tampered); leaked != debug {
+			t.Errorf("debug %v: error %q includes the cookie: %v", debug, err, leaked)
+		}
+		_, trace, err := d.DecodeAndExplain(tampered)
+		if !errors.Is(err, ErrSignatureMismatch) {
+			t.Fatalf("DecodeAndExplain: expected ErrSignatureMismatch, got %v", err)
+		}
+		if leaked := strings.Contains(err.Error(), tampered) || strings.Contains(trace.String(), tampered); leaked != debug {
+			t.Errorf("debug %v: DecodeAndExplain error %q includes the cookie: %v", debug, err, leaked)
+		}
+	}
+}
+
+func TestDecoderDecodeWithSalt(t *testing.T) {
+	obj := map[string]interface{}{"a": "b"}
+	cookie, err := Dumps(obj, "secret", "custom.salt", false)
+	if err != nil {
+		t.Fatalf("Dumps: %s", err)
+	}
+	d, err := NewDecoder("secret")
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err = d.Decode(cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("Decode: expected ErrSignatureMismatch, got %v", err)
+	}
+	decoded, err := d.DecodeWithSalt("custom.salt", cookie)
+	if err != nil {
+		t.Fatalf("DecodeWithSalt: %s", err)
+	}
+	if !reflect.DeepEqual(obj, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", obj, decoded)
+	}
+	// the Decoder itself is unchanged.
+	if _, err = d.Decode(cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("Decode after DecodeWithSalt: expected ErrSignatureMismatch, got %v", err)
+	}
+
+	if cookie, err = Dumps(obj, "secret", "", false); err != nil {
+		t.Fatalf("Dumps: %s", err)
+	}
+	if _, err = d.DecodeWithSalt("", cookie); err != nil {
+		t.Errorf("DecodeWithSalt with TimestampSigner's salt: %s", err)
+	}
+}
+
+func TestDecodeWithTimestamp(t *testing.T) {
+	data := &decodeData[1]
+	d, err := NewDecoder(data.secret, WithSerializer(data.kind), WithAlgorithm(SHA1), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	_, issued, err := d.DecodeWithTimestamp(data.cookie)
+	if err != nil {
+		t.Fatalf("DecodeWithTimestamp: %s", err)
+	}
+	// 1XeDSa, the timestamp segment of the cookie
+	if expected := time.Unix(1413336784, 0); !issued.Equal(expected) {
+		t.Errorf("issued at %s, expected %s", issued, expected)
+	}
+}
+
+func TestDecodeWithSignature(t *testing.T) {
+	data := &decodeData[1]
+	d := testDecoder(data.kind, data.secret)
+	expected := data.cookie[strings.LastIndex(data.cookie, ":")+1:]
+	for _, cookie := range []string{data.cookie, `"` + data.cookie + `"`} {
+		decoded, sig, err := d.DecodeWithSignature(cookie)
+		if err != nil {
+			t.Fatalf("DecodeWithSignature(%s): %s", cookie, err)
+		}
+		if string(sig) != expected {
+			t.Errorf("signature %s, expected %s", sig, expected)
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+	}
+
+	_, sig, err := testDecoder(data.kind, "wrong-secret").DecodeWithSignature(data.cookie)
+	if !errors.Is(err, ErrSignatureMismatch) || sig != nil {
+		t.Errorf("expected ErrSignatureMismatch and no signature, got %q, %v", sig, err)
+	}
+}
+
+func TestDecodeJSONRaw(t *testing.T) {
+	obj := map[string]interface{}{
+		"_auth_user_id": json.Number("12345678901234567890"),
+		"cart":          map[string]interface{}{"total": json.Number("1.10")},
+	}
+	cookie, err := Encode(JSON, "secret", obj)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	decoded, err := DecodeJSONRaw(DefaultMaxAge, "secret", cookie)
+	if err != nil {
+		t.Fatalf("DecodeJSONRaw: %s", err)
+	}
+	expected := map[string]json.RawMessage{
+		"_auth_user_id": json.RawMessage("12345678901234567890"),
+		"cart":          json.RawMessage(`{"total":1.10}`),
+	}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%q != %q)", expected, decoded)
+	}
+
+	pickled, err := Encode(Pickle, "secret", map[string]interface{}{"a": "b"})
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if _, err = DecodeJSONRaw(DefaultMaxAge, "secret", pickled); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for a Pickle-serialized cookie, got %v", err)
+	}
+	if _, err = DecodeJSONRaw(DefaultMaxAge, "wrong", cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	var session struct {
+		UserID  string `json:"_auth_user_id"`
+		Backend string `json:"_auth_user_backend"`
+		Hash    string `json:"_auth_user_hash"`
+	}
+	d, err := NewDecoder(sha256Data.secret, WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if err = d.DecodeInto(sha256Data.cookie, &session); err != nil {
+		t.Fatalf("DecodeInto: %s", err)
+	}
+	if session.UserID != "1334" || session.Backend != sha256Data.decoded["_auth_user_backend"] ||
+		session.Hash != sha256Data.decoded["_auth_user_hash"] {
+		t.Errorf("unexpected session: %#v", session)
+	}
+
+	data := &decodeData[0]
+	if err = DecodeInto(data.kind, DefaultMaxAge, data.secret, data.cookie, &session); err == nil {
+		t.Errorf("DecodeInto accepted a Pickle-serialized cookie")
+	}
+	if err = testDecoder(AutoSerializer, data.secret).DecodeInto(data.cookie, &session); err == nil {
+		t.Errorf("DecodeInto accepted a Pickle-serialized cookie with AutoSerializer")
+	}
+	data = &decodeData[1]
+	var session2 struct {
+		UserID int64 `json:"_auth_user_id"`
+	}
+	if err = testDecoder(AutoSerializer, data.secret).DecodeInto(data.cookie, &session2); err != nil || session2.UserID != 1334 {
+		t.Errorf("DecodeInto(AutoSerializer): %#v, %v", session2, err)
+	}
+}
+
+type testSession struct {
+	UserID  string `json:"_auth_user_id"`
+	Backend string `json:"_auth_user_backend"`
+}
+
+func TestDecodeTyped(t *testing.T) {
+	d, err := NewDecoder(sha256Data.secret, WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	session, err := DecodeTyped[testSession](d, sha256Data.cookie)
+	if err != nil {
+		t.Fatalf("DecodeTyped: %s", err)
+	}
+	if session.UserID != "1334" || session.Backend != sha256Data.decoded["_auth_user_backend"] {
+		t.Errorf("unexpected session: %#v", session)
+	}
+	ptr, err := DecodeTyped[*testSession](d, sha256Data.cookie)
+	if err != nil || ptr == nil || *ptr != session {
+		t.Errorf("DecodeTyped(pointer): %#v, %v", ptr, err)
+	}
+
+	data := &decodeData[0]
+	if session, err = DecodeTyped[testSession](testDecoder(data.kind, data.secret), data.cookie); err == nil {
+		t.Errorf("DecodeTyped accepted a Pickle-serialized cookie")
+	}
+	if session != (testSession{}) {
+		t.Errorf("DecodeTyped returned %#v with an error", session)
+	}
+}
+
+func TestDecoderSeparator(t *testing.T) {
+	secret := "secretsecretsecretsecretsecretsecretsecretsecret"
+	// signing.dumps({'user': 42}, salt=..., sep='/')
+	cookie := "eyJ1c2VyIjo0Mn0/1XdpWy/Og8rjjKXIeiqx5G9gnXW202qoF72rQjzONYptDRoUvw"
+	d, err := NewDecoder(secret, WithSeparator("/"), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	decoded, err := d.Decode(cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if expected := map[string]interface{}{"user": float64(42)}; !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+
+	for _, sep := range []string{"", "a", "-", "_", "==", "[", "Z0"} {
+		if _, err := NewDecoder(secret, WithSeparator(sep)); err == nil {
+			t.Errorf("WithSeparator(%q) should be rejected", sep)
+		}
+	}
+	for _, sep := range []string{":", "/", "a:", "::"} {
+		if _, err := NewDecoder(secret, WithSeparator(sep)); err != nil {
+			t.Errorf("WithSeparator(%q): %s", sep, err)
+		}
+	}
+}
+
+func TestDecodeQuoted(t *testing.T) {
+	data := &decodeData[1]
+	d := testDecoder(data.kind, data.secret)
+	quoted := `"` + data.cookie + `"`
+	if _, err := d.Decode(quoted); err != nil {
+		t.Errorf("Decode(%s): %s", quoted, err)
+	}
+	if err := d.Verify(quoted); err != nil {
+		t.Errorf("Verify(%s): %s", quoted, err)
+	}
+
+	// SimpleCookie quotes values containing a comma, escaping it
+	// as \054.
+	secret := "secretsecretsecretsecretsecretsecretsecretsecret"
+	cookie := `"eyJ1c2VyIjo0Mn0\0541XdpWy\054S1JeEO2UAY9Nuf2gTn45eZHqSjDGJ75oppHk56A4-50"`
+	d, err := NewDecoder(secret, WithSeparator(","), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	decoded, err := d.Decode(cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if expected := map[string]interface{}{"user": float64(42)}; !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+	if _, err = d.DecodeReader(strings.NewReader(cookie)); err != nil {
+		t.Errorf("DecodeReader: %s", err)
+	}
+}
+
+func TestDecoderNoExpiry(t *testing.T) {
+	data := &decodeData[1]
+	d, err := NewDecoder(data.secret, WithSerializer(data.kind), WithAlgorithm(SHA1), WithNoExpiry(), WithClock(testNowTimedOut))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	decoded, issued, err := d.DecodeWithTimestamp(data.cookie)
+	if err != nil {
+		t.Fatalf("DecodeWithTimestamp: %s", err)
+	}
+	if !reflect.DeepEqual(data.decoded, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+	}
+	if expected := time.Unix(1413336784, 0); !issued.Equal(expected) {
+		t.Errorf("issued at %s, expected %s", issued, expected)
+	}
+	if _, err = d.Decode("X" + data.cookie[1:]); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestDecoderClock(t *testing.T) {
+	data := &decodeData[1]
+	d, err := NewDecoder(data.secret, WithSerializer(data.kind), WithAlgorithm(SHA1), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err = d.Decode(data.cookie); err != nil {
+		t.Errorf("Decode: %s", err)
+	}
+	d, err = NewDecoder(data.secret, WithSerializer(data.kind), WithAlgorithm(SHA1), WithClock(testNowTimedOut))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err = d.Decode(data.cookie); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestDecoderClockConcurrent(t *testing.T) {
+	data := &decodeData[1]
+	ok := testDecoder(data.kind, data.secret)
+	expired := testDecoder(data.kind, data.secret, WithClock(testNowTimedOut))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := ok.Decode(data.cookie); err != nil {
+				t.Errorf("Decode: %s", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := expired.Decode(data.cookie); !errors.Is(err, ErrExpired) {
+				t.Errorf("expected ErrExpired, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDecoderConcurrent(t *testing.T) {
+	var secrets []string
+	for _, data := range decodeData {
+		secrets = append(secrets, data.secret)
+	}
+	d := testDecoder(AutoSerializer, "unused-secret", WithFallbackSecrets(secrets...))
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dst := make(map[string]interface{})
+			for j := 0; j < 50; j++ {
+				data := &decodeData[(i+j)%len(decodeData)]
+				decoded, err := d.Decode(data.cookie)
+				if err != nil {
+					t.Errorf("Decode(%v): %s", data.kind, err)
+					return
+				}
+				if !reflect.DeepEqual(data.decoded, decoded) {
+					t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+				}
+				if err = d.DecodeReuse(data.cookie, dst); err != nil {
+					t.Errorf("DecodeReuse(%v): %s", data.kind, err)
+				}
+				if err = d.Verify(data.cookie + "x"); !errors.Is(err, ErrSignatureMismatch) {
+					t.Errorf("Verify: expected ErrSignatureMismatch, got %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestRotate(t *testing.T) {
+	for _, data := range decodeData {
+		// an hour after the cookie was signed, under a new secret
+		now := time.Unix(1413336784, 0).Add(time.Hour)
+		d := testDecoder(data.kind, "new-secret", WithFallbackSecrets(data.secret),
+			WithClock(func() time.Time { return now }))
+		rotated, err := d.Rotate(data.cookie)
+		if err != nil {
+			t.Fatalf("Rotate(%v): %s", data.kind, err)
+		}
+		// the payload is unchanged, compression prefix included.
+		payload := data.cookie[:strings.Index(data.cookie, ":")]
+		if !strings.HasPrefix(rotated, payload+":") {
+			t.Errorf("Rotate(%v): payload changed: %s", data.kind, rotated)
+		}
+		decoded, issued, err := d.DecodeWithTimestamp(rotated)
+		if err != nil {
+			t.Fatalf("DecodeWithTimestamp: %s", err)
+		}
+		if !issued.Equal(now) {
+			t.Errorf("issued at %s, expected %s", issued, now)
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+		if _, index, err := d.DecodeWithKeyIndex(rotated); err != nil || index != 0 {
+			t.Errorf("DecodeWithKeyIndex: %d, %v, expected the primary secret", index, err)
+		}
+	}
+
+	data := &decodeData[1]
+	if _, err := testDecoder(data.kind, data.secret, WithClock(testNowTimedOut)).Rotate(data.cookie); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+	if _, err := testDecoder(data.kind, "wrong-secret").Rotate(data.cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestDecodeReader(t *testing.T) {
+	for _, data := range decodeData {
+		d := testDecoder(data.kind, data.secret)
+		decoded, err := d.DecodeReader(strings.NewReader(data.cookie))
+		if err != nil {
+			t.Errorf("DecodeReader(%v): %s", data.kind, err)
+			continue
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+	}
+
+	secret := decodeData[1].secret
+	d := testDecoder(JSON, secret, WithMaxDecompressedSize(64))
+	cases := []struct {
+		cookie string
+		err    error
+	}{
+		{testSign(secret, []byte(`{"a":1}garbage`)), ErrMalformed},
+		{testSign(secret, []byte(`[1334]`)), ErrMalformed},
+		{testSign(secret, nil), ErrMalformed},
+		{testSignCompressed(secret, []byte(`{"a":"`+strings.Repeat("x", 64)+`"}`)), ErrMalformed},
+		{testSign("wrong-secret", []byte(`{"a":1}`)), ErrSignatureMismatch},
+	}
+	for _, c := range cases {
+		if _, err := d.DecodeReader(strings.NewReader(c.cookie)); !errors.Is(err, c.err) {
+			t.Errorf("DecodeReader(%s): expected %v, got %v", c.cookie, c.err, err)
+		}
+	}
+}
+
+func TestDecoderEncodeCompression(t *testing.T) {
+	compressible := map[string]interface{}{"a": strings.Repeat("x", 200)}
+	incompressible := map[string]interface{}{"a": float64(1)}
+	cases := []struct {
+		compress   bool
+		obj        map[string]interface{}
+		compressed bool
+	}{
+		{true, compressible, true},
+		{true, incompressible, false},
+		{false, compressible, false},
+	}
+	for _, c := range cases {
+		d, err := NewDecoder("secret", WithCompression(c.compress))
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		cookie, err := d.Encode(c.obj)
+		if err != nil {
+			t.Fatalf("Encode: %s", err)
+		}
+		if compressed := strings.HasPrefix(cookie, "."); compressed != c.compressed {
+			t.Errorf("WithCompression(%t): compressed %t, expected %t (%s)", c.compress, compressed, c.compressed, cookie)
+		}
+		decoded, err := d.Decode(cookie)
+		if err != nil {
+			t.Errorf("Decode(Encode): %s", err)
+		} else if !reflect.DeepEqual(c.obj, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", c.obj, decoded)
+		}
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	data := &decodeData[1]
+	payload, err := testDecoder(data.kind, data.secret).DecodeRaw(data.cookie)
+	if err != nil {
+		t.Fatalf("DecodeRaw: %s", err)
+	}
+	const expected = `{"_auth_user_id":1334,"_auth_user_backend":"some.sweet.Backend"}`
+	if string(payload) != expected {
+		t.Errorf("DecodeRaw: %s != %s", payload, expected)
+	}
+
+	// a top-level list can't be decoded into a map, but its raw
+	// payload is still available.
+	secret := data.secret
+	cookie := testSign(secret, []byte(`[1334]`))
+	payload, err = testDecoder(JSON, secret).DecodeRaw(cookie)
+	if err != nil || string(payload) != "[1334]" {
+		t.Errorf("DecodeRaw(list): %q, %v", payload, err)
+	}
+	if _, err = testDecoder(JSON, secret, WithClock(testNowTimedOut)).DecodeRaw(cookie); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	data := &decodeData[1]
+	if err := testDecoder(data.kind, data.secret).Verify(data.cookie); err != nil {
+		t.Errorf("Verify: %s", err)
+	}
+	if err := testDecoder(data.kind, "wrong-secret").Verify(data.cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+	if err := testDecoder(data.kind, data.secret, WithClock(testNowTimedOut)).Verify(data.cookie); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+
+	// the payload isn't deserialized, so a cookie whose payload
+	// Decode would reject is still authentic.
+	cookie := testSign(data.secret, []byte("not json"))
+	d := testDecoder(JSON, data.secret)
+	if err := d.Verify(cookie); err != nil {
+		t.Errorf("Verify(not json): %s", err)
+	}
+	if _, err := d.Decode(cookie); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	for _, data := range decodeData {
+		if compressed, err := testDecoder(data.kind, data.secret).IsCompressed(data.cookie); err != nil || !compressed {
+			t.Errorf("IsCompressed(%v): %v, %v", data.kind, compressed, err)
+		}
+	}
+	data := &decodeData[1]
+	d := testDecoder(JSON, data.secret)
+	if compressed, err := d.IsCompressed(testSign(data.secret, []byte("e30"))); err != nil || compressed {
+		t.Errorf("IsCompressed(uncompressed): %v, %v", compressed, err)
+	}
+	// the payload isn't decompressed.
+	signer := TimestampSigner{Signer: Signer{Secret: data.secret, Salt: SaltSession, Algorithm: SHA1}}
+	notZlib := string(signer.SignAt(append([]byte{'.'}, b64Encode([]byte("not zlib"))...), testNowOK()))
+	if compressed, err := d.IsCompressed(notZlib); err != nil || !compressed {
+		t.Errorf("IsCompressed(not zlib): %v, %v", compressed, err)
+	}
+	if _, err := testDecoder(data.kind, "wrong-secret").IsCompressed(data.cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	secret := decodeData[1].secret
+	cases := []struct {
+		kind     Serializer
+		payload  string
+		expected interface{}
+	}{
+		{JSON, `[1334,"a"]`, []interface{}{float64(1334), "a"}},
+		{JSON, `"token"`, "token"},
+		{JSON, `1334`, float64(1334)},
+		{JSON, `{"a":1}`, map[string]interface{}{"a": float64(1)}},
+		// pickle.dumps([1, 'a'], 2)
+		{Pickle, "\x80\x02]q\x00(K\x01X\x01\x00\x00\x00aq\x01e.", []interface{}{int64(1), "a"}},
+	}
+	for _, c := range cases {
+		v, err := testDecoder(c.kind, secret).DecodeValue(testSign(secret, []byte(c.payload)))
+		if err != nil {
+			t.Errorf("DecodeValue(%q): %s", c.payload, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.expected, v) {
+			t.Errorf("DeepEqual(%#v != %#v)", c.expected, v)
+		}
+	}
+}
+
+// cancelAfter is a context that is canceled after Err has been
+// called n times, to cancel deterministically mid-decode.
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfter) Done() <-chan struct{} { return make(chan struct{}) }
+
+func (c *cancelAfter) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDecodeContext(t *testing.T) {
+	data := &decodeData[1]
+	d := testDecoder(data.kind, data.secret)
+	decoded, err := d.DecodeContext(context.Background(), data.cookie)
+	if err != nil {
+		t.Fatalf("DecodeContext: %s", err)
+	}
+	if !reflect.DeepEqual(data.decoded, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = d.DecodeContext(ctx, data.cookie); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// a large payload is read in many chunks; cancel after the first.
+	secret := data.secret
+	big := fmt.Sprintf(`{"a":"%s"}`, strings.Repeat("x", 64<<10))
+	cookie := testSignCompressed(secret, []byte(big))
+	if _, err = testDecoder(JSON, secret).DecodeContext(&cancelAfter{context.Background(), 2}, cookie); err != context.Canceled {
+		t.Errorf("expected context.Canceled mid-decode, got %v", err)
+	}
+}
+
+func TestDecoderExpiredError(t *testing.T) {
+	for _, data := range decodeData {
+		issued, err := PeekTimestamp(data.cookie)
+		if err != nil {
+			t.Fatalf("PeekTimestamp: %s", err)
+		}
+		d := testDecoder(data.kind, data.secret, WithClock(testNowTimedOut), WithExpiredError())
+		var expired *ExpiredError
+		for name, decode := range map[string]func(string) (map[string]interface{}, error){
+			"Decode": d.Decode,
+			"DecodeReader": func(cookie string) (map[string]interface{}, error) {
+				return d.DecodeReader(strings.NewReader(cookie))
+			},
+			"DecodeContext": func(cookie string) (map[string]interface{}, error) {
+				return d.DecodeContext(context.Background(), cookie)
+			},
+		} {
+			expired = nil
+			_, err = decode(data.cookie)
+			if !errors.As(err, &expired) || !errors.Is(err, ErrExpired) {
+				t.Fatalf("%s: expected an ExpiredError, got %v", name, err)
+			}
+			if !reflect.DeepEqual(data.decoded, expired.Session) || !expired.Issued.Equal(issued) {
+				t.Errorf("%s: ExpiredError: %#v, issued %s", name, expired.Session, expired.Issued)
+			}
+		}
+
+		// without the option, or for forged cookies, the session
+		// isn't returned.
+		_, err = testDecoder(data.kind, data.secret, WithClock(testNowTimedOut)).Decode(data.cookie)
+		if !errors.Is(err, ErrExpired) || errors.As(err, &expired) {
+			t.Errorf("expected a bare ErrExpired, got %v", err)
+		}
+		_, err = testDecoder(data.kind, "wrong", WithClock(testNowTimedOut), WithExpiredError()).Decode(data.cookie)
+		if !errors.Is(err, ErrSignatureMismatch) || errors.As(err, &expired) {
+			t.Errorf("expected ErrSignatureMismatch, got %v", err)
+		}
+	}
+}
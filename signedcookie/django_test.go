@@ -0,0 +1,100 @@
+package signedcookie
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a djangoCase is a cookie signed by testdata/django_signing.py.
+type djangoCase struct {
+	Serializer string                 `json:"serializer"`
+	Algorithm  string                 `json:"algorithm"`
+	Compress   bool                   `json:"compress"`
+	Obj        map[string]interface{} `json:"obj"`
+	Cookie     string                 `json:"cookie"`
+}
+
+// options returns the Decoder options matching c.
+func (c *djangoCase) options() []Option {
+	s, a := JSON, SHA1
+	if c.Serializer == "pickle" {
+		s = Pickle
+	}
+	if c.Algorithm == "sha256" {
+		a = SHA256
+	}
+	return []Option{WithSerializer(s), WithAlgorithm(a), WithCompression(c.Compress)}
+}
+
+// djangoSigning runs testdata/django_signing.py with the interpreter
+// named by DJANGO_PYTHON, skipping the test if it isn't set.
+func djangoSigning(t *testing.T, mode string, in interface{}, out interface{}) {
+	python := os.Getenv("DJANGO_PYTHON")
+	if python == "" {
+		t.Skip("DJANGO_PYTHON not set to a Python with Django installed")
+	}
+	cmd := exec.Command(python, "testdata/django_signing.py", mode)
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			t.Fatalf("json.Marshal: %s", err)
+		}
+		cmd.Stdin = bytes.NewReader(b)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("django_signing.py %s: %s\n%s", mode, err, stderr.String())
+	}
+	if err = json.Unmarshal(b, out); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+}
+
+// TestDjangoLive checks that cookies signed by Django decode, and that
+// cookies encoded here are accepted by Django and compressed when
+// Django would compress them.  It runs only if DJANGO_PYTHON is set.
+func TestDjangoLive(t *testing.T) {
+	var cases []djangoCase
+	djangoSigning(t, "dump", nil, &cases)
+	if len(cases) == 0 {
+		t.Fatalf("no cases")
+	}
+
+	encoded := make([]djangoCase, len(cases))
+	for i, c := range cases {
+		d, err := NewDecoder("django-live-secret", c.options()...)
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		decoded, err := d.Decode(c.Cookie)
+		if err != nil {
+			t.Errorf("Decode(%s, %s): %s", c.Serializer, c.Algorithm, err)
+		} else if !reflect.DeepEqual(c.Obj, decoded) {
+			t.Errorf("Decode(%s, %s): DeepEqual(%#v != %#v)", c.Serializer, c.Algorithm, c.Obj, decoded)
+		}
+
+		encoded[i] = c
+		if encoded[i].Cookie, err = d.Encode(c.Obj); err != nil {
+			t.Fatalf("Encode: %s", err)
+		}
+		if strings.HasPrefix(encoded[i].Cookie, ".") != strings.HasPrefix(c.Cookie, ".") {
+			t.Errorf("Encode(%s, compress %v): compression differs from Django: %s vs %s",
+				c.Serializer, c.Compress, encoded[i].Cookie, c.Cookie)
+		}
+	}
+
+	var objs []map[string]interface{}
+	djangoSigning(t, "loads", encoded, &objs)
+	for i, obj := range objs {
+		if !reflect.DeepEqual(cases[i].Obj, obj) {
+			t.Errorf("Django loads(%s): DeepEqual(%#v != %#v)", encoded[i].Cookie, cases[i].Obj, obj)
+		}
+	}
+}
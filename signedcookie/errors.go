@@ -0,0 +1,48 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors returned when a cookie can't be decoded.  The errors
+// returned by Decode wrap one of these, along with the underlying
+// cause, and can be distinguished with errors.Is.
+var (
+	// ErrSignatureMismatch means the cookie was not signed with the
+	// expected secret and salt, or has been tampered with.
+	ErrSignatureMismatch = errors.New("signedcookie: signature mismatch")
+	// ErrExpired means the cookie's signature is valid, but it was
+	// issued more than the maximum age ago.
+	ErrExpired = errors.New("signedcookie: expired timestamp")
+	// ErrMalformed means the cookie isn't structured like a value
+	// produced by django.core.signing.
+	ErrMalformed = errors.New("signedcookie: malformed cookie")
+	// ErrNoTimestamp means the cookie's signature is valid, but the
+	// value has no timestamp, as for values signed with a plain
+	// django.core.signing.Signer rather than a TimestampSigner.
+	// Such values can be verified with Signer.Unsign instead.
+	ErrNoTimestamp = errors.New("signedcookie: not a timestamp-signed value")
+)
+
+// An ExpiredError is returned by Decoders created WithExpiredError
+// for cookies whose signature is valid, but which have expired.  As
+// the session is still authentic, it is carried along, for uses such
+// as offering to log the same user back in; it must not be treated
+// as a current session.  ExpiredErrors wrap ErrExpired.
+type ExpiredError struct {
+	// Session is the expired cookie's session.
+	Session map[string]interface{}
+	// Issued is the time the cookie was signed at.
+	Issued time.Time
+
+	err error
+}
+
+func (e *ExpiredError) Error() string { return e.err.Error() }
+
+func (e *ExpiredError) Unwrap() error { return e.err }
@@ -0,0 +1,225 @@
+package signedcookie
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestErrors(t *testing.T) {
+	d := &decodeData[1]
+	tampered := "X" + d.cookie[1:]
+	cases := []struct {
+		name   string
+		now    func() time.Time
+		cookie string
+		err    error
+	}{
+		{"expired", testNowTimedOut, d.cookie, ErrExpired},
+		{"tampered", testNowOK, tampered, ErrSignatureMismatch},
+		{"no separator", testNowOK, "garbage", ErrMalformed},
+		{"no timestamp", testNowOK, string((&Signer{Secret: d.secret, Salt: SaltSession}).Sign([]byte("e30"))), ErrNoTimestamp},
+	}
+	for _, c := range cases {
+		_, err := testDecoder(d.kind, d.secret, WithClock(c.now)).Decode(c.cookie)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+// testSign returns a cookie containing payload, verbatim, signed with
+// secret as the signed_cookies SessionStore would.
+func testSign(secret string, payload []byte) string {
+	signer := TimestampSigner{Signer: Signer{Secret: secret, Salt: SaltSession, Algorithm: SHA1}}
+	return string(signer.SignAt(b64Encode(payload), testNowOK()))
+}
+
+func TestMalformedJSON(t *testing.T) {
+	secret := decodeData[1].secret
+	d := testDecoder(JSON, secret)
+	for _, payload := range []string{`{"_auth_user_id":`, `[1334]`, `{"a":1}garbage`, `null`, ` null `} {
+		cookie := testSign(secret, []byte(payload))
+		decoded, err := d.Decode(cookie)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("'%s': expected ErrMalformed, got %v (%#v)", payload, err, decoded)
+		}
+		if decoded, err = d.DecodeReader(strings.NewReader(cookie)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("DecodeReader('%s'): expected ErrMalformed, got %v (%#v)", payload, err, decoded)
+		}
+		if err = d.DecodeReuse(cookie, map[string]interface{}{}); !errors.Is(err, ErrMalformed) {
+			t.Errorf("DecodeReuse('%s'): expected ErrMalformed, got %v", payload, err)
+		}
+	}
+}
+
+func TestInvalidUTF8JSON(t *testing.T) {
+	secret := decodeData[1].secret
+	d := testDecoder(JSON, secret)
+	for _, payload := range []string{"{\"a\":\"\xff\"}", "{\"\xc3\":1}", "{\"a\":\"caf\xc3\"}"} {
+		cookie := testSign(secret, []byte(payload))
+		if decoded, err := d.Decode(cookie); !errors.Is(err, ErrMalformed) || decoded != nil {
+			t.Errorf("Decode(%q): expected ErrMalformed, got %v (%#v)", payload, err, decoded)
+		}
+		if _, err := d.DecodeReader(strings.NewReader(cookie)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("DecodeReader(%q): expected ErrMalformed, got %v", payload, err)
+		}
+		if _, err := d.DecodeValue(cookie); !errors.Is(err, ErrMalformed) {
+			t.Errorf("DecodeValue(%q): expected ErrMalformed, got %v", payload, err)
+		}
+		var v map[string]string
+		if err := d.DecodeInto(cookie, &v); !errors.Is(err, ErrMalformed) {
+			t.Errorf("DecodeInto(%q): expected ErrMalformed, got %v", payload, err)
+		}
+	}
+
+	// valid UTF-8 is still accepted, even split across reads.
+	payload := "{\"name\":\"Zo\u00eb \u65e5\u672c \U0001f600\"}"
+	decoded, err := d.DecodeReader(strings.NewReader(testSign(secret, []byte(payload))))
+	if err != nil || decoded["name"] != "Zo\u00eb \u65e5\u672c \U0001f600" {
+		t.Errorf("DecodeReader: %#v, %v", decoded, err)
+	}
+	for _, c := range []struct {
+		in    string
+		valid bool
+	}{
+		{"Zo\u00eb \u65e5\u672c \U0001f600", true},
+		{"", true},
+		{"ab\xff", false},
+		{"ab\xe6\x97", false},
+		{"\xe6\x97a", false},
+	} {
+		_, err := ioutil.ReadAll(&utf8Reader{r: iotest.OneByteReader(strings.NewReader(c.in))})
+		if (err == nil) != c.valid {
+			t.Errorf("utf8Reader(%q): %v", c.in, err)
+		}
+	}
+}
+
+func TestEmptyPayload(t *testing.T) {
+	secret := decodeData[1].secret
+	cookie := testSign(secret, nil)
+	if _, err := testDecoder(JSON, secret).Decode(cookie); !errors.Is(err, ErrMalformed) {
+		t.Errorf("'%s': expected ErrMalformed, got %v", cookie, err)
+	}
+}
+
+func TestCompressionPrefixOnly(t *testing.T) {
+	secret := decodeData[1].secret
+	signer := TimestampSigner{Signer: Signer{Secret: secret, Salt: SaltSession, Algorithm: SHA1}}
+	cookie := string(signer.SignAt([]byte("."), testNowOK()))
+	d := testDecoder(JSON, secret)
+	_, err := d.Decode(cookie)
+	if !errors.Is(err, ErrMalformed) || !strings.Contains(err.Error(), "after the '.' compression prefix") {
+		t.Errorf("Decode('%s'): expected ErrMalformed, got %v", cookie, err)
+	}
+	if _, err = d.DecodeReader(strings.NewReader(cookie)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("DecodeReader('%s'): expected ErrMalformed, got %v", cookie, err)
+	}
+	if _, tr, err := d.DecodeAndExplain(cookie); !errors.Is(err, ErrMalformed) || !tr.Compressed {
+		t.Errorf("DecodeAndExplain('%s'): expected ErrMalformed, got %v", cookie, err)
+	}
+}
+
+// testSignCompressed is like testSign, but zlib compresses payload
+// first, as signing.dumps does with compress=True.
+func testSignCompressed(secret string, payload []byte) string {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(payload)
+	w.Close()
+	encoded := append([]byte{'.'}, b64Encode(buf.Bytes())...)
+	signer := TimestampSigner{Signer: Signer{Secret: secret, Salt: SaltSession, Algorithm: SHA1}}
+	return string(signer.SignAt(encoded, testNowOK()))
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	const limit = 4096
+	secret := decodeData[1].secret
+	d := testDecoder(JSON, secret, WithMaxDecompressedSize(limit))
+	// {"a":"xxx..."} is 8 bytes of framing around the string.
+	fits := fmt.Sprintf(`{"a":"%s"}`, strings.Repeat("x", limit-8))
+	if _, err := d.Decode(testSignCompressed(secret, []byte(fits))); err != nil {
+		t.Errorf("payload of exactly %d bytes: %s", limit, err)
+	}
+	bomb := fmt.Sprintf(`{"a":"%s"}`, strings.Repeat("x", limit-7))
+	cookie := testSignCompressed(secret, []byte(bomb))
+	if len(cookie) >= limit/10 {
+		t.Fatalf("test payload isn't very compressible (%d bytes)", len(cookie))
+	}
+	if _, err := d.Decode(cookie); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+	if _, err := NewDecoder(secret, WithMaxDecompressedSize(0)); err == nil {
+		t.Errorf("NewDecoder accepted a zero max decompressed size")
+	}
+}
+
+func TestMaxCookieLength(t *testing.T) {
+	secret := decodeData[1].secret
+	// an uncompressed payload, so the cookie's length is easy to
+	// control.
+	long := testSign(secret, []byte(fmt.Sprintf(`{"a":"%s"}`, strings.Repeat("x", DefaultMaxCookieLength))))
+	if len(long) <= DefaultMaxCookieLength {
+		t.Fatalf("test cookie is only %d bytes", len(long))
+	}
+	d := testDecoder(JSON, secret)
+	if _, err := d.Decode(long); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Decode: expected ErrMalformed, got %v", err)
+	}
+	if _, err := d.DecodeReader(strings.NewReader(long)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("DecodeReader: expected ErrMalformed, got %v", err)
+	}
+	if _, err := d.Rotate(long); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Rotate: expected ErrMalformed, got %v", err)
+	}
+	untimestamped := string((&Signer{Secret: secret, Salt: SaltSession, Algorithm: SHA1}).Sign(b64Encode([]byte(`"` + strings.Repeat("x", DefaultMaxCookieLength) + `"`))))
+	if _, err := d.DecodeNoTimestamp(untimestamped); !errors.Is(err, ErrMalformed) {
+		t.Errorf("DecodeNoTimestamp: expected ErrMalformed, got %v", err)
+	}
+	if _, err := testDecoder(JSON, secret, WithMaxCookieLength(len(untimestamped))).DecodeNoTimestamp(untimestamped); err != nil {
+		t.Errorf("DecodeNoTimestamp with a higher limit: %s", err)
+	}
+	if _, trace, err := d.DecodeAndExplain(long); !errors.Is(err, ErrMalformed) || len(trace.Stages) != 1 {
+		t.Errorf("DecodeAndExplain: expected ErrMalformed, got %v\n%s", err, trace)
+	}
+	if _, err := testDecoder(JSON, secret, WithMaxCookieLength(len(long))).Decode(long); err != nil {
+		t.Errorf("Decode with a higher limit: %s", err)
+	}
+
+	short := testSign(secret, []byte(`{"a":1}`))
+	if _, err := testDecoder(JSON, secret, WithMaxCookieLength(len(short)-1)).Decode(short); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for a lower limit, got %v", err)
+	}
+	if _, err := NewDecoder(secret, WithMaxCookieLength(0)); err == nil {
+		t.Errorf("NewDecoder accepted a zero max cookie length")
+	}
+}
+
+func TestCompressionPrefixMismatch(t *testing.T) {
+	secret := decodeData[1].secret
+	d := testDecoder(JSON, secret)
+	signer := TimestampSigner{Signer: Signer{Secret: secret, Salt: SaltSession, Algorithm: SHA1}}
+
+	// claims to be compressed, but isn't.
+	encoded := append([]byte{'.'}, b64Encode([]byte(`{"a":1}`))...)
+	cookie := string(signer.SignAt(encoded, testNowOK()))
+	_, err := d.Decode(cookie)
+	if !errors.Is(err, ErrMalformed) || !strings.Contains(err.Error(), "compression prefix, but isn't zlib") {
+		t.Errorf("compressed prefix on plain payload: got %v", err)
+	}
+
+	// compressed, but missing the prefix.
+	compressed := testSignCompressed(secret, []byte(`{"a":1}`))
+	encoded = []byte(compressed[1:strings.IndexByte(compressed, ':')])
+	_, err = d.Decode(string(signer.SignAt(encoded, testNowOK())))
+	if !strings.Contains(err.Error(), "lacks the '.' compression prefix") {
+		t.Errorf("compressed payload without prefix: got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultCookieName is the name of the cookie Django stores the
+// session in, unless SESSION_COOKIE_NAME is set.
+const DefaultCookieName = "sessionid"
+
+// contextKey is a value for use with context.WithValue.  It's used as
+// a pointer so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "signedcookie context value " + k.name }
+
+// SessionContextKey is the context key Middleware stores the decoded
+// session under.  The associated value is of type
+// map[string]interface{}.
+var SessionContextKey = &contextKey{"session"}
+
+// Middleware returns HTTP middleware that decodes the cookie named
+// cookieName with d, and makes the resulting session available to
+// the wrapped handler through SessionFromContext.  Requests without
+// the cookie, or with one that fails to decode, are passed through
+// without a session, so anonymous requests are still served.  If
+// more names are given, the first cookie that decodes is used, as
+// for DecodeRequest.
+func Middleware(d *Decoder, cookieName string, more ...string) func(http.Handler) http.Handler {
+	names := append([]string{cookieName}, more...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := d.decodeRequest(r, names)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := context.WithValue(r.Context(), SessionContextKey, session)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// SessionFromContext returns the session stored in ctx by Middleware,
+// and whether there was one.
+func SessionFromContext(ctx context.Context) (map[string]interface{}, bool) {
+	session, ok := ctx.Value(SessionContextKey).(map[string]interface{})
+	return session, ok
+}
+
+// DecodeRequest decodes the session cookie sent with r, which is
+// named DefaultCookieName unless the Decoder was configured
+// otherwise with WithCookieName.  If r has no session cookie, the
+// returned error satisfies errors.Is(err, http.ErrNoCookie), so that
+// anonymous requests can be told apart from invalid sessions.
+//
+// A request can carry several cookies with the same name, such as
+// one set for a parent domain with SESSION_COOKIE_DOMAIN and one for
+// a subdomain, and with several names configured, several names.
+// These are tried in order of the configured names, and for each name
+// in the order sent, and the first that decodes is returned; if none
+// do, the first one's error is.
+func (d *Decoder) DecodeRequest(r *http.Request) (map[string]interface{}, error) {
+	return d.decodeRequest(r, d.cookieNames)
+}
+
+func (d *Decoder) decodeRequest(r *http.Request, names []string) (map[string]interface{}, error) {
+	cookies := r.Cookies()
+	var firstErr error
+	for _, name := range names {
+		for _, c := range cookies {
+			if c.Name != name {
+				continue
+			}
+			session, err := d.Decode(c.Value)
+			if err == nil {
+				return session, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, fmt.Errorf("%s: %w", strings.Join(names, ", "), http.ErrNoCookie)
+}
+
+// checkCookieValue returns an error if v contains a byte that isn't a
+// cookie-octet, as defined by RFC 6265 section 4.1.1, so that it
+// can't be set as a cookie's value unquoted.  Payloads, timestamps
+// and signatures only use characters that are cookie-octets, but a
+// custom separator may not be.
+func checkCookieValue(v string) error {
+	for i := 0; i < len(v); i++ {
+		if !isCookieOctet(v[i]) {
+			return fmt.Errorf("invalid cookie value: %q at offset %d is not a cookie-octet (RFC 6265)", v[i], i)
+		}
+	}
+	return nil
+}
+
+// isCookieOctet reports whether c is a US-ASCII character other than
+// a control, whitespace, double quote, comma, semicolon or backslash.
+func isCookieOctet(c byte) bool {
+	return c >= 0x21 && c <= 0x7e && c != '"' && c != ',' && c != ';' && c != '\\'
+}
@@ -0,0 +1,157 @@
+package signedcookie
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	d, err := NewDecoder(sha256Data.secret, WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	var session map[string]interface{}
+	var ok bool
+	handler := Middleware(d, "sessionid")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok = SessionFromContext(r.Context())
+	}))
+
+	cases := []struct {
+		cookie *http.Cookie
+		ok     bool
+	}{
+		{&http.Cookie{Name: "sessionid", Value: sha256Data.cookie}, true},
+		{&http.Cookie{Name: "sessionid", Value: "garbage"}, false},
+		{&http.Cookie{Name: "othercookie", Value: sha256Data.cookie}, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		session, ok = nil, false
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.cookie != nil {
+			r.AddCookie(c.cookie)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if ok != c.ok {
+			t.Errorf("%v: expected session %v, got %v", c.cookie, c.ok, ok)
+		}
+		if c.ok && !reflect.DeepEqual(sha256Data.decoded, session) {
+			t.Errorf("DeepEqual(%#v != %#v)", sha256Data.decoded, session)
+		}
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	d, err := NewDecoder(sha256Data.secret, WithCookieName("mysession"), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: sha256Data.cookie})
+	if _, err = d.DecodeRequest(r); !errors.Is(err, http.ErrNoCookie) {
+		t.Errorf("expected http.ErrNoCookie, got %v", err)
+	}
+	r.AddCookie(&http.Cookie{Name: "mysession", Value: sha256Data.cookie})
+	session, err := d.DecodeRequest(r)
+	if err != nil {
+		t.Fatalf("DecodeRequest: %s", err)
+	}
+	if !reflect.DeepEqual(sha256Data.decoded, session) {
+		t.Errorf("DeepEqual(%#v != %#v)", sha256Data.decoded, session)
+	}
+}
+
+func TestDecodeRequestNames(t *testing.T) {
+	d, err := NewDecoder(sha256Data.secret, WithCookieName("newsession", "sessionid"), WithClock(testNowOK))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	cases := []struct {
+		name    string
+		cookies []*http.Cookie
+		ok      bool
+	}{
+		{"old name", []*http.Cookie{{Name: "sessionid", Value: sha256Data.cookie}}, true},
+		{"new name", []*http.Cookie{{Name: "newsession", Value: sha256Data.cookie}}, true},
+		{"stale new name", []*http.Cookie{{Name: "newsession", Value: "garbage"}, {Name: "sessionid", Value: sha256Data.cookie}}, true},
+		// as sent for a subdomain and its parent domain
+		{"same name twice", []*http.Cookie{{Name: "sessionid", Value: "garbage"}, {Name: "sessionid", Value: sha256Data.cookie}}, true},
+		{"none decode", []*http.Cookie{{Name: "newsession", Value: "garbage"}, {Name: "sessionid", Value: "garbage"}}, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, cookie := range c.cookies {
+			r.AddCookie(cookie)
+		}
+		session, err := d.DecodeRequest(r)
+		if c.ok && (err != nil || !reflect.DeepEqual(sha256Data.decoded, session)) {
+			t.Errorf("%s: %#v, %v", c.name, session, err)
+		}
+		if !c.ok && (err == nil || errors.Is(err, http.ErrNoCookie)) {
+			t.Errorf("%s: expected a decode error, got %v", c.name, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "othercookie", Value: sha256Data.cookie})
+	if _, err = d.DecodeRequest(r); !errors.Is(err, http.ErrNoCookie) {
+		t.Errorf("expected http.ErrNoCookie, got %v", err)
+	}
+
+	var ok bool
+	handler := Middleware(d, "newsession", "sessionid")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok = SessionFromContext(r.Context())
+	}))
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessionid", Value: sha256Data.cookie})
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if !ok {
+		t.Errorf("Middleware: no session for the second name")
+	}
+}
+
+func TestCheckCookieValue(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		ok    bool
+	}{
+		{"eyJhIjoxfQ:1XeDSa:sig-_=", true},
+		{"!#$%&'()*+-./:<=>?@[]^`{|}~", true},
+		{"", true},
+		{"a b", false},
+		{`a"b`, false},
+		{"a,b", false},
+		{"a;b", false},
+		{`a\b`, false},
+		{"a\x7fb", false},
+		{"a\xc3\xa9", false},
+	} {
+		if err := checkCookieValue(c.value); (err == nil) != c.ok {
+			t.Errorf("checkCookieValue(%q): %v, expected ok %v", c.value, err, c.ok)
+		}
+	}
+}
+
+func TestEncodeSeparator(t *testing.T) {
+	obj := map[string]interface{}{"a": 1.0}
+	for _, c := range []struct {
+		sep string
+		ok  bool
+	}{
+		{":", true},
+		{"/", true},
+		{",", false},
+		{"; ", false},
+	} {
+		d, err := NewDecoder("secret", WithSeparator(c.sep))
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		if _, err = d.Encode(obj); (err == nil) != c.ok {
+			t.Errorf("Encode with separator %q: %v, expected ok %v", c.sep, err, c.ok)
+		}
+	}
+}
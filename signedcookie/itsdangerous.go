@@ -0,0 +1,137 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Scheme represents the library a cookie was signed by.  The
+// itsdangerous library, used by Flask, signs values much like
+// django.core.signing, but derives its keys and encodes timestamps
+// differently.
+type Scheme int
+
+const (
+	// Django signs as django.core.signing does.  This is the default.
+	Django Scheme = iota
+	// ItsDangerous signs as itsdangerous's URLSafeTimedSerializer
+	// does with its default key derivation, "django-concat".
+	ItsDangerous
+	// Flask signs as Flask's default SecureCookieSessionInterface,
+	// an itsdangerous URLSafeTimedSerializer that derives its key
+	// with HMAC.
+	Flask
+)
+
+// String returns the scheme's name, such as "Django" or "Flask".
+func (s Scheme) String() string {
+	switch s {
+	case Django:
+		return "Django"
+	case ItsDangerous:
+		return "ItsDangerous"
+	case Flask:
+		return "Flask"
+	}
+	return fmt.Sprintf("Scheme(%d)", int(s))
+}
+
+// the salts itsdangerous's URLSafeTimedSerializer and Flask's session
+// interface sign with by default.
+const (
+	itsDangerousSalt = "itsdangerous"
+	flaskSessionSalt = "cookie-session"
+)
+
+// WithScheme sets the library cookies are signed by, along with that
+// library's default salt, separator and algorithm: for ItsDangerous
+// and Flask, the salt "itsdangerous" or "cookie-session", the
+// separator "." and SHA1.  Options following WithScheme override
+// these defaults, so WithScheme should come first.  The default is
+// Django.
+//
+// Flask sessions are serialized with a tagged JSON serializer, which
+// represents values such as tuples, bytes and datetimes as objects
+// with a single key like " t".  These are decoded as plain JSON
+// objects, and are left to the caller to interpret.
+func WithScheme(s Scheme) Option {
+	return func(d *Decoder) error {
+		switch s {
+		case Django:
+			d.signer.Salt = SaltSession
+			d.signer.sep = nil
+			d.signer.Algorithm = SHA256
+		case ItsDangerous, Flask:
+			d.signer.Salt = itsDangerousSalt
+			if s == Flask {
+				d.signer.Salt = flaskSessionSalt
+			}
+			d.signer.sep = []byte(".")
+			d.signer.Algorithm = SHA1
+		default:
+			return fmt.Errorf("unknown scheme: %d", s)
+		}
+		d.signer.hashFunc = nil
+		d.signer.scheme = s
+		d.serializer = JSON
+		return nil
+	}
+}
+
+// hmacKey returns the HMAC key for secret the way itsdangerous's
+// "hmac" key derivation does: the HMAC of salt keyed by secret.
+func (s *Signer) hmacKey(salt, secret string) []byte {
+	mac := hmac.New(s.hash(), []byte(secret))
+	mac.Write([]byte(salt))
+	return mac.Sum(nil)
+}
+
+// encodeTimestamp returns t in the form the scheme's timestamp
+// signer appends it to values: base62 for Django, and for
+// itsdangerous, the unpadded base64 of its big-endian bytes with
+// leading zeros removed.
+func (s *Signer) encodeTimestamp(t time.Time) []byte {
+	if s.scheme == Django {
+		return b62Encode(t.Unix())
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.Unix()))
+	i := 0
+	for i < len(b) && b[i] == 0 {
+		i++
+	}
+	return b64Encode(b[i:])
+}
+
+// decodeTimestamp is the inverse of encodeTimestamp.
+func (s *Signer) decodeTimestamp(stamp []byte) (time.Time, error) {
+	if s.scheme == Django {
+		n, err := b62Decode(stamp)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("b62Decode: %w", err)
+		}
+		return time.Unix(n, 0), nil
+	}
+	b, err := b64Decode(stamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("b64Decode: %w", err)
+	}
+	if len(b) > 8 {
+		return time.Time{}, fmt.Errorf("timestamp too long: %d bytes", len(b))
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	if n > math.MaxInt64 {
+		return time.Time{}, fmt.Errorf("timestamp overflows int64")
+	}
+	return time.Unix(int64(n), 0), nil
+}
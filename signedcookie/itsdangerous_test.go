@@ -0,0 +1,130 @@
+package signedcookie
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// generated following itsdangerous 2's URLSafeTimedSerializer,
+// signed at 2014-10-14 00:00 UTC.
+var itsDangerousData = []struct {
+	scheme  Scheme
+	secret  string
+	salt    string
+	cookie  string
+	decoded interface{}
+}{
+	{
+		Flask, "flask-secret", "",
+		"eyJfZnJlc2giOnRydWUsIl91c2VyX2lkIjoiNDIiLCJjc3JmX3Rva2VuIjoiYWJjIn0.VDxngA.slwI7bVrdOZxkFjfUjlT3i0Cc38",
+		map[string]interface{}{"_fresh": true, "_user_id": "42", "csrf_token": "abc"},
+	},
+	{
+		ItsDangerous, "its-secret", "",
+		".eJyrViotTi1SslJKJBIo1QIA3dASog.VDxngA.9oBfzZNVzQYOhWb_XtBImHXSAFg",
+		map[string]interface{}{"user": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	},
+	{
+		ItsDangerous, "its-secret", "activate",
+		"WzEsMl0.VDxngA.8tSVQ5pxKuYI12Aw_P_r5a1YSpA",
+		[]interface{}{1.0, 2.0},
+	},
+}
+
+func TestScheme(t *testing.T) {
+	for _, data := range itsDangerousData {
+		opts := []Option{WithScheme(data.scheme), WithClock(testNowOK)}
+		if data.salt != "" {
+			opts = append(opts, WithSalt(data.salt))
+		}
+		d, err := NewDecoder(data.secret, opts...)
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		decoded, err := d.DecodeValue(data.cookie)
+		if err != nil {
+			t.Errorf("DecodeValue(%s): %s", data.scheme, err)
+			continue
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+		_, issued, err := d.loadPayload(data.cookie)
+		if want := time.Unix(1413244800, 0); err != nil || !issued.Equal(want) {
+			t.Errorf("loadPayload: %s != %s (%v)", issued, want, err)
+		}
+
+		// the same secret must not verify under Django's scheme.
+		django, err := NewDecoder(data.secret, WithSeparator("."), WithAlgorithm(SHA1), WithClock(testNowOK))
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		if err := django.Verify(data.cookie); err == nil {
+			t.Errorf("Verify: Django Decoder accepted %s cookie", data.scheme)
+		}
+	}
+}
+
+func TestSchemeRoundTrip(t *testing.T) {
+	obj := map[string]interface{}{"_user_id": "42", "padding": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}
+	for _, scheme := range []Scheme{Django, ItsDangerous, Flask} {
+		d, err := NewDecoder("secret", WithScheme(scheme))
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		cookie, err := d.Encode(obj)
+		if err != nil {
+			t.Fatalf("Encode(%s): %s", scheme, err)
+		}
+		decoded, err := d.Decode(cookie)
+		if err != nil {
+			t.Fatalf("Decode(%s): %s", scheme, err)
+		}
+		if !reflect.DeepEqual(obj, decoded) {
+			t.Errorf("%s: DeepEqual(%#v != %#v)", scheme, obj, decoded)
+		}
+	}
+}
+
+func TestSchemeFuture(t *testing.T) {
+	data := itsDangerousData[0]
+	past := func() time.Time { return time.Unix(1413244800-60, 0) }
+	d, err := NewDecoder(data.secret, WithScheme(data.scheme), WithClock(past))
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err := d.Decode(data.cookie); !errors.Is(err, ErrExpired) {
+		t.Errorf("Decode: expected ErrExpired for a timestamp in the future, got %v", err)
+	}
+}
+
+func TestSchemeInvalid(t *testing.T) {
+	if _, err := NewDecoder("secret", WithScheme(Scheme(42))); err == nil {
+		t.Errorf("NewDecoder: expected error for unknown scheme")
+	}
+	if s := Scheme(42).String(); s != "Scheme(42)" {
+		t.Errorf("String: %q", s)
+	}
+}
+
+func TestSchemeTimestamps(t *testing.T) {
+	s := &Signer{scheme: ItsDangerous}
+	for _, n := range []int64{0, 1, 255, 256, 1413244800, 1<<63 - 1} {
+		ts := time.Unix(n, 0)
+		got, err := s.decodeTimestamp(s.encodeTimestamp(ts))
+		if err != nil {
+			t.Errorf("decodeTimestamp(%d): %s", n, err)
+			continue
+		}
+		if !got.Equal(ts) {
+			t.Errorf("decodeTimestamp: %d != %d", got.Unix(), n)
+		}
+	}
+	for _, stamp := range []string{"gAAAAAAAAAA", "AQIDBAUGBwgJ", "!"} {
+		if _, err := s.decodeTimestamp([]byte(stamp)); err == nil {
+			t.Errorf("decodeTimestamp(%q): expected error", stamp)
+		}
+	}
+}
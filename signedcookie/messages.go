@@ -0,0 +1,166 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// django.core.signing.get_cookie_signer prefixes SECRET_KEY with this
+// before using it to sign cookies.
+const cookieSignerPrefix = "django.http.cookies"
+
+// markers used by the messages framework's MessageEncoder.
+const (
+	messageKey  = "__json_message__"
+	notFinished = "__messagesnotfinished__"
+)
+
+// Message is a single message stored by the messages framework, see
+// django.contrib.messages.storage.base.Message.
+type Message struct {
+	Level     int
+	Message   string
+	ExtraTags string
+	// Safe is set if the message was marked as safe for HTML
+	// output with django.utils.safestring.mark_safe.
+	Safe bool
+}
+
+// DecodeMessages returns the messages stored in cookie by the messages
+// framework's CookieStorage, or an error if the cookie could not be
+// decoded or if signature validation failed.  The compressed format
+// used by Django 4.1 and later, the raw JSON format used before that,
+// and the "hash$json" format of releases prior to Django 3.1 are all
+// supported.
+//
+// Cookie values quoted by Python's http.cookies module, which happens
+// to the raw JSON formats, are unquoted before decoding.
+func DecodeMessages(secret, cookie string) ([]Message, error) {
+	value := unquoteCookie([]byte(cookie))
+	if i := bytes.IndexByte(value, '$'); i == 40 && !bytes.HasPrefix(value, []byte{'['}) {
+		return decodeLegacyMessages(secret, value[:i], value[i+1:])
+	}
+	signer := Signer{Secret: cookieSignerPrefix + secret, Salt: SaltMessages, Algorithm: SHA256}
+	payload, err := signer.Unsign(value)
+	if errors.Is(err, ErrSignatureMismatch) {
+		signer.Algorithm = SHA1
+		payload, err = signer.Unsign(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unsign: %w", err)
+	}
+	// before Django 4.1, the JSON was signed as-is.
+	if !bytes.HasPrefix(payload, []byte{'['}) {
+		if payload, err = decodePayload(payload, Zlib, DefaultMaxDecompressedSize); err != nil {
+			return nil, err
+		}
+	}
+	return parseMessages(payload)
+}
+
+// decodeLegacyMessages verifies the SHA1 hex digest that prefixed
+// messages before CookieStorage used django.core.signing.
+func decodeLegacyMessages(secret string, hash, value []byte) ([]Message, error) {
+	expected := hex.EncodeToString(saltedHMAC(SHA1, SaltMessages, value, secret))
+	if subtle.ConstantTimeCompare(hash, []byte(expected)) != 1 {
+		return nil, ErrSignatureMismatch
+	}
+	return parseMessages(value)
+}
+
+// parseMessages converts the JSON produced by MessageEncoder into
+// Messages.  Each message is encoded as a list of the message key, a
+// safe-string flag, the level, the message, and optionally its extra
+// tags.
+func parseMessages(payload []byte) ([]Message, error) {
+	var encoded []json.RawMessage
+	if err := jsonUnmarshal(payload, &encoded); err != nil {
+		return nil, err
+	}
+	messages := make([]Message, 0, len(encoded))
+	for _, raw := range encoded {
+		var fields []interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			// the only non-list element CookieStorage writes
+			// is the marker for messages that didn't fit.
+			var marker string
+			if json.Unmarshal(raw, &marker) == nil && marker == notFinished {
+				continue
+			}
+			return nil, fmt.Errorf("%w: unexpected message %s", ErrMalformed, raw)
+		}
+		m, err := parseMessage(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrMalformed, raw, err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+func parseMessage(fields []interface{}) (Message, error) {
+	var m Message
+	if len(fields) < 4 || len(fields) > 5 || fields[0] != messageKey {
+		return m, fmt.Errorf("not an encoded message")
+	}
+	safe, ok1 := fields[1].(float64)
+	level, ok2 := fields[2].(float64)
+	msg, ok3 := fields[3].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return m, fmt.Errorf("unexpected field types")
+	}
+	m.Safe = safe != 0
+	m.Level = int(level)
+	m.Message = msg
+	if len(fields) == 5 && fields[4] != nil {
+		tags, ok := fields[4].(string)
+		if !ok {
+			return m, fmt.Errorf("unexpected extra_tags type")
+		}
+		m.ExtraTags = tags
+	}
+	return m, nil
+}
+
+// unquoteCookie reverses the quoting Python's http.cookies module
+// applies to values containing characters that aren't legal in a
+// cookie: the value is wrapped in double quotes, and special
+// characters are backslash-escaped, either literally or as a
+// three-digit octal sequence.  Unquoted values are returned as-is.
+func unquoteCookie(b []byte) []byte {
+	if len(b) < 2 || b[0] != '"' || b[len(b)-1] != '"' {
+		return b
+	}
+	b = b[1 : len(b)-1]
+	if bytes.IndexByte(b, '\\') == -1 {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c != '\\' || i+1 == len(b) {
+			out = append(out, c)
+			continue
+		}
+		if i+3 < len(b) && isOctal(b[i+1], '3') && isOctal(b[i+2], '7') && isOctal(b[i+3], '7') {
+			out = append(out, (b[i+1]-'0')<<6|(b[i+2]-'0')<<3|(b[i+3]-'0'))
+			i += 3
+			continue
+		}
+		out = append(out, b[i+1])
+		i++
+	}
+	return out
+}
+
+func isOctal(c, max byte) bool {
+	return c >= '0' && c <= max
+}
@@ -0,0 +1,70 @@
+package signedcookie
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var messagesSecret = "70e97f01975bb59ae8804ca164081c46034042aa913a4dac055cad6a7e188bd1"
+
+var messagesData = []struct {
+	cookie   string
+	messages []Message
+}{
+	// Django 4.2
+	{
+		".eJx1zUsOwjAMBNCrBK8tKBXsqp6hOxZVZCWtGwXykWKKxO3rA8B6Zt7MMxA9pRbKLOICEwF22N8Rpla3mNiI-_B6Bou_qle8dQiDHyf3zVzeZnO6WYeLHwHBx5RiCWZvQbM_hL4p8eC01MzGu-WFZhduJwXA2gM2TzUk:0-NFDlqZcdxroFHV3icU-Aylkn7uV1mPd1j0uPo1Bzc",
+		[]Message{
+			{Level: 25, Message: "Profile saved."},
+			{Level: 40, Message: "<b>Payment failed</b>", ExtraTags: "billing urgent", Safe: true},
+			{Level: 20, Message: "Welcome back, user!"},
+		},
+	},
+	// Django 3.0, quoted by http.cookies, with messages that didn't fit
+	{
+		`"[[\"__json_message__\"\0540\05425\054\"Profile saved.\"]\054[\"__json_message__\"\0541\05440\054\"<b>Payment failed</b>\"\054\"billing urgent\"]\054\"__messagesnotfinished__\"]:DPSV5QCu21G79j-Np8QdztmGIpw"`,
+		[]Message{
+			{Level: 25, Message: "Profile saved."},
+			{Level: 40, Message: "<b>Payment failed</b>", ExtraTags: "billing urgent", Safe: true},
+		},
+	},
+	// Django 2.2
+	{
+		`"3191df852335a37b2666aa23c0875052578ad0db$[[\"__json_message__\"\0540\05425\054\"Profile saved.\"]]"`,
+		[]Message{
+			{Level: 25, Message: "Profile saved."},
+		},
+	},
+}
+
+func TestDecodeMessages(t *testing.T) {
+	for _, d := range messagesData {
+		messages, err := DecodeMessages(messagesSecret, d.cookie)
+		if err != nil {
+			t.Errorf("DecodeMessages('%s'): %s", d.cookie, err)
+			continue
+		}
+		if !reflect.DeepEqual(d.messages, messages) {
+			t.Errorf("DeepEqual(%#v != %#v)", d.messages, messages)
+		}
+		if _, err = DecodeMessages("wrong", d.cookie); !errors.Is(err, ErrSignatureMismatch) {
+			t.Errorf("expected ErrSignatureMismatch, got %v", err)
+		}
+	}
+}
+
+func TestUnquoteCookie(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{`abc`, `abc`},
+		{`"abc"`, `abc`},
+		{`"`, `"`},
+		{`"a\"b\\c\054d"`, `a"b\c,d`},
+		{`"trailing\"`, `trailing\`},
+	}
+	for _, c := range cases {
+		if out := string(unquoteCookie([]byte(c.in))); out != c.out {
+			t.Errorf("unquoteCookie(%s): %s != %s", c.in, out, c.out)
+		}
+	}
+}
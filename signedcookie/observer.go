@@ -0,0 +1,99 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An Outcome classifies the result of decoding a cookie.
+type Outcome int
+
+const (
+	// OutcomeSuccess means the cookie was decoded.
+	OutcomeSuccess Outcome = iota
+	// OutcomeExpired means the cookie's signature is valid, but
+	// it has expired.
+	OutcomeExpired
+	// OutcomeTampered means the cookie's signature doesn't match,
+	// as for cookies that were tampered with or signed with a
+	// different secret.
+	OutcomeTampered
+	// OutcomeMalformed means the cookie or its payload isn't
+	// structured like a signed cookie.
+	OutcomeMalformed
+	// OutcomeError means the cookie couldn't be decoded for another
+	// reason, such as an error from a secret func.
+	OutcomeError
+)
+
+var outcomeNames = [...]string{"success", "expired", "tampered", "malformed", "error"}
+
+// String returns the outcome's name, such as "expired".
+func (o Outcome) String() string {
+	if o < 0 || int(o) >= len(outcomeNames) {
+		return fmt.Sprintf("Outcome(%d)", int(o))
+	}
+	return outcomeNames[o]
+}
+
+// A DecodeResult describes one call to Decode, for the observer set
+// WithObserver.  It is passed by value, and holds nothing of the
+// decoded session, so observers can't change what Decode returns.
+type DecodeResult struct {
+	Outcome Outcome
+	// Stage is the stage that failed, or StageDeserialize if the
+	// cookie was decoded.
+	Stage Stage
+	// Err is the error Decode returned, if any.  For an
+	// *ExpiredError, it is a copy without the Session.
+	Err error
+	// Elapsed is how long Decode took.
+	Elapsed time.Duration
+}
+
+// outcome classifies err, returned by the given stage.
+func outcome(stage Stage, err error) Outcome {
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return OutcomeError
+	case errors.Is(err, ErrExpired):
+		return OutcomeExpired
+	case errors.Is(err, ErrSignatureMismatch):
+		return OutcomeTampered
+	case errors.Is(err, ErrMalformed), errors.Is(err, ErrNoTimestamp), stage > StageTimestamp:
+		return OutcomeMalformed
+	default:
+		return OutcomeError
+	}
+}
+
+// observedDecode is DecodeBytes for Decoders with an observer.
+func (d *Decoder) observedDecode(cookie []byte) (map[string]interface{}, error) {
+	start := time.Now()
+	o, _, stage, err := d.signingLoadsStage(cookie)
+	d.observe(start, stage, err)
+	return o, err
+}
+
+// observe reports a decode started at start, which ended at stage
+// with err, to the Decoder's observer.
+func (d *Decoder) observe(start time.Time, stage Stage, err error) {
+	// the Session is the one returned to the caller.
+	if e, ok := err.(*ExpiredError); ok {
+		err = &ExpiredError{Issued: e.Issued, err: e.err}
+	}
+	d.observer(DecodeResult{
+		Outcome: outcome(stage, err),
+		Stage:   stage,
+		Err:     err,
+		Elapsed: time.Since(start),
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderObserver(t *testing.T) {
+	var results []DecodeResult
+	observe := WithObserver(func(r DecodeResult) { results = append(results, r) })
+
+	data := &decodeData[1]
+	signed := func(payload string) string {
+		s := &TimestampSigner{Signer: Signer{Secret: data.secret, Salt: SaltSession, Algorithm: SHA1}}
+		return string(s.SignAt([]byte(payload), testNowOK()))
+	}
+	cases := []struct {
+		name    string
+		d       *Decoder
+		cookie  string
+		outcome Outcome
+		stage   Stage
+	}{
+		{"ok", testDecoder(data.kind, data.secret, observe), data.cookie, OutcomeSuccess, StageDeserialize},
+		{"wrong secret", testDecoder(JSON, "wrong-secret", observe), data.cookie, OutcomeTampered, StageSignature},
+		{"no signature", testDecoder(JSON, data.secret, observe), "e30", OutcomeMalformed, StageSignature},
+		{"expired", testDecoder(JSON, data.secret, observe, WithClock(testNowTimedOut)), data.cookie, OutcomeExpired, StageTimestamp},
+		{"not base64", testDecoder(JSON, data.secret, observe), signed("!!"), OutcomeMalformed, StageBase64},
+		{"not zlib", testDecoder(JSON, data.secret, observe), signed(".e30"), OutcomeMalformed, StageDecompress},
+		{"wrong serializer", testDecoder(Pickle, data.secret, observe), data.cookie, OutcomeMalformed, StageDeserialize},
+	}
+	for _, c := range cases {
+		results = nil
+		decoded, err := c.d.Decode(c.cookie)
+		if len(results) != 1 {
+			t.Fatalf("%s: observed %d results", c.name, len(results))
+		}
+		r := results[0]
+		if r.Outcome != c.outcome || r.Stage != c.stage || r.Err != err {
+			t.Errorf("%s: unexpected result %s at %s (%v), Decode returned %v", c.name, r.Outcome, r.Stage, r.Err, err)
+		}
+		if r.Elapsed < 0 {
+			t.Errorf("%s: elapsed %s", c.name, r.Elapsed)
+		}
+		if c.outcome == OutcomeSuccess && !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("%s: DeepEqual(%#v != %#v)", c.name, data.decoded, decoded)
+		}
+	}
+
+	// streamed decodes report the same outcomes and stages.
+	for _, c := range cases {
+		results = nil
+		_, err := c.d.DecodeReader(strings.NewReader(c.cookie))
+		if len(results) != 1 {
+			t.Fatalf("%s: DecodeReader: observed %d results", c.name, len(results))
+		}
+		if r := results[0]; r.Outcome != c.outcome || r.Stage != c.stage || r.Err != err {
+			t.Errorf("%s: DecodeReader: unexpected result %s at %s (%v), returned %v", c.name, r.Outcome, r.Stage, r.Err, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = nil
+	if _, err := testDecoder(data.kind, data.secret, observe).DecodeContext(ctx, data.cookie); err != context.Canceled {
+		t.Fatalf("DecodeContext: expected context.Canceled, got %v", err)
+	}
+	if len(results) != 1 || results[0].Outcome != OutcomeError {
+		t.Errorf("DecodeContext: unexpected results %v", results)
+	}
+
+	// observers can't reach an ExpiredError's session.
+	results = nil
+	expiredDecoder := testDecoder(data.kind, data.secret, observe, WithClock(testNowTimedOut), WithExpiredError())
+	_, err := expiredDecoder.Decode(data.cookie)
+	var expired, observed *ExpiredError
+	if !errors.As(err, &expired) || len(results) != 1 || !errors.As(results[0].Err, &observed) {
+		t.Fatalf("expected ExpiredErrors, got %v and %v", err, results)
+	}
+	if observed.Session != nil || !observed.Issued.Equal(expired.Issued) || !errors.Is(observed, ErrExpired) {
+		t.Errorf("observed %#v", observed)
+	}
+	if !reflect.DeepEqual(data.decoded, expired.Session) {
+		t.Errorf("DeepEqual(%#v != %#v)", data.decoded, expired.Session)
+	}
+
+	failing := WithSecretFunc(func(string) ([]string, error) { return nil, errors.New("no keyring") })
+	results = nil
+	if _, err := testDecoder(JSON, data.secret, observe, failing).Decode(data.cookie); err == nil {
+		t.Fatalf("Decode succeeded without secrets")
+	}
+	if r := results[0]; r.Outcome != OutcomeError || r.Stage != StageSignature {
+		t.Errorf("secret func: unexpected result %s at %s", r.Outcome, r.Stage)
+	}
+
+	if OutcomeTampered.String() != "tampered" || Outcome(-1).String() != "Outcome(-1)" {
+		t.Errorf("unexpected String: %s, %s", OutcomeTampered, Outcome(-1))
+	}
+}
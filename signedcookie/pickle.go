@@ -0,0 +1,351 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/bpowers/go-django/internal/github.com/kisielk/og-rek"
+)
+
+// normalizePickle converts a value decoded by ogórek into the same
+// shapes encoding/json produces, so that Pickle and JSON sessions can
+// be handled alike: tuples and lists become []interface{}, dicts
+// become map[string]interface{} (it is an error for a dict to have a
+// non-string key), and scalars are left as-is.  Python objects ogórek
+// leaves as opaque reconstructions are converted with the handler
+// registered with RegisterGlobal, if there is one, and otherwise with
+// pickleValue.
+func normalizePickle(v interface{}) (interface{}, error) {
+	var n pickleNormalizer
+	return n.normalize(v, 0)
+}
+
+// maxPickleDepth bounds how deeply normalizePickle recurses, matching
+// encoding/json's limit on nesting.
+const maxPickleDepth = 10000
+
+// A pickleNormalizer keeps track of the dicts and lists it has seen.
+// Through the memo, a pickle can refer to the same dict or list many
+// times, and even to a dict from within itself, so that naively
+// recursing could take exponential time, or forever.
+type pickleNormalizer struct {
+	// dicts holds the normalized form of each dict, by identity,
+	// or nil while it is being normalized.
+	dicts map[uintptr]map[string]interface{}
+	// lists holds the lists already normalized in place.
+	lists map[pickleList]bool
+}
+
+// pickleList identifies a list by its elements.
+type pickleList struct {
+	p uintptr
+	n int
+}
+
+func (pn *pickleNormalizer) normalize(v interface{}, depth int) (interface{}, error) {
+	if depth > maxPickleDepth {
+		return nil, fmt.Errorf("%w: exceeded max depth", ErrMalformed)
+	}
+	depth++
+	switch v := v.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			return v, nil
+		}
+		id := pickleList{reflect.ValueOf(v).Pointer(), len(v)}
+		if pn.lists[id] {
+			return v, nil
+		}
+		if pn.lists == nil {
+			pn.lists = make(map[pickleList]bool)
+		}
+		// lists can't contain themselves, as appending to a list
+		// doesn't change the length of earlier references to it.
+		pn.lists[id] = true
+		for i, e := range v {
+			n, err := pn.normalize(e, depth)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		id := reflect.ValueOf(v).Pointer()
+		if m, ok := pn.dicts[id]; ok {
+			if m == nil {
+				return nil, fmt.Errorf("%w: dict contains itself", ErrMalformed)
+			}
+			return m, nil
+		}
+		if pn.dicts == nil {
+			pn.dicts = make(map[uintptr]map[string]interface{})
+		}
+		pn.dicts[id] = nil
+		m := make(map[string]interface{}, len(v))
+		for ki, e := range v {
+			k, ok := ki.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: non-string key in map: %#v", ErrMalformed, ki)
+			}
+			n, err := pn.normalize(e, depth)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = n
+		}
+		pn.dicts[id] = m
+		return m, nil
+	case ogórek.Call:
+		if fn := lookupGlobal(v.Callable); fn != nil {
+			args, err := pn.normalize(v.Args, depth)
+			if err != nil {
+				return nil, err
+			}
+			o, err := fn(args.([]interface{}))
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", v.Callable.Module, v.Callable.Name, err)
+			}
+			return o, nil
+		}
+	}
+	return pickleValue(v), nil
+}
+
+var (
+	globalsMu sync.RWMutex
+	globals   map[ogórek.Class]func(args []interface{}) (interface{}, error)
+)
+
+// RegisterGlobal registers fn to reconstruct objects of the Python
+// class or function module.name, such as an app's own session
+// objects, when they are found in Pickle payloads.  fn is called with
+// the arguments the object is reconstructed from, normalized as
+// Pickle payloads are, and its result replaces the object in the
+// decoded value.  If fn returns an error, decoding fails with it.
+//
+// Registered handlers take precedence over the built-in conversions,
+// like those for datetime.datetime; registering a nil fn removes the
+// handler for module.name.  RegisterGlobal is safe to call
+// concurrently with decoding, but is normally called from an init
+// function.
+func RegisterGlobal(module, name string, fn func(args []interface{}) (interface{}, error)) {
+	globalsMu.Lock()
+	defer globalsMu.Unlock()
+	class := ogórek.Class{Module: module, Name: name}
+	if fn == nil {
+		delete(globals, class)
+		return
+	}
+	if globals == nil {
+		globals = make(map[ogórek.Class]func([]interface{}) (interface{}, error))
+	}
+	globals[class] = fn
+}
+
+// lookupGlobal returns the handler registered for class, or nil.
+func lookupGlobal(class ogórek.Class) func([]interface{}) (interface{}, error) {
+	globalsMu.RLock()
+	defer globalsMu.RUnlock()
+	return globals[class]
+}
+
+// pickleValue converts the Python objects ogórek leaves as opaque
+// reconstructions into their natural Go equivalents:
+//
+//	datetime.datetime -> time.Time
+//	datetime.date     -> time.Time, at midnight UTC
+//	bytes             -> []byte, as pickled by protocol 2
+//	decimal.Decimal   -> Decimal
+//
+// Naive datetimes have no zone information and are returned in UTC.
+// Aware datetimes are supported when their tzinfo is a fixed offset,
+// datetime.timezone or pytz.UTC; datetimes with any other tzinfo, and
+// values that aren't recognized reconstructions, are returned as-is.
+func pickleValue(v interface{}) interface{} {
+	call, ok := v.(ogórek.Call)
+	if !ok {
+		return v
+	}
+	if call.Callable == codecsEncode {
+		if b, ok := pickleState(call); ok {
+			return b
+		}
+		return v
+	}
+	if call.Callable == decimalDecimal {
+		if len(call.Args) == 1 {
+			if s, ok := call.Args[0].(string); ok {
+				return Decimal(s)
+			}
+		}
+		return v
+	}
+	if call.Callable.Module != "datetime" {
+		return v
+	}
+	switch call.Callable.Name {
+	case "datetime":
+		if t, ok := pickleDatetime(call.Args); ok {
+			return t
+		}
+	case "date":
+		if t, ok := pickleDate(call.Args); ok {
+			return t
+		}
+	}
+	return v
+}
+
+// A Decimal is a decimal.Decimal from a pickled session, such as a
+// cart total, in the string form Python pickles it as, for example
+// "1234.5600" or "1E+3".  It is kept as a string, rather than
+// converted to a float64, so that no precision is lost; Rat converts
+// it for arithmetic.
+type Decimal string
+
+// Rat returns d as a big.Rat, or false if d is not a finite number,
+// like "NaN" or "Infinity".
+func (d Decimal) Rat() (*big.Rat, bool) {
+	return new(big.Rat).SetString(string(d))
+}
+
+// decimalDecimal is the callable decimal.Decimal objects are
+// reconstructed with, from their string form.
+var decimalDecimal = ogórek.Class{Module: "decimal", Name: "Decimal"}
+
+// codecsEncode is the callable Python 3 pickles bytes objects with
+// under protocol 2, which has no opcode for bytes.
+var codecsEncode = ogórek.Class{Module: "_codecs", Name: "encode"}
+
+// pickleState returns the packed state bytes datetime objects are
+// pickled with.  Under Python 2 the state is a byte string, which
+// ogórek decodes byte-for-byte into a Go string.  Python 3 pickles
+// bytes for protocols < 3 as _codecs.encode(unicode, 'latin1'), in
+// which case every rune of the unicode string is one byte, and as
+// bytes, which ogórek decodes to a []byte, from protocol 3 on.
+func pickleState(v interface{}) ([]byte, bool) {
+	switch s := v.(type) {
+	case []byte:
+		return s, true
+	case string:
+		return []byte(s), true
+	case ogórek.Call:
+		if s.Callable != codecsEncode || len(s.Args) != 2 {
+			return nil, false
+		}
+		if enc, ok := s.Args[1].(string); !ok || enc != "latin1" {
+			return nil, false
+		}
+		u, ok := s.Args[0].(string)
+		if !ok {
+			return nil, false
+		}
+		b := make([]byte, 0, len(u))
+		for _, r := range u {
+			if r > 0xff {
+				return nil, false
+			}
+			b = append(b, byte(r))
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+// pickleDatetime reconstructs a datetime.datetime from its pickled
+// arguments: a 10 byte packed state, optionally followed by tzinfo.
+func pickleDatetime(args []interface{}) (time.Time, bool) {
+	if len(args) < 1 || len(args) > 2 {
+		return time.Time{}, false
+	}
+	b, ok := pickleState(args[0])
+	if !ok || len(b) != 10 {
+		return time.Time{}, false
+	}
+	loc := time.UTC
+	if len(args) == 2 {
+		if loc, ok = pickleTZInfo(args[1]); !ok {
+			return time.Time{}, false
+		}
+	}
+	year := int(b[0])<<8 | int(b[1])
+	// the high bit of the month byte holds the PEP 495 fold.
+	month := time.Month(b[2] & 0x7f)
+	usec := int(b[7])<<16 | int(b[8])<<8 | int(b[9])
+	t := time.Date(year, month, int(b[3]), int(b[4]), int(b[5]), int(b[6]), usec*1000, loc)
+	return t, true
+}
+
+// pickleDate reconstructs a datetime.date from its 4 byte packed
+// state.
+func pickleDate(args []interface{}) (time.Time, bool) {
+	if len(args) != 1 {
+		return time.Time{}, false
+	}
+	b, ok := pickleState(args[0])
+	if !ok || len(b) != 4 {
+		return time.Time{}, false
+	}
+	year := int(b[0])<<8 | int(b[1])
+	return time.Date(year, time.Month(b[2]), int(b[3]), 0, 0, 0, 0, time.UTC), true
+}
+
+// pickleTZInfo returns a Location for the fixed-offset tzinfo objects
+// Django uses for aware datetimes.
+func pickleTZInfo(v interface{}) (*time.Location, bool) {
+	switch tz := v.(type) {
+	case ogórek.None:
+		return time.UTC, true
+	case ogórek.Call:
+		switch tz.Callable {
+		case ogórek.Class{Module: "pytz", Name: "_UTC"}:
+			return time.UTC, true
+		case ogórek.Class{Module: "datetime", Name: "timezone"}:
+			if len(tz.Args) < 1 || len(tz.Args) > 2 {
+				return nil, false
+			}
+			offset, ok := pickleTimedelta(tz.Args[0])
+			if !ok {
+				return nil, false
+			}
+			if offset == 0 && len(tz.Args) == 1 {
+				return time.UTC, true
+			}
+			name := ""
+			if len(tz.Args) == 2 {
+				if name, ok = tz.Args[1].(string); !ok {
+					return nil, false
+				}
+			}
+			return time.FixedZone(name, int(offset/time.Second)), true
+		}
+	}
+	return nil, false
+}
+
+// pickleTimedelta converts a pickled datetime.timedelta, which is
+// reconstructed from (days, seconds, microseconds).
+func pickleTimedelta(v interface{}) (time.Duration, bool) {
+	call, ok := v.(ogórek.Call)
+	if !ok || call.Callable != (ogórek.Class{Module: "datetime", Name: "timedelta"}) || len(call.Args) != 3 {
+		return 0, false
+	}
+	var parts [3]int64
+	for i, a := range call.Args {
+		if parts[i], ok = a.(int64); !ok {
+			return 0, false
+		}
+	}
+	d := time.Duration(parts[0])*24*time.Hour +
+		time.Duration(parts[1])*time.Second +
+		time.Duration(parts[2])*time.Microsecond
+	return d, true
+}
@@ -0,0 +1,355 @@
+package signedcookie
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpowers/go-django/internal/github.com/kisielk/og-rek"
+)
+
+func TestPickleDatetime(t *testing.T) {
+	est := time.FixedZone("", -5*60*60)
+	cases := []struct {
+		name    string
+		payload string
+		decoded map[string]interface{}
+	}{
+		{
+			// pickle.dumps(..., protocol=2) under Python 3
+			"python3",
+			"\x80\x02}q\x00(X\x05\x00\x00\x00naiveq\x01cdatetime\ndatetime\nq\x02c_codecs\nencode\nq\x03X\x0c\x00\x00\x00\x07\xc3\x9e\n\x0f\x01\x02\x03\x06\xc3\xb8Uq\x04X\x06\x00\x00\x00latin1q\x05\x86q\x06Rq\x07\x85q\x08Rq\x09X\x03\x00\x00\x00utcq\nh\x02h\x03X\x0b\x00\x00\x00\x07\xc3\x9e\n\x0f\x01\x02\x03\x00\x00\x00q\x0bh\x05\x86q\x0cRq\x0dcdatetime\ntimezone\nq\x0ecdatetime\ntimedelta\nq\x0fK\x00K\x00K\x00\x87q\x10Rq\x11\x85q\x12Rq\x13\x86q\x14Rq\x15X\x03\x00\x00\x00estq\x16h\x02h\x03X\x0b\x00\x00\x00\x07\xc3\x9e\n\x0f\x01\x02\x03\x00\x00\x00q\x17h\x05\x86q\x18Rq\x19h\x0eh\x0fJ\xff\xff\xff\xffJ0\x0b\x01\x00K\x00\x87q\x1aRq\x1b\x85q\x1cRq\x1d\x86q\x1eRq\x1fX\x03\x00\x00\x00dayq cdatetime\ndate\nq!h\x03X\x05\x00\x00\x00\x07\xc3\x9e\n\x0fq\"h\x05\x86q#Rq$\x85q%Rq&X\x01\x00\x00\x00nq'K\x01u.",
+			map[string]interface{}{
+				"naive": time.Date(2014, 10, 15, 1, 2, 3, 456789000, time.UTC),
+				"utc":   time.Date(2014, 10, 15, 1, 2, 3, 0, time.UTC),
+				"est":   time.Date(2014, 10, 15, 1, 2, 3, 0, est),
+				"day":   time.Date(2014, 10, 15, 0, 0, 0, 0, time.UTC),
+				"n":     int64(1),
+			},
+		},
+		{
+			// Python 2 pickles the state as a byte string, and
+			// Django < 4 used pytz.utc for aware datetimes.
+			"python2",
+			"\x80\x02}q\x00(U\x05naiveq\x01cdatetime\ndatetime\nq\x02U\n\x07\xde\n\x0f\x01\x02\x03\x06\xf8U\x85Rq\x03U\x04pytzq\x04h\x02U\n\x07\xde\n\x0f\x01\x02\x03\x00\x00\x00cpytz\n_UTC\n)R\x86Rq\x05u.",
+			map[string]interface{}{
+				"naive": time.Date(2014, 10, 15, 1, 2, 3, 456789000, time.UTC),
+				"pytz":  time.Date(2014, 10, 15, 1, 2, 3, 0, time.UTC),
+			},
+		},
+	}
+	for _, c := range cases {
+		decoded, err := deserialize(Pickle, []byte(c.payload))
+		if err != nil {
+			t.Errorf("%s: deserialize: %s", c.name, err)
+			continue
+		}
+		if !pickleEqual(c.decoded, decoded) {
+			t.Errorf("%s: pickleEqual(%#v != %#v)", c.name, c.decoded, decoded)
+		}
+	}
+}
+
+// pickleEqual is like reflect.DeepEqual, but compares times by
+// instant and UTC offset, as each FixedZone is a distinct Location.
+func pickleEqual(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		at, ok := av.(time.Time)
+		if !ok {
+			if !reflect.DeepEqual(av, b[k]) {
+				return false
+			}
+			continue
+		}
+		bt, ok := b[k].(time.Time)
+		if !ok || !at.Equal(bt) {
+			return false
+		}
+		_, aoff := at.Zone()
+		_, boff := bt.Zone()
+		if aoff != boff {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPickleNested(t *testing.T) {
+	// {'a': (1, [2, {'b': 3.5}]), 'days': [datetime.date(2014, 10, 15)]}
+	payload := "\x80\x02}q\x00(X\x01\x00\x00\x00aq\x01K\x01]q\x02(K\x02}q\x03X\x01\x00\x00\x00bq\x04G@\x0c\x00\x00\x00\x00\x00\x00se\x86q\x05X\x04\x00\x00\x00daysq\x06]q\x07cdatetime\ndate\nq\x08c_codecs\nencode\nq\x09X\x05\x00\x00\x00\x07\xc3\x9e\n\x0fq\nX\x06\x00\x00\x00latin1q\x0b\x86q\x0cRq\x0d\x85q\x0eRq\x0fau."
+	expected := map[string]interface{}{
+		"a": []interface{}{
+			int64(1),
+			[]interface{}{int64(2), map[string]interface{}{"b": 3.5}},
+		},
+		"days": []interface{}{time.Date(2014, 10, 15, 0, 0, 0, 0, time.UTC)},
+	}
+	decoded, err := deserialize(Pickle, []byte(payload))
+	if err != nil {
+		t.Fatalf("deserialize: %s", err)
+	}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+
+	// {'a': {1: 'x'}}
+	payload = "\x80\x02}q\x00X\x01\x00\x00\x00aq\x01}q\x02K\x01X\x01\x00\x00\x00xq\x03ss."
+	if _, err = deserialize(Pickle, []byte(payload)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("nested non-string key: expected ErrMalformed, got %v", err)
+	}
+}
+
+// pickleProtocols holds the same dict pickled by Python 3.11 with
+// each protocol Django may use, PickleSerializer using
+// pickle.HIGHEST_PROTOCOL:
+//
+//	{'_auth_user_id': '1334', 'n': 1334, 'big': 2**70, 'neg': -5,
+//	 'f': 1.5, 'ok': True, 'none': None, 'l': [1, 'two'], 't': (1, 2),
+//	 'd': {'k': 'v'}, 'when': datetime.datetime(2014, 10, 15, 1, 2, 3, 456789),
+//	 'b': b'\x00\xff', 'u': '日本語'}
+var pickleProtocols = []struct {
+	protocol int
+	payload  string
+}{
+	{2, "\x80\x02}q\x00(X\x0d\x00\x00\x00_auth_user_idq\x01X\x04\x00\x00\x001334q\x02X\x01\x00\x00\x00nq\x03M6\x05X\x03\x00\x00\x00bigq\x04\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00@X\x03\x00\x00\x00negq\x05J\xfb\xff\xff\xffX\x01\x00\x00\x00fq\x06G?\xf8\x00\x00\x00\x00\x00\x00X\x02\x00\x00\x00okq\x07\x88X\x04\x00\x00\x00noneq\x08NX\x01\x00\x00\x00lq\x09]q\n(K\x01X\x03\x00\x00\x00twoq\x0beX\x01\x00\x00\x00tq\x0cK\x01K\x02\x86q\x0dX\x01\x00\x00\x00dq\x0e}q\x0fX\x01\x00\x00\x00kq\x10X\x01\x00\x00\x00vq\x11sX\x04\x00\x00\x00whenq\x12cdatetime\ndatetime\nq\x13c_codecs\nencode\nq\x14X\x0c\x00\x00\x00\x07\xc3\x9e\n\x0f\x01\x02\x03\x06\xc3\xb8Uq\x15X\x06\x00\x00\x00latin1q\x16\x86q\x17Rq\x18\x85q\x19Rq\x1aX\x01\x00\x00\x00bq\x1bh\x14X\x03\x00\x00\x00\x00\xc3\xbfq\x1ch\x16\x86q\x1dRq\x1eX\x01\x00\x00\x00uq\x1fX\x09\x00\x00\x00\xe6\x97\xa5\xe6\x9c\xac\xe8\xaa\x9eq u."},
+	{3, "\x80\x03}q\x00(X\x0d\x00\x00\x00_auth_user_idq\x01X\x04\x00\x00\x001334q\x02X\x01\x00\x00\x00nq\x03M6\x05X\x03\x00\x00\x00bigq\x04\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00@X\x03\x00\x00\x00negq\x05J\xfb\xff\xff\xffX\x01\x00\x00\x00fq\x06G?\xf8\x00\x00\x00\x00\x00\x00X\x02\x00\x00\x00okq\x07\x88X\x04\x00\x00\x00noneq\x08NX\x01\x00\x00\x00lq\x09]q\n(K\x01X\x03\x00\x00\x00twoq\x0beX\x01\x00\x00\x00tq\x0cK\x01K\x02\x86q\x0dX\x01\x00\x00\x00dq\x0e}q\x0fX\x01\x00\x00\x00kq\x10X\x01\x00\x00\x00vq\x11sX\x04\x00\x00\x00whenq\x12cdatetime\ndatetime\nq\x13C\n\x07\xde\n\x0f\x01\x02\x03\x06\xf8Uq\x14\x85q\x15Rq\x16X\x01\x00\x00\x00bq\x17C\x02\x00\xffq\x18X\x01\x00\x00\x00uq\x19X\x09\x00\x00\x00\xe6\x97\xa5\xe6\x9c\xac\xe8\xaa\x9eq\x1au."},
+	{4, "\x80\x04\x95\xcc\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x0d_auth_user_id\x94\x8c\x041334\x94\x8c\x01n\x94M6\x05\x8c\x03big\x94\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00@\x8c\x03neg\x94J\xfb\xff\xff\xff\x8c\x01f\x94G?\xf8\x00\x00\x00\x00\x00\x00\x8c\x02ok\x94\x88\x8c\x04none\x94N\x8c\x01l\x94]\x94(K\x01\x8c\x03two\x94e\x8c\x01t\x94K\x01K\x02\x86\x94\x8c\x01d\x94}\x94\x8c\x01k\x94\x8c\x01v\x94s\x8c\x04when\x94\x8c\x08datetime\x94\x8c\x08datetime\x94\x93\x94C\n\x07\xde\n\x0f\x01\x02\x03\x06\xf8U\x94\x85\x94R\x94\x8c\x01b\x94C\x02\x00\xff\x94\x8c\x01u\x94\x8c\x09\xe6\x97\xa5\xe6\x9c\xac\xe8\xaa\x9e\x94u."},
+	{5, "\x80\x05\x95\xcc\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x0d_auth_user_id\x94\x8c\x041334\x94\x8c\x01n\x94M6\x05\x8c\x03big\x94\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00@\x8c\x03neg\x94J\xfb\xff\xff\xff\x8c\x01f\x94G?\xf8\x00\x00\x00\x00\x00\x00\x8c\x02ok\x94\x88\x8c\x04none\x94N\x8c\x01l\x94]\x94(K\x01\x8c\x03two\x94e\x8c\x01t\x94K\x01K\x02\x86\x94\x8c\x01d\x94}\x94\x8c\x01k\x94\x8c\x01v\x94s\x8c\x04when\x94\x8c\x08datetime\x94\x8c\x08datetime\x94\x93\x94C\n\x07\xde\n\x0f\x01\x02\x03\x06\xf8U\x94\x85\x94R\x94\x8c\x01b\x94C\x02\x00\xff\x94\x8c\x01u\x94\x8c\x09\xe6\x97\xa5\xe6\x9c\xac\xe8\xaa\x9e\x94u."},
+}
+
+func TestPickleProtocols(t *testing.T) {
+	expected := map[string]interface{}{
+		"_auth_user_id": "1334",
+		"n":             int64(1334),
+		"neg":           int64(-5),
+		"f":             1.5,
+		"ok":            true,
+		"none":          ogórek.None{},
+		"l":             []interface{}{int64(1), "two"},
+		"t":             []interface{}{int64(1), int64(2)},
+		"d":             map[string]interface{}{"k": "v"},
+		"when":          time.Date(2014, 10, 15, 1, 2, 3, 456789000, time.UTC),
+		"b":             []byte{0x00, 0xff},
+		"u":             "日本語",
+	}
+	two70 := new(big.Int).Lsh(big.NewInt(1), 70)
+	for _, p := range pickleProtocols {
+		decoded, err := deserialize(Pickle, []byte(p.payload))
+		if err != nil {
+			t.Errorf("protocol %d: %s", p.protocol, err)
+			continue
+		}
+		if b, ok := decoded["big"].(*big.Int); !ok || b.Cmp(two70) != 0 {
+			t.Errorf("protocol %d: big: %#v != %s", p.protocol, decoded["big"], two70)
+		}
+		delete(decoded, "big")
+		if !reflect.DeepEqual(expected, decoded) {
+			t.Errorf("protocol %d: DeepEqual(%#v != %#v)", p.protocol, expected, decoded)
+		}
+	}
+}
+
+func TestPickleProtocol5Cookie(t *testing.T) {
+	// signing.dumps({'_auth_user_id': '1334', 'when': datetime.datetime(2014, 10, 15, 1, 2, 3)},
+	//     compress=True, serializer=PickleSerializer), as the
+	// signed_cookies backend does under Python 3.11.
+	const cookie = ".eJxrYJ3qwwABtVM0enjjE0tLMuJLi1OL4jNTpvSwGBobmwCp8ozUvCk9HCmJJaklmbmpyMzJU5y52O9x8TMyMQMNmdI6JWhKqR4Aw3UchQ:1XeDSa:jGt9p_sybUETz8gJL4lituIYKtk"
+	decoded, err := testDecoder(Pickle, signerSecret).Decode(cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	expected := map[string]interface{}{
+		"_auth_user_id": "1334",
+		"when":          time.Date(2014, 10, 15, 1, 2, 3, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+}
+
+func TestPickleDecimal(t *testing.T) {
+	// pickle.dumps({'total': Decimal('1234.5600'), 'neg': Decimal('-0.01'),
+	//     'exp': Decimal('1E+3'), 'nan': Decimal('NaN')}, protocol)
+	payloads := map[int]string{
+		2: "\x80\x02}q\x00(X\x05\x00\x00\x00totalq\x01cdecimal\x0aDecimal\x0aq\x02X\x09\x00\x00\x001234.5600q\x03\x85q\x04Rq\x05X\x03\x00\x00\x00negq\x06h\x02X\x05\x00\x00\x00-0.01q\x07\x85q\x08Rq\x09X\x03\x00\x00\x00expq\x0ah\x02X\x04\x00\x00\x001E+3q\x0b\x85q\x0cRq\x0dX\x03\x00\x00\x00nanq\x0eh\x02X\x03\x00\x00\x00NaNq\x0f\x85q\x10Rq\x11u.",
+		5: "\x80\x05\x95l\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x05total\x94\x8c\x07decimal\x94\x8c\x07Decimal\x94\x93\x94\x8c\x091234.5600\x94\x85\x94R\x94\x8c\x03neg\x94h\x04\x8c\x05-0.01\x94\x85\x94R\x94\x8c\x03exp\x94h\x04\x8c\x041E+3\x94\x85\x94R\x94\x8c\x03nan\x94h\x04\x8c\x03NaN\x94\x85\x94R\x94u.",
+	}
+	expected := map[string]interface{}{
+		"total": Decimal("1234.5600"),
+		"neg":   Decimal("-0.01"),
+		"exp":   Decimal("1E+3"),
+		"nan":   Decimal("NaN"),
+	}
+	for protocol, payload := range payloads {
+		decoded, err := deserialize(Pickle, []byte(payload))
+		if err != nil {
+			t.Errorf("protocol %d: %s", protocol, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, decoded) {
+			t.Errorf("protocol %d: DeepEqual(%#v != %#v)", protocol, expected, decoded)
+		}
+	}
+
+	for _, c := range []struct {
+		d   Decimal
+		rat string
+	}{
+		{"1234.5600", "30864/25"},
+		{"-0.01", "-1/100"},
+		{"1E+3", "1000/1"},
+	} {
+		if r, ok := c.d.Rat(); !ok || r.String() != c.rat {
+			t.Errorf("Decimal(%q).Rat(): %v, %v, expected %s", c.d, r, ok, c.rat)
+		}
+	}
+	if _, ok := Decimal("NaN").Rat(); ok {
+		t.Errorf("Decimal(NaN).Rat(): expected false")
+	}
+}
+
+func TestPickleUnsupportedOpcode(t *testing.T) {
+	// {'s': {1}}, using protocol 4's EMPTY_SET
+	payload := "\x80\x04\x95\x0e\x00\x00\x00\x00\x00\x00\x00}\x94\x8c\x01s\x94\x8f\x94(K\x01\x90s."
+	_, err := deserialize(Pickle, []byte(payload))
+	if !errors.Is(err, ErrMalformed) || !strings.Contains(err.Error(), "EMPTY_SET") {
+		t.Errorf("expected an error naming EMPTY_SET, got %v", err)
+	}
+}
+
+func TestPickleMalformed(t *testing.T) {
+	for _, payload := range []string{
+		"",
+		"0",
+		"a",
+		"(a",
+		"K\x01\x85",
+		"(K\x01d",
+		"}(]K\x01u",
+		"}q\x00X\x01\x00\x00\x00ah\x00s.",
+		"B\xff\xff\xff\xff.",
+	} {
+		if _, err := pickleLoads(strings.NewReader(payload)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("pickleLoads(%q): expected ErrMalformed, got %v", payload, err)
+		}
+	}
+}
+
+func TestPickleShared(t *testing.T) {
+	// d = {'x': 1}; pickle.dumps({'a': [d, d], 'b': d}, 2) refers to d
+	// through the memo.
+	payload := "\x80\x02}q\x00(X\x01\x00\x00\x00aq\x01]q\x02(}q\x03X\x01\x00\x00\x00xq\x04K\x01sh\x03eX\x01\x00\x00\x00bq\x05h\x03u."
+	o, err := pickleLoads(strings.NewReader(payload))
+	if err != nil {
+		t.Fatalf("pickleLoads: %s", err)
+	}
+	d := map[string]interface{}{"x": int64(1)}
+	expected := map[string]interface{}{"a": []interface{}{d, d}, "b": d}
+	if !reflect.DeepEqual(expected, o) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, o)
+	}
+
+	// l = [1]; for i in range(64): l = [l, l].  Walking this without
+	// noticing the sharing would visit 2^64 lists.
+	payload = "}X\x01\x00\x00\x00l]K\x01a" + strings.Repeat("q\x000](h\x00h\x00e", 64) + "s."
+	if _, err = pickleLoads(strings.NewReader(payload)); err != nil {
+		t.Errorf("pickleLoads(shared lists): %s", err)
+	}
+}
+
+func TestRegisterGlobal(t *testing.T) {
+	// pickle.dumps({'cart': Cart(3, 'sku-1', {'gift': True}), 'n': 1},
+	//     protocol), where Cart is myapp.cart.Cart and reduces to its
+	//     constructor arguments.
+	payloads := map[int]string{
+		2: "\x80\x02}q\x00(X\x04\x00\x00\x00cartq\x01cmyapp.cart\nCart\nq\x02K\x03X\x05\x00\x00\x00sku-1q\x03}q\x04X\x04\x00\x00\x00giftq\x05\x88s\x87q\x06Rq\x07X\x01\x00\x00\x00nq\x08K\x01u.",
+		5: "\x80\x05\x95A\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x04cart\x94\x8c\nmyapp.cart\x94\x8c\x04Cart\x94\x93\x94K\x03\x8c\x05sku-1\x94}\x94\x8c\x04gift\x94\x88s\x87\x94R\x94\x8c\x01n\x94K\x01u.",
+	}
+	type cart struct {
+		Qty  int64
+		SKU  string
+		Opts map[string]interface{}
+	}
+	errBad := errors.New("bad cart")
+	RegisterGlobal("myapp.cart", "Cart", func(args []interface{}) (interface{}, error) {
+		if len(args) != 3 {
+			return nil, errBad
+		}
+		qty, _ := args[0].(int64)
+		sku, _ := args[1].(string)
+		opts, _ := args[2].(map[string]interface{})
+		return cart{qty, sku, opts}, nil
+	})
+	defer RegisterGlobal("myapp.cart", "Cart", nil)
+
+	expected := map[string]interface{}{
+		"cart": cart{3, "sku-1", map[string]interface{}{"gift": true}},
+		"n":    int64(1),
+	}
+	for protocol, payload := range payloads {
+		decoded, err := deserialize(Pickle, []byte(payload))
+		if err != nil {
+			t.Errorf("protocol %d: %s", protocol, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, decoded) {
+			t.Errorf("protocol %d: DeepEqual(%#v != %#v)", protocol, expected, decoded)
+		}
+	}
+
+	RegisterGlobal("myapp.cart", "Cart", func(args []interface{}) (interface{}, error) {
+		return nil, errBad
+	})
+	if _, err := deserialize(Pickle, []byte(payloads[2])); !errors.Is(err, errBad) || !strings.Contains(err.Error(), "myapp.cart.Cart") {
+		t.Errorf("expected the handler's error, got %v", err)
+	}
+
+	// without a handler, the reconstruction is returned as-is.
+	RegisterGlobal("myapp.cart", "Cart", nil)
+	decoded, err := deserialize(Pickle, []byte(payloads[2]))
+	if err != nil {
+		t.Fatalf("deserialize: %s", err)
+	}
+	if call, ok := decoded["cart"].(ogórek.Call); !ok || call.Callable != (ogórek.Class{Module: "myapp.cart", Name: "Cart"}) {
+		t.Errorf("expected an ogórek.Call, got %#v", decoded["cart"])
+	}
+}
+
+func TestPickleEncode(t *testing.T) {
+	// pickle.loads(b) == {'n': 1334, 'name': 'Zoë', 'raw': b'\x00\xff',
+	//     'ok': True} under Python 2 and 3.
+	const encoded = "\x80\x02}(X\x01\x00\x00\x00nM6\x05X\x04\x00\x00\x00nameX\x04\x00\x00\x00Zo\xc3\xabX\x02\x00\x00\x00ok\x88X\x03\x00\x00\x00rawc_codecs\nencode\nX\x03\x00\x00\x00\x00\xc3\xbfX\x06\x00\x00\x00latin1\x86Ru."
+	obj := map[string]interface{}{"n": int64(1334), "name": "Zoë", "ok": true, "raw": []byte{0, 0xff}}
+	b, err := pickleDumps(obj)
+	if err != nil {
+		t.Fatalf("pickleDumps: %s", err)
+	}
+	if string(b) != encoded {
+		t.Errorf("pickleDumps: %q != %q", b, encoded)
+	}
+
+	d := testDecoder(Pickle, "secret")
+	obj["nested"] = map[string]interface{}{"list": []interface{}{"a", 1.5, nil}}
+	cookie, err := d.Encode(obj)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	decoded, err := d.Decode(cookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	obj["nested"] = map[string]interface{}{"list": []interface{}{"a", 1.5, ogórek.None{}}}
+	if !reflect.DeepEqual(obj, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", obj, decoded)
+	}
+
+	if _, err = pickleDumps(map[string]interface{}{"bad": "\xff"}); err == nil {
+		t.Errorf("pickleDumps: expected an error for invalid UTF-8")
+	}
+}
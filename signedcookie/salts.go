@@ -0,0 +1,33 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+// Salts Django signs well-known values with, for use with WithSalt
+// and Decoder.DecodeWithSalt.  Django namespaces its signatures by
+// salt, typically derived from the module and class doing the
+// signing, so that a value signed for one purpose can't be passed off
+// as another.  See also DefaultSalt, used by
+// django.core.signing.dumps.
+const (
+	// SaltSession is the salt the signed_cookies SessionStore signs
+	// sessions with.  It is not configurable through normal means.
+	SaltSession = "django.contrib.sessions.backends.signed_cookies"
+	// SaltMessages is the salt the messages framework's
+	// CookieStorage signs messages with.
+	SaltMessages = "django.contrib.messages"
+	// SaltSigner and SaltTimestampSigner are the salts
+	// django.core.signing's Signer and TimestampSigner fall back to
+	// when none is given, derived from the class names.
+	SaltSigner          = "django.core.signing.Signer"
+	SaltTimestampSigner = "django.core.signing.TimestampSigner"
+
+	// SaltSessionAuthHash and SaltPasswordReset are the key salts
+	// django.utils.crypto.salted_hmac is called with for the session
+	// auth hash, checked by VerifyAuthHash, and for password reset
+	// tokens, checked by CheckPasswordResetToken.  These are HMACs
+	// rather than signed values, so they can't be decoded.
+	SaltSessionAuthHash = "django.contrib.auth.models.AbstractBaseUser.get_session_auth_hash"
+	SaltPasswordReset   = "django.contrib.auth.tokens.PasswordResetTokenGenerator"
+)
@@ -0,0 +1,273 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bpowers/go-django/internal/github.com/kisielk/og-rek"
+)
+
+// the session keys django.contrib.auth stores the logged in user's
+// primary key, authentication backend and session auth hash under
+// (SESSION_KEY, BACKEND_SESSION_KEY and HASH_SESSION_KEY).
+const (
+	userIDKey  = "_auth_user_id"
+	backendKey = "_auth_user_backend"
+	hashKey    = "_auth_user_hash"
+	// the key SessionBase.set_expiry stores a per-session expiry
+	// under.
+	expiryKey = "_session_expiry"
+)
+
+// Int returns the integer stored under key in session, as decoded
+// from either serializer: Pickle produces int64 (or *big.Int), JSON
+// produces float64, and Django stores some integers, like primary
+// keys, as decimal strings.  The second result is false if key isn't
+// present or its value isn't an integer that fits in an int64.
+func Int(session map[string]interface{}, key string) (int64, bool) {
+	switch v := session[key].(type) {
+	case int64:
+		return v, true
+	case float64:
+		// float64(math.MaxInt64) rounds up to 2^63, which
+		// doesn't fit.
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case *big.Int:
+		if !v.IsInt64() {
+			return 0, false
+		}
+		return v.Int64(), true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return i, true
+	}
+	return 0, false
+}
+
+// UserID returns the primary key of the user logged in to session, as
+// stored by django.contrib.auth.login, regardless of the serializer
+// used.  Users with non-integer primary keys, like UUIDs, are stored
+// as strings and can be read directly from session["_auth_user_id"].
+func UserID(session map[string]interface{}) (int64, bool) {
+	return Int(session, userIDKey)
+}
+
+// String returns the string stored under key in session.  The second
+// result is false if key isn't present or its value isn't a string.
+func String(session map[string]interface{}, key string) (string, bool) {
+	s, ok := session[key].(string)
+	return s, ok
+}
+
+// Backend returns the dotted path of the authentication backend the
+// user logged in to session with, such as
+// "django.contrib.auth.backends.ModelBackend".
+func Backend(session map[string]interface{}) (string, bool) {
+	return String(session, backendKey)
+}
+
+// SessionHash returns the session auth hash django.contrib.auth.login
+// stored in session, the hex digest of the user's
+// get_session_auth_hash() at login.  Django uses it to invalidate
+// sessions when the user's password changes.
+func SessionHash(session map[string]interface{}) (string, bool) {
+	return String(session, hashKey)
+}
+
+// VerifyAuthHash reports whether sessionHash, as returned by
+// SessionHash, matches the session auth hash Django derives for a
+// user whose password field is passwordHash, as
+// AbstractBaseUser.get_session_auth_hash does.  A mismatch means the
+// user's password has changed since the session was created, and, as
+// Django does, the session should no longer be trusted.
+func VerifyAuthHash(sessionHash, passwordHash, secret string) bool {
+	expected := hex.EncodeToString(saltedHMAC(SHA256, SaltSessionAuthHash, []byte(passwordHash), secret))
+	return subtle.ConstantTimeCompare([]byte(sessionHash), []byte(expected)) == 1
+}
+
+// DefaultPasswordResetTimeout is Django's default
+// PASSWORD_RESET_TIMEOUT: three days.
+const DefaultPasswordResetTimeout = 3 * 24 * time.Hour
+
+// CheckPasswordResetToken reports whether token is a valid password
+// reset token for a user, made no more than timeout ago, as
+// PasswordResetTokenGenerator.check_token does.  The user is
+// described by the fields Django hashes into the token, which change
+// once the token has been used: userPK, the user's primary key;
+// passwordHash, its password field; lastLogin, its last_login as
+// Python's str formats it without microseconds or a time zone, like
+// "2024-04-30 08:15:00", or "" if the user has never logged in; and
+// email, its email address, or "" if it has none.
+//
+// Tokens are checked against secret with SHA256, as by Django 3.1 and
+// later.  An invalid token is reported with ErrMalformed or
+// ErrSignatureMismatch, and one older than timeout with ErrExpired.
+// Django dates tokens by the wall clock in its TIME_ZONE, so for the
+// timeout to be checked exactly, the local time zone should match it.
+func CheckPasswordResetToken(secret, userPK, passwordHash, lastLogin, email, token string, timeout time.Duration) (bool, error) {
+	return checkPasswordResetToken(time.Now(), secret, userPK, passwordHash, lastLogin, email, token, timeout)
+}
+
+func checkPasswordResetToken(now time.Time, secret, userPK, passwordHash, lastLogin, email, token string, timeout time.Duration) (bool, error) {
+	parts := strings.Split(token, "-")
+	// base36_to_int rejects more than 13 digits.
+	if len(parts) != 2 || len(parts[0]) > 13 {
+		return false, fmt.Errorf("%w: invalid password reset token", ErrMalformed)
+	}
+	ts, err := base36Decode([]byte(parts[0]))
+	if err != nil || ts < 0 {
+		return false, fmt.Errorf("%w: invalid password reset token timestamp", ErrMalformed)
+	}
+	expected := passwordResetToken(secret, userPK+passwordHash+lastLogin+strconv.FormatInt(ts, 10)+email, ts)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return false, ErrSignatureMismatch
+	}
+	if passwordResetSeconds(now)-ts > int64(timeout/time.Second) {
+		return false, fmt.Errorf("%w: %d", ErrExpired, ts)
+	}
+	return true, nil
+}
+
+// passwordResetToken returns the token
+// PasswordResetTokenGenerator._make_token_with_timestamp makes from
+// the user's hash value and ts: ts in base36, and every other hex
+// digit of the HMAC of the hash value.
+func passwordResetToken(secret, hashValue string, ts int64) string {
+	digest := hex.EncodeToString(saltedHMAC(SHA256, SaltPasswordReset, []byte(hashValue), secret))
+	token := append(base36Encode(ts), '-')
+	for i := 0; i < len(digest); i += 2 {
+		token = append(token, digest[i])
+	}
+	return string(token)
+}
+
+// passwordResetSeconds returns t as PasswordResetTokenGenerator dates
+// tokens: the seconds since 2001-01-01 by t's wall clock.
+func passwordResetSeconds(t time.Time) int64 {
+	y, m, d := t.Date()
+	wall := time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	return int64(wall.Sub(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)) / time.Second)
+}
+
+// EffectiveExpiry returns when session expires, replicating Django's
+// SessionBase.get_expiry_date with modification set to issued, the
+// time the session was last saved, such as the cookie's timestamp.
+// A per-session expiry set with set_expiry is stored under
+// "_session_expiry", and is honored in each of its forms:
+//
+//   - an age in seconds after issued, which may be fractional as for
+//     Python's timedelta(seconds=expiry), where 0 means defaultMaxAge;
+//   - a datetime, pickled or, as newer Django stores it, as an ISO
+//     8601 string, which is returned as-is (naive datetimes are taken
+//     to be UTC).
+//
+// Without one, sessions expire defaultMaxAge after issued.  A
+// "_session_expiry" in any other form can't be honored, so the
+// session is treated as having expired at issued.
+func EffectiveExpiry(session map[string]interface{}, issued time.Time, defaultMaxAge time.Duration) time.Time {
+	v, ok := session[expiryKey]
+	if !ok || v == nil || v == (ogórek.None{}) {
+		return issued.Add(defaultMaxAge)
+	}
+	switch expiry := v.(type) {
+	case time.Time:
+		return expiry
+	case string:
+		if t, ok := parseISOTime(expiry); ok {
+			return t
+		}
+		return issued
+	case float64:
+		// beyond the range of a Duration, and of a timedelta.
+		if math.IsNaN(expiry) || math.Abs(expiry) > float64(math.MaxInt64/int64(time.Second)) {
+			return issued
+		}
+		if expiry == 0 {
+			return issued.Add(defaultMaxAge)
+		}
+		return issued.Add(time.Duration(expiry * float64(time.Second)))
+	}
+	age, ok := Int(session, expiryKey)
+	if !ok {
+		return issued
+	}
+	if age == 0 {
+		return issued.Add(defaultMaxAge)
+	}
+	return issued.Add(time.Duration(age) * time.Second)
+}
+
+// parseISOTime parses the output of Python's datetime.isoformat, as
+// datetime.fromisoformat does.  Times without an offset are taken to
+// be UTC.
+func parseISOTime(s string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// A SessionInfo holds a decoded session along with the metadata of
+// the cookie it was decoded from, as returned by DecodeFull.
+type SessionInfo struct {
+	Session map[string]interface{}
+	// Issued is the time the cookie was signed at.
+	Issued time.Time
+	// Expiry is when the session expires, as computed by
+	// EffectiveExpiry with the Decoder's max age.
+	Expiry time.Time
+	// Serializer is the serializer the payload was deserialized
+	// with, as detected if the Decoder uses AutoSerializer.
+	Serializer Serializer
+	// Compressed is set if the payload was compressed.
+	Compressed bool
+	// KeyIndex is the index of the secret the cookie was signed
+	// with, as returned by DecodeWithKeyIndex.
+	KeyIndex int
+}
+
+// DecodeFull is like Decode, but returns the session together with
+// its metadata, such as for populating a log line in one call.
+func (d *Decoder) DecodeFull(cookie string) (*SessionInfo, error) {
+	payload, issued, key, err := d.unsign([]byte(cookie))
+	if err != nil {
+		return nil, err
+	}
+	info := &SessionInfo{Issued: issued, Serializer: d.serializer, KeyIndex: key}
+	info.Compressed = len(payload) > 0 && payload[0] == '.'
+	if payload, err = decodePayload(payload, d.compressor, d.maxDecompressedSize); err != nil {
+		return nil, err
+	}
+	if info.Serializer == AutoSerializer {
+		err = autoDeserialize(payload, func(s Serializer) (err error) {
+			info.Serializer = s
+			info.Session, err = deserialize(s, payload)
+			return err
+		})
+	} else {
+		info.Session, err = deserialize(info.Serializer, payload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("deserialize: %w", err)
+	}
+	info.Expiry = EffectiveExpiry(info.Session, issued, d.maxAge)
+	return info, nil
+}
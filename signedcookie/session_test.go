@@ -0,0 +1,214 @@
+package signedcookie
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bpowers/go-django/internal/github.com/kisielk/og-rek"
+)
+
+func TestInt(t *testing.T) {
+	session := map[string]interface{}{
+		"int64":    int64(1334),
+		"float64":  float64(1334),
+		"string":   "1334",
+		"big":      big.NewInt(1334),
+		"fraction": 1.5,
+		"huge":     math.Pow(2, 63),
+		"bigger":   new(big.Int).Lsh(big.NewInt(1), 70),
+		"uuid":     "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+		"bool":     true,
+	}
+	for _, key := range []string{"int64", "float64", "string", "big"} {
+		if i, ok := Int(session, key); !ok || i != 1334 {
+			t.Errorf("Int(%s): %d, %t", key, i, ok)
+		}
+	}
+	for _, key := range []string{"fraction", "huge", "bigger", "uuid", "bool", "missing"} {
+		if i, ok := Int(session, key); ok {
+			t.Errorf("Int(%s): unexpectedly ok (%d)", key, i)
+		}
+	}
+}
+
+func TestUserID(t *testing.T) {
+	for _, d := range decodeData {
+		if id, ok := UserID(d.decoded); !ok || id != 1334 {
+			t.Errorf("UserID(%v): %d, %t", d.kind, id, ok)
+		}
+	}
+	if _, ok := UserID(map[string]interface{}{}); ok {
+		t.Errorf("UserID of an anonymous session is ok")
+	}
+}
+
+func TestAuthAccessors(t *testing.T) {
+	for _, d := range decodeData {
+		if backend, ok := Backend(d.decoded); !ok || backend != "some.sweet.Backend" {
+			t.Errorf("Backend(%v): %q, %t", d.kind, backend, ok)
+		}
+	}
+	session := map[string]interface{}{
+		hashKey:    "6c5f5e7f5ad8b0e5c0f5d2ad5b0104e0bd98c4fa6b6c8d3f5b0f7da8d9b1a9a2",
+		backendKey: int64(1),
+	}
+	if hash, ok := SessionHash(session); !ok || hash != session[hashKey] {
+		t.Errorf("SessionHash: %q, %t", hash, ok)
+	}
+	if _, ok := Backend(session); ok {
+		t.Errorf("Backend of a non-string value is ok")
+	}
+	if _, ok := SessionHash(map[string]interface{}{}); ok {
+		t.Errorf("SessionHash of an anonymous session is ok")
+	}
+}
+
+func TestVerifyAuthHash(t *testing.T) {
+	const (
+		secret   = "django-insecure-secret"
+		password = "pbkdf2_sha256$600000$salt$hash="
+		// user.get_session_auth_hash() for a user with password
+		hash = "fd2a27aadcf6c8a5feeb44d8e4c36bb38d9c0b6af43518d9ae674a7f0c734a11"
+	)
+	if !VerifyAuthHash(hash, password, secret) {
+		t.Errorf("VerifyAuthHash rejected a valid hash")
+	}
+	if VerifyAuthHash(hash, "pbkdf2_sha256$600000$salt$changed=", secret) {
+		t.Errorf("VerifyAuthHash accepted a hash after a password change")
+	}
+	if VerifyAuthHash(hash, password, "other-secret") {
+		t.Errorf("VerifyAuthHash accepted a hash under the wrong secret")
+	}
+}
+
+func TestCheckPasswordResetToken(t *testing.T) {
+	const (
+		secret   = "reset-secret"
+		password = "pbkdf2_sha256$600000$salt$hash="
+		login    = "2024-04-30 08:15:00"
+		email    = "a@example.com"
+		// PasswordResetTokenGenerator().make_token(user) at
+		// 2024-05-01 12:00:00, for user 42 with password, login
+		// and email, and for the same user without the last two.
+		token        = "c6ck00-51c24788de2eb872eaeddc332beadb22"
+		tokenNoLogin = "c6ck00-3f6a06c86049cf639e4ff8754e1d2e59"
+	)
+	made := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := made.Add(DefaultPasswordResetTimeout)
+	if ok, err := checkPasswordResetToken(later, secret, "42", password, login, email, token, DefaultPasswordResetTimeout); !ok || err != nil {
+		t.Errorf("check_token: %v, %v", ok, err)
+	}
+	if ok, err := checkPasswordResetToken(made, secret, "42", password, "", "", tokenNoLogin, DefaultPasswordResetTimeout); !ok || err != nil {
+		t.Errorf("check_token without login or email: %v, %v", ok, err)
+	}
+	// the wall clock in the local zone counts, as for Django.
+	local := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	if ok, err := checkPasswordResetToken(local, secret, "42", password, login, email, token, time.Minute); !ok || err != nil {
+		t.Errorf("check_token in CEST: %v, %v", ok, err)
+	}
+
+	cases := []struct {
+		name                       string
+		now                        time.Time
+		pk, password, login, email string
+		token                      string
+		err                        error
+	}{
+		{"expired", later.Add(time.Second), "42", password, login, email, token, ErrExpired},
+		{"other user", made, "43", password, login, email, token, ErrSignatureMismatch},
+		{"password changed", made, "42", password + "x", login, email, token, ErrSignatureMismatch},
+		{"logged in since", made, "42", password, "2024-05-01 12:30:00", email, token, ErrSignatureMismatch},
+		{"email changed", made, "42", password, login, "b@example.com", token, ErrSignatureMismatch},
+		{"other timestamp", made, "42", password, login, email, "c6ck01" + token[6:], ErrSignatureMismatch},
+		{"uppercase", made, "42", password, login, email, "C6CK00" + token[6:], ErrMalformed},
+		{"no timestamp", made, "42", password, login, email, token[7:], ErrMalformed},
+		{"extra part", made, "42", password, login, email, token + "-x", ErrMalformed},
+		{"long timestamp", made, "42", password, login, email, "00000000c6ck00" + token[6:], ErrMalformed},
+		{"empty", made, "42", password, login, email, "", ErrMalformed},
+	}
+	for _, c := range cases {
+		ok, err := checkPasswordResetToken(c.now, secret, c.pk, c.password, c.login, c.email, c.token, DefaultPasswordResetTimeout)
+		if ok || !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v, %v", c.name, c.err, ok, err)
+		}
+	}
+	if ok, err := CheckPasswordResetToken("wrong", "42", password, login, email, token, DefaultPasswordResetTimeout); ok || !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("CheckPasswordResetToken with the wrong secret: %v, %v", ok, err)
+	}
+}
+
+func TestEffectiveExpiry(t *testing.T) {
+	issued := time.Date(2014, 10, 15, 1, 2, 3, 0, time.UTC)
+	at := time.Date(2014, 10, 20, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		expiry interface{}
+		want   time.Time
+	}{
+		{"json seconds", float64(3600), issued.Add(time.Hour)},
+		{"pickle seconds", int64(3600), issued.Add(time.Hour)},
+		{"zero", float64(0), issued.Add(DefaultMaxAge)},
+		{"none", ogórek.None{}, issued.Add(DefaultMaxAge)},
+		{"null", nil, issued.Add(DefaultMaxAge)},
+		{"pickled datetime", at, at},
+		{"isoformat", "2014-10-20T12:00:00+00:00", at},
+		{"isoformat with microseconds", "2014-10-20T14:00:00.000000+02:00", at},
+		{"naive isoformat", "2014-10-20T12:00:00", at},
+		{"garbage", "next tuesday", issued},
+		{"fraction", 1.5, issued.Add(1500 * time.Millisecond)},
+		{"negative fraction", -0.25, issued.Add(-250 * time.Millisecond)},
+		{"huge", 1e300, issued},
+	}
+	for _, c := range cases {
+		session := map[string]interface{}{"_session_expiry": c.expiry}
+		if got := EffectiveExpiry(session, issued, DefaultMaxAge); !got.Equal(c.want) {
+			t.Errorf("%s: %s != %s", c.name, got, c.want)
+		}
+	}
+	if got := EffectiveExpiry(map[string]interface{}{}, issued, time.Hour); !got.Equal(issued.Add(time.Hour)) {
+		t.Errorf("no expiry: %s", got)
+	}
+}
+
+func TestDecodeFull(t *testing.T) {
+	for _, data := range decodeData {
+		issued, err := PeekTimestamp(data.cookie)
+		if err != nil {
+			t.Fatalf("PeekTimestamp: %s", err)
+		}
+		d := testDecoder(AutoSerializer, "old", WithFallbackSecrets(data.secret))
+		info, err := d.DecodeFull(data.cookie)
+		if err != nil {
+			t.Fatalf("DecodeFull: %s", err)
+		}
+		if !reflect.DeepEqual(data.decoded, info.Session) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, info.Session)
+		}
+		if !info.Issued.Equal(issued) || !info.Expiry.Equal(issued.Add(DefaultMaxAge)) {
+			t.Errorf("issued %s, expiry %s", info.Issued, info.Expiry)
+		}
+		if info.Serializer != data.kind || !info.Compressed || info.KeyIndex != 1 {
+			t.Errorf("serializer %s, compressed %t, key %d", info.Serializer, info.Compressed, info.KeyIndex)
+		}
+	}
+
+	d := testDecoder(JSON, "secret", WithCompression(false))
+	cookie, err := d.Encode(map[string]interface{}{"_session_expiry": 3600})
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	info, err := d.DecodeFull(cookie)
+	if err != nil {
+		t.Fatalf("DecodeFull: %s", err)
+	}
+	if info.Compressed || info.Serializer != JSON || !info.Expiry.Equal(info.Issued.Add(time.Hour)) {
+		t.Errorf("compressed %t, serializer %s, expiry %s", info.Compressed, info.Serializer, info.Expiry)
+	}
+	if _, err = testDecoder(JSON, "wrong").DecodeFull(cookie); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
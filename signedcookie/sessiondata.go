@@ -0,0 +1,106 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the salt used by SessionBase.encode since Django 3.1, built from
+// the SessionStore's module and __qualname__.  Every backend shipped
+// with Django names its class SessionStore.
+const sessionDataSalt = "django.contrib.sessions.SessionStore"
+
+// the key salt used by SessionBase._hash before Django 3.1, built
+// from "django.contrib.sessions" and the SessionStore's __name__.
+const legacySessionDataSalt = "django.contrib.sessionsSessionStore"
+
+// DecodeSessionData returns a map corresponding to the session_data
+// column of a row in Django's django_session table, as written by the
+// db and cached_db session backends.  Both
+// the format used since Django 3.1, which is produced by
+// django.core.signing.dumps, and the older base64-encoded "hash:data"
+// format are supported.
+//
+// Unlike cookies, session data carries no expiry of its own; Django
+// tracks it in the expire_date column, so no maximum age is enforced
+// here.
+func DecodeSessionData(s Serializer, secret, data string) (map[string]interface{}, error) {
+	// the legacy format is standard base64, which never contains
+	// the signing module's ':' separator.
+	if !strings.Contains(data, ":") {
+		return decodeLegacySessionData(s, secret, data)
+	}
+	o, err := decodeSignedSessionData(s, SHA256, secret, data)
+	if errors.Is(err, ErrSignatureMismatch) {
+		// DEFAULT_HASHING_ALGORITHM = 'sha1' was supported
+		// during the transition to SHA256 in Django 3.1.
+		o, err = decodeSignedSessionData(s, SHA1, secret, data)
+	}
+	return o, err
+}
+
+func decodeSignedSessionData(s Serializer, a Algorithm, secret, data string) (map[string]interface{}, error) {
+	d, err := NewDecoder(secret, WithSerializer(s), WithAlgorithm(a), WithSalt(sessionDataSalt), WithNoExpiry())
+	if err != nil {
+		return nil, err
+	}
+	return d.Decode(data)
+}
+
+// decodeLegacySessionData implements SessionBase._legacy_decode.
+func decodeLegacySessionData(s Serializer, secret, data string) (map[string]interface{}, error) {
+	encoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: base64: %w", ErrMalformed, err)
+	}
+	i := bytes.IndexByte(encoded, ':')
+	if i == -1 {
+		return nil, fmt.Errorf("%w: expected : in session data", ErrMalformed)
+	}
+	hash, serialized := encoded[:i], encoded[i+1:]
+	expected := hex.EncodeToString(saltedHMAC(SHA1, legacySessionDataSalt, serialized, secret))
+	if subtle.ConstantTimeCompare(hash, []byte(expected)) != 1 {
+		return nil, fmt.Errorf("%w: session data corrupted", ErrSignatureMismatch)
+	}
+	return deserialize(s, serialized)
+}
+
+// DecodeLegacyMD5 returns a map corresponding to session data written
+// by Django 1.2 and earlier, read from an old session_data column or
+// archive.  LEGACY: these versions predate django.core.signing, and
+// appended the MD5 digest of the pickled session followed by
+// SECRET_KEY, as 32 hex digits, to the pickle, base64 encoding the
+// result with line breaks.  A digest of data followed by the secret
+// is not a MAC, and MD5 is broken, so data this function accepts must
+// not be trusted any more than data without a signature, and it must
+// not be used to read current cookies or session data.  Such sessions
+// were always pickled.
+func DecodeLegacyMD5(secret, data string) (map[string]interface{}, error) {
+	// the base64 decoder skips the line breaks.
+	encoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: base64: %w", ErrMalformed, err)
+	}
+	if len(encoded) < md5.Size*2 {
+		return nil, fmt.Errorf("%w: session data too short", ErrMalformed)
+	}
+	i := len(encoded) - md5.Size*2
+	pickled, hash := encoded[:i], encoded[i:]
+	h := md5.New()
+	h.Write(pickled)
+	h.Write([]byte(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(hex.EncodeToString(h.Sum(nil)))) != 1 {
+		return nil, fmt.Errorf("%w: session data corrupted", ErrSignatureMismatch)
+	}
+	return deserialize(Pickle, pickled)
+}
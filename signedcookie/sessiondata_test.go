@@ -0,0 +1,68 @@
+package signedcookie
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var sessionDataSecret = "70e97f01975bb59ae8804ca164081c46034042aa913a4dac055cad6a7e188bd1"
+
+var sessionData = []struct {
+	kind Serializer
+	data string
+}{
+	// Django 3.0, JSONSerializer
+	{JSON, "MmE0YzhjZWUzNDkzZTgyMDFjNmQ5Yjg1ZWQ0NmY1MDk4OWFhMzNmODp7Il9hdXRoX3VzZXJfaWQiOiIxMzM0IiwiX2F1dGhfdXNlcl9iYWNrZW5kIjoiZGphbmdvLmNvbnRyaWIuYXV0aC5iYWNrZW5kcy5Nb2RlbEJhY2tlbmQifQ=="},
+	// Django 3.0, PickleSerializer
+	{Pickle, "NjEyMGM4ODcxYmRmYTA3Zjg3ZWFjYzYwMjg2MDk4NTA4OWNkZjI4NTqAAn1xAChYDQAAAF9hdXRoX3VzZXJfaWRxAVgEAAAAMTMzNHECWBIAAABfYXV0aF91c2VyX2JhY2tlbmRxA1gpAAAAZGphbmdvLmNvbnRyaWIuYXV0aC5iYWNrZW5kcy5Nb2RlbEJhY2tlbmRxBHUu"},
+	// Django 4.2, JSONSerializer
+	{JSON, ".eJyrVopPLC3JiC8tTi2Kz0xRslIyNDY2UdJBFk5KTM5OzQPJpWQl5qXn6yXn55UUZSbpgZToQWWL9XzzU1JznKBqawF4Zx_H:1XdpWy:12L0bPH3yVYEBMRFVwJj2vNgqGfemR41vP1JZxqJ74g"},
+}
+
+func TestDecodeSessionData(t *testing.T) {
+	// the signed format has a timestamp from 2014; decoding it
+	// ensures expiry isn't checked.
+	expected := map[string]interface{}{
+		"_auth_user_id":      "1334",
+		"_auth_user_backend": "django.contrib.auth.backends.ModelBackend",
+	}
+	for _, d := range sessionData {
+		decoded, err := DecodeSessionData(d.kind, sessionDataSecret, d.data)
+		if err != nil {
+			t.Errorf("DecodeSessionData(%v, '%s'): %s", d.kind, d.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+		}
+		if _, err = DecodeSessionData(d.kind, "wrong", d.data); !errors.Is(err, ErrSignatureMismatch) {
+			t.Errorf("expected ErrSignatureMismatch, got %v", err)
+		}
+	}
+}
+
+// Django 1.2, pickled with protocol 2
+const legacyMD5Data = "gAJ9cQAoWA0AAABfYXV0aF91c2VyX2lkcQFYBAAAADEzMzRxAlgSAAAAX2F1dGhfdXNlcl9iYWNr\nZW5kcQNYKQAAAGRqYW5nby5jb250cmliLmF1dGguYmFja2VuZHMuTW9kZWxCYWNrZW5kcQR1Ljhl\nOWZiZjk3MzExMDFlNzgwMzBiYTgwNTg5ZDM0ZDNk\n"
+
+func TestDecodeLegacyMD5(t *testing.T) {
+	expected := map[string]interface{}{
+		"_auth_user_id":      "1334",
+		"_auth_user_backend": "django.contrib.auth.backends.ModelBackend",
+	}
+	decoded, err := DecodeLegacyMD5(sessionDataSecret, legacyMD5Data)
+	if err != nil {
+		t.Fatalf("DecodeLegacyMD5: %s", err)
+	}
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", expected, decoded)
+	}
+	if _, err = DecodeLegacyMD5("wrong", legacyMD5Data); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+	for _, data := range []string{"", "c2hvcnQ=", "not base64!"} {
+		if _, err = DecodeLegacyMD5(sessionDataSecret, data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("DecodeLegacyMD5(%q): expected ErrMalformed, got %v", data, err)
+		}
+	}
+}
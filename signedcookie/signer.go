@@ -0,0 +1,347 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+)
+
+// A Signer signs and verifies arbitrary values the same way as
+// django.core.signing.Signer.  An empty Salt means the salt Django's
+// Signer uses by default.  The zero Algorithm is SHA1; Django 3.1 and
+// later sign with SHA256 by default.
+type Signer struct {
+	Secret string
+	// FallbackSecrets are accepted by Unsign in addition to Secret,
+	// mirroring Django's SECRET_KEY_FALLBACKS setting.
+	FallbackSecrets []string
+	Salt            string
+	Algorithm       Algorithm
+
+	sep      []byte           // if nil, defaultSep
+	hashFunc func() hash.Hash // if non-nil, used in place of Algorithm
+	scheme   Scheme
+	debug    bool // if set, mismatch errors include the signatures
+	// if set, the signature is checked against every secret, see
+	// WithConstantTimeKeyTrial.
+	allSecrets bool
+
+	// macs holds a pool of keyed HMACs for each secret, primary
+	// first, if the Signer has been prepared.
+	macs []*sync.Pool
+}
+
+// prepare precomputes the HMAC keys for the Signer's secrets, so that
+// signatures can be computed with pooled, already keyed HMACs.  The
+// Signer's fields must not be changed afterwards.
+func (s *Signer) prepare() {
+	s.macs = make([]*sync.Pool, 0, 1+len(s.FallbackSecrets))
+	for i := 0; i <= len(s.FallbackSecrets); i++ {
+		key := s.key(s.secret(i))
+		h := s.hash()
+		s.macs = append(s.macs, &sync.Pool{
+			New: func() interface{} { return hmac.New(h, key) },
+		})
+	}
+}
+
+// hash returns the constructor for the Signer's digest, or nil if
+// its Algorithm is unknown.
+func (s *Signer) hash() func() hash.Hash {
+	if s.hashFunc != nil {
+		return s.hashFunc
+	}
+	return s.Algorithm.hash()
+}
+
+// secret returns the i'th secret, where the primary secret is 0 and
+// fallbacks follow it.
+func (s *Signer) secret(i int) string {
+	if i == 0 {
+		return s.Secret
+	}
+	return s.FallbackSecrets[i-1]
+}
+
+// separator returns the separator between a value and its signature.
+func (s *Signer) separator() []byte {
+	if s.sep == nil {
+		return defaultSep
+	}
+	return s.sep
+}
+
+// key returns the HMAC key for secret, derived the same way as
+// django.utils.crypto.salted_hmac: the digest of the key salt, which
+// for signing is the Signer's salt followed by "signer", and secret.
+// itsdangerous's default key derivation is the same, but Flask's
+// derives the key with HMAC.
+func (s *Signer) key(secret string) []byte {
+	salt := s.Salt
+	if salt == "" {
+		salt = SaltSigner
+	}
+	if s.scheme == Flask {
+		return s.hmacKey(salt, secret)
+	}
+	return saltedHMACKey(s.hash(), salt+"signer", secret)
+}
+
+// signature calculates a HMAC signature of value in a way that
+// matches django.core.signing.Signer.signature(), keyed by the i'th
+// secret.
+func (s *Signer) signature(i int, value []byte) []byte {
+	if s.macs != nil {
+		pool := s.macs[i]
+		mac := pool.Get().(hash.Hash)
+		mac.Reset()
+		mac.Write(value)
+		sig := b64Encode(mac.Sum(nil))
+		pool.Put(mac)
+		return sig
+	}
+	mac := hmac.New(s.hash(), s.key(s.secret(i)))
+	mac.Write(value)
+	return b64Encode(mac.Sum(nil))
+}
+
+// Sign returns value with its signature appended, matching
+// django.core.signing.Signer.sign().  It panics if Algorithm is not a
+// known Algorithm.
+func (s *Signer) Sign(value []byte) []byte {
+	sep := s.separator()
+	sig := s.signature(0, value)
+	signed := make([]byte, 0, len(value)+len(sep)+len(sig))
+	signed = append(signed, value...)
+	signed = append(signed, sep...)
+	return append(signed, sig...)
+}
+
+// Unsign returns the value signed has been signed with if its
+// signature matches under Secret or any of FallbackSecrets, or an
+// error otherwise.  The signature follows the last separator in
+// signed.  A mismatch is reported as ErrSignatureMismatch, without
+// either signature.
+func (s *Signer) Unsign(signed []byte) ([]byte, error) {
+	val, _, err := s.unsign(signed)
+	return val, err
+}
+
+// unsign is like Unsign, but additionally returns the index of the
+// secret the signature matched under: 0 for Secret, and i+1 for
+// FallbackSecrets[i].
+func (s *Signer) unsign(signed []byte) ([]byte, int, error) {
+	if s.hash() == nil {
+		return nil, 0, fmt.Errorf("unknown algorithm: %d", s.Algorithm)
+	}
+	sep := s.separator()
+	i := bytes.LastIndex(signed, sep)
+	if i == -1 {
+		return nil, 0, fmt.Errorf("%w: expected %s in '%s'", ErrMalformed, sep, string(signed))
+	}
+	val := signed[:i]
+	sig := signed[i+len(sep):]
+	expectedSig := s.signature(0, val)
+	match := s.matchFirst
+	if s.allSecrets {
+		match = s.matchAll
+	}
+	if key, ok := match(val, sig, expectedSig); ok {
+		return val, key, nil
+	}
+	// the expected signature is a valid one for val, so it is only
+	// reported when debugging.  If none match, it is the one
+	// expected under the current secret rather than the last
+	// fallback.
+	if s.debug {
+		return nil, 0, fmt.Errorf("%w: '%s' != '%s'", ErrSignatureMismatch, sig, string(expectedSig))
+	}
+	return nil, 0, ErrSignatureMismatch
+}
+
+// matchFirst compares sig to the signature of val under each secret
+// in turn, expectedSig being the primary secret's, and returns the
+// index of the first that matches.
+func (s *Signer) matchFirst(val, sig, expectedSig []byte) (int, bool) {
+	if subtle.ConstantTimeCompare(sig, expectedSig) == 1 {
+		return 0, true
+	}
+	for i := range s.FallbackSecrets {
+		if subtle.ConstantTimeCompare(sig, s.signature(i+1, val)) == 1 {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// matchAll is like matchFirst, but always computes and compares the
+// signature under every secret, so that the comparisons, and the
+// choice of index, take the same time whichever secret matches.
+func (s *Signer) matchAll(val, sig, expectedSig []byte) (int, bool) {
+	matched, key := subtle.ConstantTimeCompare(sig, expectedSig), 0
+	for i := range s.FallbackSecrets {
+		eq := subtle.ConstantTimeCompare(sig, s.signature(i+1, val))
+		key = subtle.ConstantTimeSelect(eq&^matched, i+1, key)
+		matched |= eq
+	}
+	return key, matched == 1
+}
+
+// A TimestampSigner signs and verifies values along with the time
+// they were signed at, the same way as
+// django.core.signing.TimestampSigner.  An empty Salt means the salt
+// Django's TimestampSigner uses by default.
+type TimestampSigner struct {
+	Signer
+
+	clock func() time.Time // if nil, time.Now
+
+	// if checkSkew is set, values signed more than maxSkew in the
+	// future are rejected.
+	checkSkew bool
+	maxSkew   time.Duration
+
+	leeway time.Duration // added to the max age when checking expiry
+}
+
+// signer returns the Signer used for the timestamped value, with
+// TimestampSigner's default salt applied.
+func (s *TimestampSigner) signer() *Signer {
+	if s.Salt != "" {
+		return &s.Signer
+	}
+	signer := s.Signer
+	signer.Salt = SaltTimestampSigner
+	signer.macs = nil // keyed with the empty salt
+	return &signer
+}
+
+// now returns the current time according to the signer's clock.
+func (s *TimestampSigner) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
+
+// Sign appends the current time to value, and signs the result,
+// matching django.core.signing.TimestampSigner.sign().
+func (s *TimestampSigner) Sign(value []byte) []byte {
+	return s.SignAt(value, s.now())
+}
+
+// SignAt is like Sign, but appends signedAt rather than the current
+// time, for uses such as deterministic tests, or re-signing a value
+// with a new key while keeping the time it was originally signed at.
+func (s *TimestampSigner) SignAt(value []byte, signedAt time.Time) []byte {
+	sep := s.separator()
+	ts := s.encodeTimestamp(signedAt)
+	val := make([]byte, 0, len(value)+len(sep)+len(ts))
+	val = append(val, value...)
+	val = append(val, sep...)
+	val = append(val, ts...)
+	return s.signer().Sign(val)
+}
+
+// Unsign returns the value signed has been signed with, if its
+// signature is valid and it was signed no more than maxAge ago.  A
+// maxAge of zero or less disables the age check, like passing
+// max_age=None to Django.
+func (s *TimestampSigner) Unsign(signed []byte, maxAge time.Duration) ([]byte, error) {
+	val, _, _, err := s.timestampUnsign(signed, maxAge, maxAge > 0)
+	return val, err
+}
+
+// timestampUnsign returns the value, the time it was signed at and
+// the index of the secret it was signed with if the signature is
+// valid, and, if checkAge is set, the value was signed no more than
+// maxAge ago.  It wraps Signer.unsign.
+func (s *TimestampSigner) timestampUnsign(signed []byte, maxAge time.Duration, checkAge bool) ([]byte, time.Time, int, error) {
+	val, issued, key, _, err := s.timestampUnsignStage(signed, maxAge, checkAge)
+	return val, issued, key, err
+}
+
+// timestampUnsignStage is like timestampUnsign, but additionally
+// returns the Stage that failed, if any.
+func (s *TimestampSigner) timestampUnsignStage(signed []byte, maxAge time.Duration, checkAge bool) ([]byte, time.Time, int, Stage, error) {
+	val, key, err := s.signer().unsign(signed)
+	if err != nil {
+		// signed is a bearer credential, so it is only reported
+		// when debugging.
+		if s.debug {
+			return nil, time.Time{}, 0, StageSignature, fmt.Errorf("unsign('%s'): %w", string(signed), err)
+		}
+		return nil, time.Time{}, 0, StageSignature, fmt.Errorf("unsign: %w", err)
+	}
+	val, issued, err := s.splitTimestamp(val)
+	if err != nil {
+		return nil, time.Time{}, 0, StageTimestamp, err
+	}
+	if checkAge && s.expired(issued, maxAge) {
+		return nil, time.Time{}, 0, StageTimestamp, fmt.Errorf("%w: %d", ErrExpired, issued.Unix())
+	}
+	return val, issued, key, StageTimestamp, nil
+}
+
+// maxTimestampLen bounds the length of an encoded timestamp: a
+// base62 int64 is at most 11 digits and a sign, and itsdangerous's
+// base64 of 8 bytes is 11 characters.  Longer timestamps are rejected
+// as malformed before they are decoded.
+const maxTimestampLen = 12
+
+// splitTimestamp splits the value unsigned by Signer.Unsign into the
+// original value and the time it was signed at.  The value itself may
+// contain the separator: the timestamp is appended last, and its
+// alphabet of A-z0-9-_ can't contain a separator WithSeparator
+// accepts, so it follows the last one, as for Django's rsplit.
+func (s *TimestampSigner) splitTimestamp(val []byte) ([]byte, time.Time, error) {
+	sep := s.separator()
+	i := bytes.LastIndex(val, sep)
+	if i == -1 {
+		return nil, time.Time{}, fmt.Errorf("%w: expected %s in '%s'", ErrNoTimestamp, sep, string(val))
+	}
+	stamp := val[i+len(sep):]
+	if len(stamp) == 0 {
+		return nil, time.Time{}, fmt.Errorf("%w: empty timestamp", ErrMalformed)
+	}
+	if len(stamp) > maxTimestampLen {
+		return nil, time.Time{}, fmt.Errorf("%w: timestamp too long: %d bytes", ErrMalformed, len(stamp))
+	}
+	issued, err := s.decodeTimestamp(stamp)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return val[:i], issued, nil
+}
+
+// expired reports whether a value signed at issued is more than
+// maxAge old, or more than the maximum clock skew in the future.
+// Unlike Django, which has no such limit, itsdangerous rejects values
+// signed in the future by default.
+func (s *TimestampSigner) expired(issued time.Time, maxAge time.Duration) bool {
+	now := s.now()
+	if s.checkSkew {
+		if issued.After(now.Add(s.maxSkew)) {
+			return true
+		}
+	} else if s.scheme != Django && issued.After(now) {
+		return true
+	}
+	return issued.Add(maxAge + s.leeway).Before(now)
+}
+
+// EqualCookies reports whether two cookies are equal, in time that
+// doesn't depend on their contents, as comparing signed values with
+// == does.  Only their lengths, which are public anyway, may be
+// inferred from the time taken.
+func EqualCookies(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,215 @@
+package signedcookie
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const signerSecret = "70e97f01975bb59ae8804ca164081c46034042aa913a4dac055cad6a7e188bd1"
+
+func TestSigner(t *testing.T) {
+	cases := []struct {
+		signer Signer
+		signed string
+	}{
+		{Signer{Secret: signerSecret, Algorithm: SHA256}, "hello:np0Cq5WTRsWiO-jvZVLpXR9uLFWXX5ZFs6n3T_OKz_8"},
+		{Signer{Secret: signerSecret, Salt: "myapp"}, "hello:MOEtuChZdr3qPiVvSw4pa2JQ8EM"},
+	}
+	for _, c := range cases {
+		if signed := c.signer.Sign([]byte("hello")); string(signed) != c.signed {
+			t.Errorf("Sign: %s != %s", signed, c.signed)
+		}
+		value, err := c.signer.Unsign([]byte(c.signed))
+		if err != nil {
+			t.Errorf("Unsign(%s): %s", c.signed, err)
+		} else if string(value) != "hello" {
+			t.Errorf("Unsign(%s): %s != hello", c.signed, value)
+		}
+	}
+
+	s := Signer{Secret: "new-secret", Salt: "myapp"}
+	if _, err := s.Unsign([]byte(cases[1].signed)); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch, got %v", err)
+	}
+	s.FallbackSecrets = []string{signerSecret}
+	if _, err := s.Unsign([]byte(cases[1].signed)); err != nil {
+		t.Errorf("Unsign with fallback: %s", err)
+	}
+	if _, err := s.Unsign([]byte("hello")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
+
+// generated by django.core.signing.Signer(key=secret,
+// salt=salt, algorithm=algorithm).sign('hello'), for short secrets
+// and a variety of salts.  An empty salt stands for Signer's default.
+var saltedSignerData = []struct {
+	secret    string
+	salt      string
+	algorithm Algorithm
+	signed    string
+}{
+	{"s", "", SHA1, "hello:5kGIIOlr1e2YNGvEOJkpfpTWfLM"},
+	{"s", "", SHA256, "hello:BzpIIanV5aOOIwuosmTVwwYqLTeNV-RlQ99kk9UoESs"},
+	{"s", "a", SHA1, "hello:RUQqBCqsQamJLS6_cTYidrui0n4"},
+	{"s", "a", SHA256, "hello:3pDVsrDOMFkzEq3ssIQ8n3bYfx5nybpcihxJY7B0_6g"},
+	{"s", "myapp", SHA1, "hello:fnbinTEq3Hio5O-0gN_L0aiBRcU"},
+	{"s", "myapp", SHA256, "hello:Qj1yN0ccoBWZVC89hWn66ucLFLc6_Ulb6suxLgKr2B8"},
+	{"s", "sälz", SHA1, "hello:5cqOi1_X5plq8zAMkBNKTYN_pu8"},
+	{"s", "sälz", SHA256, "hello:6kVZq2Sj6HrNjDF-4HRP9tpQH86z0cbY2skiG-qmsNs"},
+	{"s", strings.Repeat("x", 100), SHA1, "hello:-AY5U5GOa1TELVD1CKDUkDsvxRE"},
+	{"s", strings.Repeat("x", 100), SHA256, "hello:3fIvQuSUlwUdIrWs3GbLlRtrHwbSJwQSjF6KvBArpw4"},
+	{"secret", "", SHA1, "hello:AmyOTQY9JAikz0u2GebORkTo4LA"},
+	{"secret", "", SHA256, "hello:FRBs_KKrjaVe9zJEdlQdiuJ2n9jBEsFOL1Capquoa18"},
+	{"secret", "a", SHA1, "hello:EW9iDnzIYunmrXwKgwhLXQgFTcc"},
+	{"secret", "a", SHA256, "hello:sAL97cRG1645JWuz7FD1DGWnd9eItgREYRyTq7FSx_U"},
+	{"secret", "myapp", SHA1, "hello:yb7sqv54mjEX5AJcGJ0wwChqk5M"},
+	{"secret", "myapp", SHA256, "hello:Beg-T8i23qpaccAvdZoEqte-EVvdME-0kIJXDSmZgRo"},
+	{"secret", "myapp", SHA384, "hello:uYxQLpl0N9Fita07epwsKhPMni_h_Fyf6gupafCDEmjQKtkW9E6mFb_5zEK_NYe3"},
+	{"secret", "myapp", SHA512, "hello:MHOAifIS9DyU28VCi1Y0Ul4_g7fPCayOWqRjDbvm_liZamMVnJvyICnNkIRvliEhaE9F7ColNXgRqLodMiUziw"},
+	{"secret", "sälz", SHA1, "hello:mHyDprON-uT4hsTALYTabWcDrWg"},
+	{"secret", "sälz", SHA256, "hello:kQr_VfTIfSpk9g4HkxqOh0BH2dle99JiyynSpYhWw_Q"},
+	{"secret", strings.Repeat("x", 100), SHA1, "hello:5hTcF4ysct9IyKtstT5iF86Gfbw"},
+	{"secret", strings.Repeat("x", 100), SHA256, "hello:wbzg21p0xGOI6DDRlJQEuK4c3S_DUrchfXOhkYs4ePA"},
+}
+
+func TestSignerSalts(t *testing.T) {
+	for _, c := range saltedSignerData {
+		s := Signer{Secret: c.secret, Salt: c.salt, Algorithm: c.algorithm}
+		if signed := s.Sign([]byte("hello")); string(signed) != c.signed {
+			t.Errorf("Sign(%q, %q, %d): %s != %s", c.secret, c.salt, c.algorithm, signed, c.signed)
+		}
+		if _, err := s.Unsign([]byte(c.signed)); err != nil {
+			t.Errorf("Unsign(%s): %s", c.signed, err)
+		}
+	}
+}
+
+func TestTimestampSigner(t *testing.T) {
+	const signed = "hello:1XdpWy:1osoQIToQUVr-j3lahPKItmRKZSQXX3TuSq_-9dzYjM"
+	signedAt := time.Unix(1413244800, 0)
+	s := TimestampSigner{
+		Signer: Signer{Secret: signerSecret, Algorithm: SHA256},
+		clock:  func() time.Time { return signedAt.Add(time.Hour) },
+	}
+	if out := s.SignAt([]byte("hello"), signedAt); string(out) != signed {
+		t.Errorf("sign: %s != %s", out, signed)
+	}
+	value, err := s.Unsign([]byte(signed), 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Unsign: %s", err)
+	}
+	if string(value) != "hello" {
+		t.Errorf("Unsign: %s != hello", value)
+	}
+	if _, err = s.Unsign([]byte(signed), time.Minute); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+	if _, err = s.Unsign([]byte(signed), 0); err != nil {
+		t.Errorf("Unsign without max age: %s", err)
+	}
+
+	// values may contain the separator, even followed by something
+	// that looks like a timestamp.
+	for _, c := range []struct {
+		value, sep, signed string
+	}{
+		{"a:b:", ":", "a:b::1XdpWy:B6NrMJHLbLfE8Kgbr7kMhfKivh0jLdGVuNliXbTJ9cs"},
+		{"x:::", "::", "x:::::1XdpWy::h2pqPwcjFdT30pcfuUKhRbOO6UyuuPowufn2zSg4n10"},
+		{"1XdpWy/a/", "/", "1XdpWy/a//1XdpWy/9qMzx-kDTY7V0CG8oOd8ShDugQ2QHFyCb5bbWrs4Ep4"},
+	} {
+		s := TimestampSigner{Signer: Signer{Secret: signerSecret, Salt: "myapp", Algorithm: SHA256, sep: []byte(c.sep)}}
+		if out := s.SignAt([]byte(c.value), signedAt); string(out) != c.signed {
+			t.Errorf("sign(%q): %s != %s", c.value, out, c.signed)
+		}
+		value, issued, _, err := s.timestampUnsign([]byte(c.signed), 0, false)
+		if err != nil || string(value) != c.value || !issued.Equal(signedAt) {
+			t.Errorf("Unsign(%s): %q, %s, %v", c.signed, value, issued, err)
+		}
+	}
+
+	long := s.signer().Sign([]byte("hello:" + strings.Repeat("1", maxTimestampLen+1)))
+	if _, err = s.Unsign(long, 0); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for a long timestamp, got %v", err)
+	}
+	empty := s.signer().Sign([]byte("hello:"))
+	if _, err = s.Unsign(empty, 0); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed for an empty timestamp, got %v", err)
+	}
+
+	// a value signed now round trips with the default clock.
+	s.clock = nil
+	if _, err = s.Unsign(s.Sign([]byte("hello")), time.Minute); err != nil {
+		t.Errorf("Unsign(Sign): %s", err)
+	}
+}
+
+func BenchmarkSignerUnsign(b *testing.B) {
+	signed := []byte("hello:np0Cq5WTRsWiO-jvZVLpXR9uLFWXX5ZFs6n3T_OKz_8")
+	prepared := Signer{Secret: signerSecret, Algorithm: SHA256}
+	prepared.prepare()
+	for _, c := range []struct {
+		name   string
+		signer Signer
+	}{
+		{"unprepared", Signer{Secret: signerSecret, Algorithm: SHA256}},
+		{"prepared", prepared},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.signer.Unsign(signed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEqualCookies(t *testing.T) {
+	cookie := decodeData[1].cookie
+	for _, c := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{cookie, cookie, true},
+		{cookie, string([]byte(cookie)), true},
+		{"", "", true},
+		{cookie, cookie[:len(cookie)-1] + "x", false},
+		{cookie, cookie[:len(cookie)-1], false},
+		{cookie, "", false},
+	} {
+		if equal := EqualCookies(c.a, c.b); equal != c.equal {
+			t.Errorf("EqualCookies(%q, %q): %v", c.a, c.b, equal)
+		}
+	}
+}
+
+func TestSignerKeyDerivation(t *testing.T) {
+	// salted_hmac has hashed the key salt and secret into the HMAC
+	// key since it was introduced, so a signature keyed with their
+	// raw concatenation must not verify.  (Keys longer than the
+	// digest's block size are hashed by HMAC itself, so a short
+	// salt is needed to tell them apart.)
+	c := struct {
+		secret, salt, signed string
+		algorithm            Algorithm
+	}{"secret", "myapp", "hello:Beg-T8i23qpaccAvdZoEqte-EVvdME-0kIJXDSmZgRo", SHA256}
+	s := Signer{Secret: c.secret, Salt: c.salt, Algorithm: c.algorithm}
+	mac := hmac.New(sha256.New, []byte(c.salt+"signer"+c.secret))
+	mac.Write([]byte("hello"))
+	raw := "hello:" + string(b64Encode(mac.Sum(nil)))
+	if raw == c.signed {
+		t.Fatalf("raw key produced Django's signature")
+	}
+	if _, err := s.Unsign([]byte(raw)); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected ErrSignatureMismatch for a raw key, got %v", err)
+	}
+	if _, err := s.Unsign([]byte(c.signed)); err != nil {
+		t.Errorf("Unsign(%s): %s", c.signed, err)
+	}
+}
@@ -0,0 +1,88 @@
+#!/usr/bin/env python3
+# Copyright 2014 Bobby Powers. All rights reserved.
+# Use of this source code is governed by the MIT
+# license that can be found in the LICENSE file.
+
+"""Generates and checks signed cookies with django.core.signing.
+
+Used by TestDjangoLive, which runs it with the interpreter named by
+the DJANGO_PYTHON environment variable.
+
+    django_signing.py dump   prints a JSON list of signed cookies
+    django_signing.py loads  reads a JSON list of cookies from stdin,
+                             and prints the objects they contain
+"""
+
+import json
+import pickle
+import sys
+
+from django.conf import settings
+
+SECRET = 'django-live-secret'
+SALT = 'django.contrib.sessions.backends.signed_cookies'
+
+settings.configure(SECRET_KEY=SECRET, SECRET_KEY_FALLBACKS=[])
+
+from django.core import signing  # noqa: E402
+
+
+class PickleSerializer:
+    """The PickleSerializer Django shipped in contrib.sessions until
+    5.0."""
+
+    protocol = pickle.HIGHEST_PROTOCOL
+
+    def dumps(self, obj):
+        return pickle.dumps(obj, self.protocol)
+
+    def loads(self, data):
+        return pickle.loads(data)
+
+
+SERIALIZERS = {'json': signing.JSONSerializer, 'pickle': PickleSerializer}
+
+OBJECTS = {
+    # too small for compression to pay off
+    'small': {'a': 'b'},
+    'large': {
+        '_auth_user_id': '1',
+        'name': 'Zo\u00eb',
+        'flags': [True, False],
+        'nested': {'padding': 'x' * 200},
+    },
+}
+
+
+def signer(algorithm):
+    return signing.TimestampSigner(key=SECRET, salt=SALT, algorithm=algorithm)
+
+
+def dump():
+    cases = []
+    for serializer in sorted(SERIALIZERS):
+        for algorithm in ('sha1', 'sha256'):
+            for compress in (False, True):
+                for name, obj in sorted(OBJECTS.items()):
+                    cookie = signer(algorithm).sign_object(
+                        obj, serializer=SERIALIZERS[serializer], compress=compress)
+                    cases.append({
+                        'serializer': serializer,
+                        'algorithm': algorithm,
+                        'compress': compress,
+                        'obj': obj,
+                        'cookie': cookie,
+                    })
+    json.dump(cases, sys.stdout)
+
+
+def loads():
+    objs = []
+    for case in json.load(sys.stdin):
+        objs.append(signer(case['algorithm']).unsign_object(
+            case['cookie'], serializer=SERIALIZERS[case['serializer']]))
+    json.dump(objs, sys.stdout)
+
+
+if __name__ == '__main__':
+    {'dump': dump, 'loads': loads}[sys.argv[1]]()
@@ -0,0 +1,202 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Stage is one of the steps of decoding a cookie, in the order they
+// are performed.
+type Stage int
+
+const (
+	// StageSignature verifies the cookie's signature.
+	StageSignature Stage = iota
+	// StageTimestamp parses the timestamp, and checks the cookie's
+	// age.
+	StageTimestamp
+	// StageBase64 base64 decodes the payload.
+	StageBase64
+	// StageDecompress decompresses the payload, if it is
+	// compressed.
+	StageDecompress
+	// StageDeserialize deserializes the payload.
+	StageDeserialize
+)
+
+var stageNames = [...]string{"signature", "timestamp", "base64", "decompress", "deserialize"}
+
+// String returns the stage's name, such as "signature".
+func (s Stage) String() string {
+	if s < 0 || int(s) >= len(stageNames) {
+		return fmt.Sprintf("Stage(%d)", int(s))
+	}
+	return stageNames[s]
+}
+
+// A StageResult records the outcome of a Stage: Err is nil if the
+// stage succeeded.
+type StageResult struct {
+	Stage Stage
+	Err   error
+}
+
+// A DecodeTrace describes how a cookie was decoded by
+// DecodeAndExplain, to help diagnose cookies that won't decode, such
+// as those signed with a different secret, salt or algorithm than
+// the Decoder expects.
+type DecodeTrace struct {
+	// Stages holds the stages attempted, in order.  Decoding stops
+	// at the first stage that fails.
+	Stages []StageResult
+	// SignedAt is the time the cookie was signed at, if its
+	// timestamp could be parsed.
+	SignedAt time.Time
+	// Compressed is set if the payload has the '.' compression
+	// prefix.
+	Compressed bool
+	// Serializer is the serializer the payload was deserialized
+	// with, as detected if the Decoder uses AutoSerializer.
+	Serializer Serializer
+
+	// CookieLen is the length of the cookie, after unquoting.
+	CookieLen int
+	// PayloadLen is the length of the base64 encoded payload,
+	// including any compression prefix.
+	PayloadLen int
+	// DecodedLen is the length of the base64 decoded payload.
+	DecodedLen int
+	// DecompressedLen is the length of the serialized payload,
+	// after decompression if the payload was compressed.
+	DecompressedLen int
+}
+
+// Err returns the error of the stage that failed, or nil if the
+// cookie was decoded.
+func (t *DecodeTrace) Err() error {
+	if len(t.Stages) == 0 {
+		return nil
+	}
+	return t.Stages[len(t.Stages)-1].Err
+}
+
+// record appends the result of stage to t, and reports whether it
+// failed.
+func (t *DecodeTrace) record(stage Stage, err error) bool {
+	t.Stages = append(t.Stages, StageResult{Stage: stage, Err: err})
+	return err != nil
+}
+
+// String returns a human readable summary of t, with one line per
+// stage.
+func (t *DecodeTrace) String() string {
+	var b strings.Builder
+	for _, r := range t.Stages {
+		fmt.Fprintf(&b, "%s: ", r.Stage)
+		if r.Err != nil {
+			fmt.Fprintf(&b, "failed: %s\n", r.Err)
+			continue
+		}
+		b.WriteString("ok")
+		switch r.Stage {
+		case StageSignature:
+			fmt.Fprintf(&b, " (%d bytes)", t.CookieLen)
+		case StageTimestamp:
+			fmt.Fprintf(&b, " (signed at %s)", t.SignedAt.UTC().Format(time.RFC3339))
+		case StageBase64:
+			fmt.Fprintf(&b, " (%d bytes to %d)", t.PayloadLen, t.DecodedLen)
+		case StageDecompress:
+			fmt.Fprintf(&b, " (%d bytes to %d)", t.DecodedLen, t.DecompressedLen)
+		case StageDeserialize:
+			fmt.Fprintf(&b, " (%s)", t.Serializer)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// DecodeAndExplain is like Decode, but additionally returns a trace
+// of each stage of decoding cookie, including the stage that failed
+// if cookie couldn't be decoded.  It is meant for diagnostics, and is
+// slower than Decode.
+func (d *Decoder) DecodeAndExplain(cookie string) (map[string]interface{}, *DecodeTrace, error) {
+	t := &DecodeTrace{Serializer: d.serializer}
+	if err := d.checkLength([]byte(cookie)); err != nil {
+		t.record(StageSignature, err)
+		return nil, t, err
+	}
+	c := unquoteCookie([]byte(cookie))
+	t.CookieLen = len(c)
+
+	signer, err := d.timestampSigner(c)
+	if err != nil {
+		t.record(StageSignature, err)
+		return nil, t, err
+	}
+	val, err := signer.signer().Unsign(c)
+	if t.record(StageSignature, err) {
+		if signer.debug {
+			return nil, t, fmt.Errorf("unsign('%s'): %w", string(c), err)
+		}
+		return nil, t, fmt.Errorf("unsign: %w", err)
+	}
+
+	payload, issued, err := signer.splitTimestamp(val)
+	if err == nil {
+		t.SignedAt = issued
+		if !d.noExpiry && signer.expired(issued, d.maxAge) {
+			err = fmt.Errorf("%w: %d", ErrExpired, issued.Unix())
+		}
+	}
+	if t.record(StageTimestamp, err) {
+		return nil, t, err
+	}
+
+	t.PayloadLen = len(payload)
+	payload, t.Compressed, err = splitCompressed(payload)
+	if err == nil {
+		if payload, err = b64Decode(payload); err != nil {
+			err = fmt.Errorf("%w: base64Decode: %w", ErrMalformed, err)
+		}
+	}
+	if t.record(StageBase64, err) {
+		return nil, t, err
+	}
+	t.DecodedLen = len(payload)
+
+	if t.Compressed {
+		payload, err = decompressPayload(payload, d.compressor, d.maxDecompressedSize)
+		if t.record(StageDecompress, err) {
+			return nil, t, err
+		}
+	}
+	t.DecompressedLen = len(payload)
+
+	var o map[string]interface{}
+	if t.Serializer == AutoSerializer {
+		// record the serializer that worked, or if neither did,
+		// the one detected.
+		err = autoDeserialize(payload, func(s Serializer) (err error) {
+			t.Serializer = s
+			o, err = deserialize(s, payload)
+			return err
+		})
+		if err != nil {
+			t.Serializer = DetectSerializer(payload)
+		}
+	} else {
+		o, err = deserialize(t.Serializer, payload)
+	}
+	if err != nil {
+		err = fmt.Errorf("deserialize: %w", err)
+	}
+	if t.record(StageDeserialize, err) {
+		return nil, t, err
+	}
+	return o, t, nil
+}
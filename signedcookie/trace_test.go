@@ -0,0 +1,60 @@
+package signedcookie
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAndExplain(t *testing.T) {
+	for _, data := range decodeData {
+		decoded, trace, err := testDecoder(AutoSerializer, data.secret).DecodeAndExplain(data.cookie)
+		if err != nil {
+			t.Errorf("DecodeAndExplain(%v): %s\n%s", data.kind, err, trace)
+			continue
+		}
+		if !reflect.DeepEqual(data.decoded, decoded) {
+			t.Errorf("DeepEqual(%#v != %#v)", data.decoded, decoded)
+		}
+		if len(trace.Stages) != 5 || trace.Err() != nil {
+			t.Errorf("unexpected stages: %v", trace.Stages)
+		}
+		if !trace.Compressed || trace.Serializer != data.kind || trace.CookieLen != len(data.cookie) {
+			t.Errorf("unexpected trace: %#v", trace)
+		}
+		if _, issued, _ := testDecoder(data.kind, data.secret).DecodeWithTimestamp(data.cookie); !trace.SignedAt.Equal(issued) {
+			t.Errorf("SignedAt: %s != %s", trace.SignedAt, issued)
+		}
+		if trace.DecompressedLen <= trace.DecodedLen || trace.DecodedLen >= trace.PayloadLen {
+			t.Errorf("unexpected lengths: %#v", trace)
+		}
+	}
+
+	data := &decodeData[1]
+	cases := []struct {
+		name   string
+		d      *Decoder
+		cookie string
+		stage  Stage
+		err    error
+	}{
+		{"wrong secret", testDecoder(JSON, "wrong-secret"), data.cookie, StageSignature, ErrSignatureMismatch},
+		{"expired", testDecoder(JSON, data.secret, WithClock(testNowTimedOut)), data.cookie, StageTimestamp, ErrExpired},
+		{"not base64", testDecoder(JSON, data.secret), string((&TimestampSigner{Signer: Signer{Secret: data.secret, Salt: SaltSession, Algorithm: SHA1}}).SignAt([]byte("!!"), testNowOK())), StageBase64, ErrMalformed},
+		{"not zlib", testDecoder(JSON, data.secret), string((&TimestampSigner{Signer: Signer{Secret: data.secret, Salt: SaltSession, Algorithm: SHA1}}).SignAt([]byte(".e30"), testNowOK())), StageDecompress, ErrMalformed},
+		{"wrong serializer", testDecoder(Pickle, data.secret), data.cookie, StageDeserialize, ErrMalformed},
+	}
+	for _, c := range cases {
+		_, trace, err := c.d.DecodeAndExplain(c.cookie)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+		if last := trace.Stages[len(trace.Stages)-1]; last.Stage != c.stage || !errors.Is(last.Err, c.err) {
+			t.Errorf("%s: expected failure at %s, got %s", c.name, c.stage, trace)
+		}
+		if !strings.Contains(trace.String(), c.stage.String()+": failed") {
+			t.Errorf("%s: unexpected String: %s", c.name, trace)
+		}
+	}
+}
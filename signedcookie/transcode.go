@@ -0,0 +1,112 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bpowers/go-django/internal/github.com/kisielk/og-rek"
+)
+
+// TranscodeCookie decodes pickleCookie, a Pickle serialized session
+// signed with secret as by Decode, and returns it re-encoded as JSON,
+// signed with the same secret, the time pickleCookie was signed at and
+// the same compression, for migrating a site from PickleSerializer to
+// JSONSerializer.
+//
+// pickleCookie is verified as by a Decoder created with
+// WithSerializer(Pickle) and WithAlgorithm(SHA1), as for sessions
+// written before Django 3.1, followed by opts, which can set a
+// different algorithm, salt or fallback secrets.  The JSON cookie is
+// signed with the same configuration.
+//
+// Values JSON can't represent, such as datetimes, bytes and Decimals,
+// are omitted from the JSON cookie's dicts, and replaced with null in
+// its lists, so that the positions of the other elements are kept.
+// If there are any, the JSON cookie is returned along with an error
+// listing their paths, like "cart.items[2]", so the caller can decide
+// whether the session survives without them.
+func TranscodeCookie(secret, pickleCookie string, opts ...Option) (jsonCookie string, err error) {
+	opts = append([]Option{WithSerializer(Pickle), WithAlgorithm(SHA1)}, opts...)
+	d, err := NewDecoder(secret, opts...)
+	if err != nil {
+		return "", err
+	}
+	info, err := d.DecodeFull(pickleCookie)
+	if err != nil {
+		return "", err
+	}
+	var skipped []string
+	obj := jsonMap(info.Session, "", &skipped)
+
+	enc := *d
+	enc.serializer = JSON
+	enc.compress = info.Compressed
+	if jsonCookie, err = enc.EncodeAt(obj, info.Issued); err != nil {
+		return "", err
+	}
+	if len(skipped) > 0 {
+		return jsonCookie, fmt.Errorf("values not representable as JSON were omitted: %s", strings.Join(skipped, ", "))
+	}
+	return jsonCookie, nil
+}
+
+// jsonMap returns a copy of m holding only the values JSON can
+// represent, appending the paths of those it can't to skipped.
+func jsonMap(m map[string]interface{}, path string, skipped *[]string) map[string]interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // for a deterministic list of skipped paths
+	out := make(map[string]interface{}, len(m))
+	for _, k := range keys {
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		if v, ok := jsonValue(m[k], p, skipped); ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// jsonValue returns v as JSON would represent it, and whether it can.
+// Elements of lists that can't be represented are replaced with nil.
+func jsonValue(v interface{}, path string, skipped *[]string) (interface{}, bool) {
+	switch v := v.(type) {
+	case nil, ogórek.None:
+		return nil, true
+	case bool, int, int64, *big.Int:
+		return v, true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			break
+		}
+		return v, true
+	case string:
+		if !utf8.ValidString(v) {
+			break
+		}
+		return v, true
+	case map[string]interface{}:
+		return jsonMap(v, path, skipped), true
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i], _ = jsonValue(e, path+"["+strconv.Itoa(i)+"]", skipped)
+		}
+		return out, true
+	}
+	*skipped = append(*skipped, path)
+	return nil, false
+}
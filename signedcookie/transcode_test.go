@@ -0,0 +1,105 @@
+// Copyright 2014 Bobby Powers. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package signedcookie
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscodeCookie(t *testing.T) {
+	const secret = "transcode-secret"
+	signedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	obj := map[string]interface{}{
+		"_auth_user_id": "1",
+		"count":         int64(3),
+		"padding":       strings.Repeat("x", 200), // so compression pays off
+		"avatar":        []byte("\x89PNG"),
+		"cart":          map[string]interface{}{"items": []interface{}{"a", "b", []byte("c")}},
+		"tags":          []interface{}{"a", []byte("b"), "c"},
+	}
+	want := map[string]interface{}{
+		"_auth_user_id": "1",
+		"count":         float64(3),
+		"padding":       strings.Repeat("x", 200),
+		"cart":          map[string]interface{}{"items": []interface{}{"a", "b", nil}},
+		"tags":          []interface{}{"a", nil, "c"},
+	}
+
+	for _, compress := range []bool{false, true} {
+		d, err := NewDecoder(secret, WithSerializer(Pickle), WithAlgorithm(SHA1), WithCompression(compress))
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+		pickleCookie, err := d.EncodeAt(obj, signedAt)
+		if err != nil {
+			t.Fatalf("EncodeAt: %s", err)
+		}
+		jsonCookie, err := TranscodeCookie(secret, pickleCookie)
+		if err == nil || !strings.Contains(err.Error(), "avatar, cart.items[2], tags[1]") {
+			t.Errorf("TranscodeCookie: expected the skipped values, got %v", err)
+		}
+		if jsonCookie == "" {
+			t.Fatalf("TranscodeCookie returned no cookie")
+		}
+
+		info, err := testDecoder(JSON, secret, WithClock(time.Now)).DecodeFull(jsonCookie)
+		if err != nil {
+			t.Fatalf("DecodeFull: %s", err)
+		}
+		if !reflect.DeepEqual(want, info.Session) {
+			t.Errorf("DeepEqual(%#v != %#v)", want, info.Session)
+		}
+		if !info.Issued.Equal(signedAt) || info.Compressed != compress {
+			t.Errorf("unexpected info: %s, compressed %v", info.Issued, info.Compressed)
+		}
+	}
+
+	cookie, err := Encode(Pickle, secret, want)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if _, err = TranscodeCookie(secret, cookie); err != nil {
+		t.Errorf("TranscodeCookie: %s", err)
+	}
+	if _, err = TranscodeCookie("wrong-secret", cookie); err == nil {
+		t.Errorf("TranscodeCookie accepted the wrong secret")
+	}
+}
+
+func TestTranscodeCookieOptions(t *testing.T) {
+	const secret = "transcode-secret"
+	obj := map[string]interface{}{"_auth_user_id": "1"}
+	opts := []Option{WithAlgorithm(SHA256), WithSalt("custom.salt")}
+	d, err := NewDecoder(secret, append([]Option{WithSerializer(Pickle)}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	pickleCookie, err := d.Encode(obj)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if _, err = TranscodeCookie(secret, pickleCookie); err == nil {
+		t.Errorf("TranscodeCookie accepted a SHA256 cookie by default")
+	}
+	jsonCookie, err := TranscodeCookie(secret, pickleCookie, opts...)
+	if err != nil {
+		t.Fatalf("TranscodeCookie: %s", err)
+	}
+	// the JSON cookie is signed the same way.
+	jd, err := NewDecoder(secret, opts...)
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	decoded, err := jd.Decode(jsonCookie)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !reflect.DeepEqual(obj, decoded) {
+		t.Errorf("DeepEqual(%#v != %#v)", obj, decoded)
+	}
+}